@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/health"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// ProvideHealthChecker creates the dependency checker with the database and
+// broker checks. The consumer registers its own checks once created.
+func ProvideHealthChecker(pool *db.Pool, conn *mq.Connection) *health.Checker {
+	checker := health.NewChecker()
+
+	checker.Register("database", health.Readiness, func(ctx context.Context) error {
+		return pool.Ping(ctx)
+	})
+	checker.Register("rabbitmq_connection", health.Readiness, func(ctx context.Context) error {
+		if !conn.IsConnected() {
+			return mq.ErrNotConnected
+		}
+		return nil
+	})
+
+	return checker
+}
+
+// registerConsumerChecks adds the consumer checks to the checker
+func registerConsumerChecks(checker *health.Checker, consumer *mq.Consumer) {
+	checker.Register("consumer_channel", health.Readiness, func(ctx context.Context) error {
+		if !consumer.IsChannelOpen() {
+			return errors.New("consumer channel is closed")
+		}
+		return nil
+	})
+	checker.Register("consumer", health.Liveness, func(ctx context.Context) error {
+		if !consumer.IsRunning() {
+			return errors.New("consumer loop is not running")
+		}
+		return nil
+	})
+}
+
+// startHTTPServer serves the health endpoints and Prometheus metrics on
+// SERVICE_PORT
+func startHTTPServer(lc fx.Lifecycle, cfg *config.Config, pool *db.Pool, checker *health.Checker, logger *zap.Logger) error {
+	if err := metrics.RegisterPool(pool); err != nil {
+		return fmt.Errorf("failed to register pool metrics: %w", err)
+	}
+
+	server := health.NewServer(lc, cfg.ServicePort, checker, logger)
+	server.Handle("GET /metrics", metrics.Handler())
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/joho/godotenv"
 	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/tracing"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
@@ -53,19 +54,27 @@ func main() {
 		fmt.Println("No .env file found, using system environment variables (OK for pods/containers)")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
 	app := fx.New(
 		fx.Provide(
 			config.Load,
 			newLogger,
 			ProvideDBPool,
 			ProvideRepository,
+			ProvideClientResolver,
+			ProvideBaselineCache,
+			ProvideSeasonalCache,
 			ProvideAnomalyDetector,
 			ProvideValidator,
 			ProvideMQConnection,
 			ProvidePublisher,
 			ProvideProcessorService,
+			ProvideHealthChecker,
 		),
-		fx.Invoke(startWorker),
+		fx.Invoke(tracing.Setup, autoMigrate, startHTTPServer, startWorker, startOutboxRelay, startOfflineMonitor, startPartitionMaintainer, startRollupRefresher, startRetentionPurger),
 	)
 
 	// Setup signal handling for graceful shutdown
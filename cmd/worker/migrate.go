@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/logging"
+	"github.com/septivank/energy-metering-worker/internal/migrate"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const migrateUsage = `usage: worker migrate <command>
+
+commands:
+  up         apply all pending migrations
+  down [n]   revert the latest n applied migrations (default 1)
+  status     list migrations and whether they are applied`
+
+// runMigrate runs the migrate subcommand and returns the exit code
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	cfg, err := config.LoadDatabase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	logger, err := logging.NewLogger(getServiceName())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer logger.Sync()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pool, err := pgxpool.New(ctx, cfg.URL)
+	if err != nil {
+		logger.Error("failed to create connection pool", zap.Error(err))
+		return 1
+	}
+	defer pool.Close()
+
+	migrator, err := migrate.New(pool, cfg.Storage, logger)
+	if err != nil {
+		logger.Error("failed to load migrations", zap.Error(err))
+		return 1
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			logger.Error("migration failed", zap.Error(err))
+			return 1
+		}
+		logger.Info("database is up to date", zap.Int("applied", len(applied)))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid number of steps %q\n", args[1])
+				return 2
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			logger.Error("migration revert failed", zap.Error(err))
+			return 1
+		}
+		logger.Info("migrations reverted", zap.Int("reverted", len(reverted)))
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			logger.Error("failed to get migration status", zap.Error(err))
+			return 1
+		}
+		printMigrationStatus(statuses)
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	return 0
+}
+
+func printMigrationStatus(statuses []migrate.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tVARIANT\tSTATUS\tAPPLIED AT")
+	for _, s := range statuses {
+		state, appliedAt := "pending", "-"
+		if s.AppliedAt != nil {
+			state, appliedAt = "applied", s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		switch {
+		case s.Modified:
+			state = "modified"
+		case s.Missing:
+			state = "missing"
+		}
+		variant := s.Variant
+		if variant == "" {
+			variant = "-"
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\t%s\n", s.Version, s.Name, variant, state, appliedAt)
+	}
+	w.Flush()
+}
+
+// getServiceName returns the configured service name, for commands that do
+// not load the full configuration
+func getServiceName() string {
+	if name := os.Getenv("SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "energy-metering-worker"
+}
+
+// autoMigrate applies pending migrations on start when DB_AUTO_MIGRATE is
+// set, before the consumer and background jobs start
+func autoMigrate(lc fx.Lifecycle, pool *db.Pool, cfg *config.Config, logger *zap.Logger) error {
+	if !cfg.Database.AutoMigrate {
+		return nil
+	}
+
+	migrator, err := migrate.New(pool, cfg.Database.Storage, logger)
+	if err != nil {
+		return err
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			applied, err := migrator.Up(ctx)
+			if err != nil {
+				return fmt.Errorf("[DATABASE] failed to migrate schema: %w", err)
+			}
+			logger.Info("database schema migrated", zap.Int("applied", len(applied)))
+			return nil
+		},
+	})
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/septivank/energy-metering-worker/internal/anomaly"
 	"github.com/septivank/energy-metering-worker/internal/config"
 	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/health"
 	"github.com/septivank/energy-metering-worker/internal/mq"
 	"github.com/septivank/energy-metering-worker/internal/repository"
 	"github.com/septivank/energy-metering-worker/internal/service"
@@ -20,6 +21,7 @@ func startWorker(
 	cfg *config.Config,
 	logger *zap.Logger,
 	processor *service.ProcessorService,
+	checker *health.Checker,
 ) (*mq.Consumer, error) {
 	// Create context for consumer that will be cancelled on shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -31,6 +33,12 @@ func startWorker(
 		Exchange:         cfg.RabbitMQ.IngestExchange,
 		RoutingKey:       cfg.RabbitMQ.IngestRoutingKey,
 		PrefetchCount:    cfg.RabbitMQ.PrefetchCount,
+		RetryDelays:      cfg.RabbitMQ.RetryDelays,
+		MaxRetries:       cfg.RabbitMQ.MaxRetries,
+		ConfirmTimeout:   cfg.RabbitMQ.PublishConfirmTimeout,
+		Concurrency:      cfg.RabbitMQ.Concurrency,
+		ShardKey:         service.ShardKey,
+		Backoff:          reconnectBackoff(cfg),
 		Logger:           logger,
 		MessageProcessor: processor.ProcessMessage,
 	})
@@ -38,17 +46,22 @@ func startWorker(
 		cancel()
 		return nil, err
 	}
+	registerConsumerChecks(checker, consumer)
 
 	// Register lifecycle hooks
 	lc.Append(fx.Hook{
 		OnStart: func(startCtx context.Context) error {
 			logger.Info("starting worker consumer",
 				zap.String("queue", cfg.RabbitMQ.IngestQueue),
-				zap.Int("prefetch", cfg.RabbitMQ.PrefetchCount))
+				zap.Int("prefetch", cfg.RabbitMQ.PrefetchCount),
+				zap.Int("concurrency", cfg.RabbitMQ.Concurrency))
 			return consumer.Start(ctx)
 		},
 		OnStop: func(stopCtx context.Context) error {
 			cancel()
+			if err := consumer.Wait(stopCtx); err != nil {
+				logger.Warn("consumer did not drain before shutdown deadline", zap.Error(err))
+			}
 			if err := consumer.Close(); err != nil {
 				logger.Error("failed to close consumer", zap.Error(err))
 				return err
@@ -66,31 +79,203 @@ func ProvideRepository(pool *db.Pool) *repository.Repository {
 	return repository.NewRepository(pool)
 }
 
-// ProvideAnomalyDetector creates a new anomaly detector instance
-func ProvideAnomalyDetector(cfg *config.Config) *anomaly.Detector {
-	return anomaly.NewDetector(cfg.Anomaly.SpikeThreshold, cfg.Anomaly.MinDataPointsForDetection)
+// ProvideAnomalyDetector creates the chain of anomaly strategies named in
+// ANOMALY_DETECTORS
+func ProvideAnomalyDetector(cfg *config.Config, seasonal *service.SeasonalCache, logger *zap.Logger) (anomaly.Strategy, error) {
+	chain, err := anomaly.NewChainFromConfig(cfg.Anomaly, anomaly.Deps{Seasonal: seasonal})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("anomaly detectors configured", zap.Strings("detectors", cfg.Anomaly.Detectors))
+	return chain, nil
 }
 
-// ProvideValidator creates a new validator instance
-func ProvideValidator(cfg *config.Config) *validator.Validator {
-	return validator.NewValidator(cfg.Validation.TimestampToleranceMinutes)
+// ProvideValidator creates a new validator instance, loading the rules file
+// named by VALIDATION_RULES_FILE if set
+func ProvideValidator(cfg *config.Config, logger *zap.Logger) (*validator.Validator, error) {
+	var rules []validator.Rule
+	if cfg.Validation.RulesFile != "" {
+		var err error
+		rules, err = validator.LoadRules(cfg.Validation.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("validation rules loaded",
+			zap.String("file", cfg.Validation.RulesFile),
+			zap.Int("rules_count", len(rules)),
+		)
+	}
+
+	return validator.NewValidatorWithConfig(cfg.Validation.TimestampToleranceMinutes, validator.Config{
+		Counters: validator.CounterConfig{
+			Metrics:     cfg.Validation.CounterMetrics,
+			RolloverMax: cfg.Validation.CounterRolloverMax,
+			ResetMax:    cfg.Validation.CounterResetMax,
+		},
+		ConsistencyRules: cfg.Validation.ConsistencyRules,
+		Rules:            rules,
+	})
 }
 
 // ProvidePublisher creates a new publisher instance
 func ProvidePublisher(conn *mq.Connection, cfg *config.Config, logger *zap.Logger) (*mq.Publisher, error) {
-	return mq.NewPublisher(conn, cfg.RabbitMQ.WorkerExchange, logger)
+	return mq.NewPublisher(conn, cfg.RabbitMQ.WorkerExchange, cfg.RabbitMQ.PublishConfirmTimeout, logger)
 }
 
 // ProvideProcessorService creates a new processor service instance
 func ProvideProcessorService(
 	repo *repository.Repository,
-	publisher *mq.Publisher,
-	detector *anomaly.Detector,
+	clients *service.ClientResolver,
+	baselines *service.BaselineCache,
+	detector anomaly.Strategy,
 	validator *validator.Validator,
 	cfg *config.Config,
 	logger *zap.Logger,
 ) *service.ProcessorService {
-	return service.NewProcessorService(repo, publisher, detector, validator, cfg, logger)
+	return service.NewProcessorService(repo, clients, baselines, detector, validator, cfg, logger)
+}
+
+// ProvideClientResolver creates the client resolver and runs its
+// last_seen_at flusher for the lifetime of the application
+func ProvideClientResolver(lc fx.Lifecycle, repo *repository.Repository, cfg *config.Config, logger *zap.Logger) *service.ClientResolver {
+	resolver := service.NewClientResolver(repo, cfg.Client, logger)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			resolver.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return resolver.Stop(ctx)
+		},
+	})
+
+	return resolver
+}
+
+// ProvideSeasonalCache creates the cache of seasonal bucket statistics
+func ProvideSeasonalCache(repo *repository.Repository, cfg *config.Config) *service.SeasonalCache {
+	return service.NewSeasonalCache(repo, cfg.Anomaly.SeasonalCacheMaxEntries, cfg.Anomaly.SeasonalCacheTTL)
+}
+
+// ProvideBaselineCache creates the in-memory anomaly baseline cache
+func ProvideBaselineCache(repo *repository.Repository, cfg *config.Config) *service.BaselineCache {
+	return service.NewBaselineCache(repo, cfg.Anomaly.HistoryWindow, cfg.Anomaly.BaselineCacheMaxEntries, cfg.Anomaly.BaselineCacheTTL)
+}
+
+// startOutboxRelay runs the outbox relay for the lifetime of the application
+func startOutboxRelay(
+	lc fx.Lifecycle,
+	repo *repository.Repository,
+	publisher *mq.Publisher,
+	cfg *config.Config,
+	logger *zap.Logger,
+) *service.OutboxRelay {
+	relay := service.NewOutboxRelay(repo, publisher, cfg.Outbox, logger)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			relay.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return relay.Stop(ctx)
+		},
+	})
+
+	return relay
+}
+
+// startOfflineMonitor runs the offline meter check for the lifetime of the
+// application
+func startOfflineMonitor(
+	lc fx.Lifecycle,
+	repo *repository.Repository,
+	cfg *config.Config,
+	logger *zap.Logger,
+) *service.OfflineMonitor {
+	monitor := service.NewOfflineMonitor(repo, cfg, logger)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			monitor.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return monitor.Stop(ctx)
+		},
+	})
+
+	return monitor
+}
+
+// startPartitionMaintainer runs the reading partition job for the lifetime
+// of the application
+func startPartitionMaintainer(
+	lc fx.Lifecycle,
+	repo *repository.Repository,
+	cfg *config.Config,
+	logger *zap.Logger,
+) *service.PartitionMaintainer {
+	maintainer := service.NewPartitionMaintainer(repo, cfg, logger)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			maintainer.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return maintainer.Stop(ctx)
+		},
+	})
+
+	return maintainer
+}
+
+// startRollupRefresher runs the reading rollup refresh for the lifetime of
+// the application
+func startRollupRefresher(
+	lc fx.Lifecycle,
+	repo *repository.Repository,
+	cfg *config.Config,
+	logger *zap.Logger,
+) *service.RollupRefresher {
+	refresher := service.NewRollupRefresher(repo, cfg.Rollup, logger)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			refresher.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return refresher.Stop(ctx)
+		},
+	})
+
+	return refresher
+}
+
+// startRetentionPurger runs the purge of expired bookkeeping rows for the
+// lifetime of the application
+func startRetentionPurger(
+	lc fx.Lifecycle,
+	repo *repository.Repository,
+	cfg *config.Config,
+	logger *zap.Logger,
+) *service.RetentionPurger {
+	purger := service.NewRetentionPurger(repo, cfg, logger)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			purger.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return purger.Stop(ctx)
+		},
+	})
+
+	return purger
 }
 
 // ProvideDBPool creates a new database pool instance
@@ -100,5 +285,13 @@ func ProvideDBPool(lc fx.Lifecycle, logger *zap.Logger, cfg *config.Config) (*db
 
 // ProvideMQConnection creates a new RabbitMQ connection instance
 func ProvideMQConnection(lc fx.Lifecycle, logger *zap.Logger, cfg *config.Config) (*mq.Connection, error) {
-	return mq.NewConnection(lc, logger, cfg.RabbitMQ.URL)
+	return mq.NewConnection(lc, logger, cfg.RabbitMQ.URL, reconnectBackoff(cfg))
+}
+
+// reconnectBackoff builds the broker reconnect backoff from configuration
+func reconnectBackoff(cfg *config.Config) mq.Backoff {
+	return mq.Backoff{
+		Initial: cfg.RabbitMQ.ReconnectInitialBackoff,
+		Max:     cfg.RabbitMQ.ReconnectMaxBackoff,
+	}
 }
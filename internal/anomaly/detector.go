@@ -1,10 +1,21 @@
 package anomaly
 
 import (
+	"context"
 	"fmt"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
 )
 
-// Detector handles anomaly detection with configurable thresholds
+func init() {
+	Register("spike", func(cfg config.AnomalyConfig, deps Deps) (Strategy, error) {
+		return NewDetector(cfg.SpikeThreshold, cfg.MinDataPointsForDetection), nil
+	})
+}
+
+// Detector handles anomaly detection with configurable thresholds. It flags
+// negative values and values above a multiple of the rolling average, and
+// is registered as the "spike" strategy.
 type Detector struct {
 	spikeThreshold            float64
 	minDataPointsForDetection int
@@ -18,16 +29,43 @@ func NewDetector(spikeThreshold float64, minDataPointsForDetection int) *Detecto
 	}
 }
 
+// Name returns the registry name of the detector
+func (d *Detector) Name() string {
+	return "spike"
+}
+
+// Check implements Strategy
+func (d *Detector) Check(ctx context.Context, series Series, candidate Candidate) []Finding {
+	if candidate.Value < 0 && candidate.AllowNegative {
+		return nil
+	}
+	if f, ok := d.evaluate(candidate.Value, series.Values()); ok {
+		return []Finding{f}
+	}
+	return nil
+}
+
 // DetectAnomaly checks if the value is anomalous based on historical data
 func (d *Detector) DetectAnomaly(value float64, historicalValues []float64) (bool, string) {
+	f, ok := d.evaluate(value, historicalValues)
+	return ok, f.Message
+}
+
+func (d *Detector) evaluate(value float64, historicalValues []float64) (Finding, bool) {
 	// Check for negative values
 	if value < 0 {
-		return true, "negative value"
+		return Finding{
+			Detector: d.Name(),
+			Code:     "negative_value",
+			Severity: SeverityCritical,
+			Score:    value,
+			Message:  "negative value",
+		}, true
 	}
 
 	// Need enough historical data for spike detection
 	if len(historicalValues) < d.minDataPointsForDetection {
-		return false, ""
+		return Finding{}, false
 	}
 
 	// Calculate rolling average
@@ -39,9 +77,15 @@ func (d *Detector) DetectAnomaly(value float64, historicalValues []float64) (boo
 
 	// Detect sudden spike (>threshold x rolling average)
 	if average > 0 && value > d.spikeThreshold*average {
-		return true, fmt.Sprintf("sudden spike detected: value %.2f exceeds %.1fx rolling average %.2f",
-			value, d.spikeThreshold, average)
+		return Finding{
+			Detector: d.Name(),
+			Code:     "spike",
+			Severity: SeverityWarning,
+			Score:    value / average,
+			Message: fmt.Sprintf("sudden spike detected: value %.2f exceeds %.1fx rolling average %.2f",
+				value, d.spikeThreshold, average),
+		}, true
 	}
 
-	return false, ""
+	return Finding{}, false
 }
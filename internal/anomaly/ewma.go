@@ -0,0 +1,80 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+func init() {
+	Register("ewma", func(cfg config.AnomalyConfig, deps Deps) (Strategy, error) {
+		return NewEWMADetector(cfg.EWMAAlpha, Bounds{Upper: cfg.EWMAUpper, Lower: cfg.EWMALower}, cfg.MinDataPointsForDetection)
+	})
+}
+
+// EWMADetector tracks an exponentially weighted moving average and variance
+// of the history and flags values outside a band of standard deviations
+// around it. Recent readings weigh more, so the band follows gradual drifts
+// in consumption.
+type EWMADetector struct {
+	alpha     float64
+	bounds    Bounds
+	minPoints int
+}
+
+// NewEWMADetector creates an EWMA band detector. alpha is the weight of the
+// newest reading, in (0, 1].
+func NewEWMADetector(alpha float64, bounds Bounds, minPoints int) (*EWMADetector, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("EWMA alpha must be in (0, 1], got %v", alpha)
+	}
+	if err := bounds.validate("EWMA"); err != nil {
+		return nil, err
+	}
+	return &EWMADetector{alpha: alpha, bounds: bounds, minPoints: max(minPoints, 2)}, nil
+}
+
+// Name returns the registry name of the detector
+func (d *EWMADetector) Name() string {
+	return "ewma"
+}
+
+// Check implements Strategy. Histories without variance are skipped.
+func (d *EWMADetector) Check(ctx context.Context, series Series, candidate Candidate) []Finding {
+	if len(series) < d.minPoints {
+		return nil
+	}
+
+	// Fold the series oldest to newest
+	avg := series[len(series)-1].Value
+	variance := 0.0
+	for i := len(series) - 2; i >= 0; i-- {
+		diff := series[i].Value - avg
+		incr := d.alpha * diff
+		avg += incr
+		variance = (1 - d.alpha) * (variance + diff*incr)
+	}
+
+	sd := math.Sqrt(variance)
+	if sd == 0 {
+		return nil
+	}
+
+	score := (candidate.Value - avg) / sd
+	side, ok := d.bounds.exceeds(score)
+	if !ok {
+		return nil
+	}
+
+	threshold := d.bounds.threshold(side)
+	return []Finding{{
+		Detector: d.Name(),
+		Code:     "ewma_" + side,
+		Severity: severity(score, threshold),
+		Score:    score,
+		Message: fmt.Sprintf("outside EWMA band: value %.2f vs %.2f ± %.1f×%.2f",
+			candidate.Value, avg, threshold, sd),
+	}}
+}
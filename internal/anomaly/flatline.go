@@ -0,0 +1,115 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+// CodeStuckMeter is the finding code of a meter repeating the same value
+const CodeStuckMeter = "stuck_meter"
+
+// Details keys of a stuck meter finding
+const (
+	DetailStuckSince = "stuck_since" // time.Time of the first repeated reading
+	DetailRunLength  = "run_length"  // int, readings in the run including the candidate
+)
+
+func init() {
+	Register("flatline", func(cfg config.AnomalyConfig, deps Deps) (Strategy, error) {
+		if cfg.FlatlineMinPoints-1 > cfg.HistoryWindow {
+			return nil, fmt.Errorf("ANOMALY_FLATLINE_MIN_POINTS (%d) needs ANOMALY_HISTORY_WINDOW of at least %d",
+				cfg.FlatlineMinPoints, cfg.FlatlineMinPoints-1)
+		}
+		return NewFlatlineDetector(cfg.FlatlineMinPoints, cfg.FlatlineMinDuration, cfg.FlatlineEpsilon, cfg.FlatlineExemptMetrics)
+	})
+}
+
+// FlatlineDetector flags a meter that keeps reporting the same value. A
+// reading is flagged when, together with the newest history, at least
+// minPoints consecutive values lie within epsilon of it, or when such a run
+// spans at least minDuration. Metrics matching an exempt glob pattern, such
+// as status flags that legitimately never change, are skipped.
+type FlatlineDetector struct {
+	minPoints   int
+	minDuration time.Duration
+	epsilon     float64
+	exempt      []string
+}
+
+// NewFlatlineDetector creates a flatline detector. A zero minDuration
+// disables the duration criterion.
+func NewFlatlineDetector(minPoints int, minDuration time.Duration, epsilon float64, exempt []string) (*FlatlineDetector, error) {
+	if minPoints < 2 {
+		return nil, fmt.Errorf("flatline minimum points must be at least 2, got %d", minPoints)
+	}
+	if epsilon < 0 {
+		return nil, fmt.Errorf("flatline epsilon must not be negative, got %v", epsilon)
+	}
+	for _, pattern := range exempt {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid flatline exemption %q: %w", pattern, err)
+		}
+	}
+	return &FlatlineDetector{
+		minPoints:   minPoints,
+		minDuration: minDuration,
+		epsilon:     epsilon,
+		exempt:      exempt,
+	}, nil
+}
+
+// Name returns the registry name of the detector
+func (d *FlatlineDetector) Name() string {
+	return "flatline"
+}
+
+// Check implements Strategy
+func (d *FlatlineDetector) Check(ctx context.Context, series Series, candidate Candidate) []Finding {
+	if d.isExempt(candidate.MetricName) {
+		return nil
+	}
+
+	run := 0
+	for _, p := range series {
+		if math.Abs(p.Value-candidate.Value) > d.epsilon {
+			break
+		}
+		run++
+	}
+	if run == 0 {
+		return nil
+	}
+
+	since := series[run-1].Timestamp
+	stuckFor := candidate.Timestamp.Sub(since)
+	if run+1 < d.minPoints && (d.minDuration <= 0 || stuckFor < d.minDuration) {
+		return nil
+	}
+
+	return []Finding{{
+		Detector: d.Name(),
+		Code:     CodeStuckMeter,
+		Severity: SeverityWarning,
+		Score:    float64(run + 1),
+		Message: fmt.Sprintf("stuck meter: %d consecutive readings at %.2f since %s",
+			run+1, candidate.Value, since.UTC().Format(time.RFC3339)),
+		Details: map[string]any{
+			DetailStuckSince: since,
+			DetailRunLength:  run + 1,
+		},
+	}}
+}
+
+func (d *FlatlineDetector) isExempt(metricName string) bool {
+	for _, pattern := range d.exempt {
+		if ok, _ := path.Match(pattern, metricName); ok {
+			return true
+		}
+	}
+	return false
+}
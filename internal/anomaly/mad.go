@@ -0,0 +1,76 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+// madScale makes the MAD a consistent estimator of the standard deviation
+// for normally distributed data (Iglewicz and Hoaglin)
+const madScale = 0.6745
+
+func init() {
+	Register("mad", func(cfg config.AnomalyConfig, deps Deps) (Strategy, error) {
+		return NewMADDetector(Bounds{Upper: cfg.MADUpper, Lower: cfg.MADLower}, cfg.MinDataPointsForDetection)
+	})
+}
+
+// MADDetector flags values by their modified z-score, computed from the
+// median and the median absolute deviation of the history. Unlike the mean
+// and standard deviation, both are barely moved by a previous outlier.
+type MADDetector struct {
+	bounds    Bounds
+	minPoints int
+}
+
+// NewMADDetector creates a modified z-score detector
+func NewMADDetector(bounds Bounds, minPoints int) (*MADDetector, error) {
+	if err := bounds.validate("MAD"); err != nil {
+		return nil, err
+	}
+	return &MADDetector{bounds: bounds, minPoints: max(minPoints, 3)}, nil
+}
+
+// Name returns the registry name of the detector
+func (d *MADDetector) Name() string {
+	return "mad"
+}
+
+// Check implements Strategy. Histories where more than half of the values
+// are equal have a zero MAD and are skipped.
+func (d *MADDetector) Check(ctx context.Context, series Series, candidate Candidate) []Finding {
+	if len(series) < d.minPoints {
+		return nil
+	}
+
+	values := series.Values()
+	med := median(values)
+
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - med)
+	}
+	mad := median(deviations)
+	if mad == 0 {
+		return nil
+	}
+
+	score := madScale * (candidate.Value - med) / mad
+	side, ok := d.bounds.exceeds(score)
+	if !ok {
+		return nil
+	}
+
+	threshold := d.bounds.threshold(side)
+	return []Finding{{
+		Detector: d.Name(),
+		Code:     "mad_" + side,
+		Severity: severity(score, threshold),
+		Score:    score,
+		Message: fmt.Sprintf("modified z-score %.2f outside ±%.1f: value %.2f vs median %.2f (MAD %.2f)",
+			score, threshold, candidate.Value, med, mad),
+	}}
+}
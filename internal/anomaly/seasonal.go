@@ -0,0 +1,119 @@
+package anomaly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+// HoursPerWeek is the number of seasonal buckets
+const HoursPerWeek = 7 * 24
+
+func init() {
+	Register("seasonal", func(cfg config.AnomalyConfig, deps Deps) (Strategy, error) {
+		if deps.Seasonal == nil {
+			return nil, errors.New("seasonal statistics source is not available")
+		}
+		return NewSeasonalDetector(deps.Seasonal, cfg.SeasonalLocation,
+			Bounds{Upper: cfg.SeasonalUpper, Lower: cfg.SeasonalLower}, cfg.SeasonalMinSamples)
+	})
+}
+
+// HourOfWeek returns the seasonal bucket of t in loc (UTC when nil): 0 is
+// Sunday 00:00-00:59 and 167 is Saturday 23:00-23:59
+func HourOfWeek(t time.Time, loc *time.Location) int {
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// SeasonalStats are the running statistics of a client metric within one
+// hour-of-week bucket
+type SeasonalStats struct {
+	Count int64
+	Mean  float64
+	M2    float64 // sum of squared deviations from the mean
+}
+
+// StdDev returns the sample standard deviation
+func (s SeasonalStats) StdDev() float64 {
+	if s.Count < 2 {
+		return 0
+	}
+	return math.Sqrt(s.M2 / float64(s.Count-1))
+}
+
+// SeasonalSource looks up the seasonal statistics of a bucket. ok is false
+// when the bucket has no data yet.
+type SeasonalSource interface {
+	SeasonalStats(ctx context.Context, clientID uuid.UUID, metricName string, bucket int) (stats SeasonalStats, ok bool, err error)
+}
+
+// SeasonalDetector compares a reading with the historical distribution of
+// its client metric in the same hour-of-week, so that daily and weekly load
+// cycles are not mistaken for anomalies
+type SeasonalDetector struct {
+	source     SeasonalSource
+	loc        *time.Location
+	bounds     Bounds
+	minSamples int64
+}
+
+// NewSeasonalDetector creates a seasonal detector. Buckets are computed in
+// loc, which should be the local time of the metered sites.
+func NewSeasonalDetector(source SeasonalSource, loc *time.Location, bounds Bounds, minSamples int) (*SeasonalDetector, error) {
+	if err := bounds.validate("seasonal"); err != nil {
+		return nil, err
+	}
+	return &SeasonalDetector{
+		source:     source,
+		loc:        loc,
+		bounds:     bounds,
+		minSamples: int64(max(minSamples, 2)),
+	}, nil
+}
+
+// Name returns the registry name of the detector
+func (d *SeasonalDetector) Name() string {
+	return "seasonal"
+}
+
+// Check implements Strategy. Buckets with fewer than the minimum samples or
+// without variance are skipped, as are lookups that fail: a missing
+// baseline must not reject readings.
+func (d *SeasonalDetector) Check(ctx context.Context, series Series, candidate Candidate) []Finding {
+	bucket := HourOfWeek(candidate.Timestamp, d.loc)
+
+	stats, ok, err := d.source.SeasonalStats(ctx, candidate.ClientID, candidate.MetricName, bucket)
+	if err != nil || !ok || stats.Count < d.minSamples {
+		return nil
+	}
+
+	sd := stats.StdDev()
+	if sd == 0 {
+		return nil
+	}
+
+	z := (candidate.Value - stats.Mean) / sd
+	side, ok := d.bounds.exceeds(z)
+	if !ok {
+		return nil
+	}
+
+	threshold := d.bounds.threshold(side)
+	return []Finding{{
+		Detector: d.Name(),
+		Code:     "seasonal_" + side,
+		Severity: severity(z, threshold),
+		Score:    z,
+		Message: fmt.Sprintf("seasonal z-score %.2f outside ±%.1f: value %.2f vs %s %02d:00 mean %.2f (stddev %.2f, n=%d)",
+			z, threshold, candidate.Value, time.Weekday(bucket/24), bucket%24, stats.Mean, sd, stats.Count),
+	}}
+}
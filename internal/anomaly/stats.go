@@ -0,0 +1,82 @@
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Bounds holds two-sided thresholds on a score. A reading is anomalous when
+// its score is above Upper or below -Lower; a zero threshold disables that
+// side.
+type Bounds struct {
+	Upper float64
+	Lower float64
+}
+
+// exceeds reports which side of the bounds score falls outside of, if any
+func (b Bounds) exceeds(score float64) (side string, ok bool) {
+	switch {
+	case b.Upper > 0 && score > b.Upper:
+		return "high", true
+	case b.Lower > 0 && score < -b.Lower:
+		return "low", true
+	}
+	return "", false
+}
+
+// threshold returns the threshold of side
+func (b Bounds) threshold(side string) float64 {
+	if side == "high" {
+		return b.Upper
+	}
+	return b.Lower
+}
+
+// validate rejects negative thresholds
+func (b Bounds) validate(name string) error {
+	if b.Upper < 0 || b.Lower < 0 {
+		return fmt.Errorf("%s thresholds must not be negative", name)
+	}
+	return nil
+}
+
+// severity is critical once a score is twice past its threshold
+func severity(score, threshold float64) Severity {
+	if math.Abs(score) >= 2*threshold {
+		return SeverityCritical
+	}
+	return SeverityWarning
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// stddev returns the sample standard deviation of values around m
+func stddev(values []float64, m float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
+
+// median returns the median of values without modifying them
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
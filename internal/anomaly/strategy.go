@@ -0,0 +1,179 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+// Severity ranks how suspicious a finding is
+type Severity string
+
+const (
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// Point is one historical value of a metric
+type Point struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// Series is the recent valid history of a client metric, newest first
+type Series []Point
+
+// Values returns the values of the series, newest first
+func (s Series) Values() []float64 {
+	values := make([]float64, len(s))
+	for i, p := range s {
+		values[i] = p.Value
+	}
+	return values
+}
+
+// Candidate is the reading being checked
+type Candidate struct {
+	ClientID   uuid.UUID
+	MetricName string
+	Value      float64
+	Timestamp  time.Time
+
+	// AllowNegative is set when the validation rules of the metric accept
+	// negative values, e.g. export power
+	AllowNegative bool
+}
+
+// Finding describes one anomaly raised by a strategy
+type Finding struct {
+	Detector string   // name of the strategy that raised it
+	Code     string   // stable machine-readable reason, e.g. "spike"
+	Severity Severity // how suspicious the reading is
+	Score    float64  // strategy-specific magnitude, e.g. ratio or z-score
+	Message  string   // human-readable reason stored with the reading
+
+	// Details carries strategy-specific context, keyed by constants of the
+	// strategy that sets them
+	Details map[string]any
+}
+
+// Strategy checks a candidate reading against the history of its metric.
+// Implementations must be safe for concurrent use.
+type Strategy interface {
+	Name() string
+	Check(ctx context.Context, series Series, candidate Candidate) []Finding
+}
+
+// Deps holds the services strategies may depend on beyond their
+// configuration. Strategies that need a missing dependency fail to build.
+type Deps struct {
+	Seasonal SeasonalSource
+}
+
+// Factory builds a strategy from the anomaly configuration
+type Factory func(cfg config.AnomalyConfig, deps Deps) (Strategy, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a strategy available by name to ANOMALY_DETECTORS. It
+// panics if the name is already taken, so clashes surface at startup.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("anomaly strategy %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered lists the registered strategy names in sorted order
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New builds the registered strategy called name
+func New(name string, cfg config.AnomalyConfig, deps Deps) (Strategy, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown anomaly detector %q (available: %s)", name, strings.Join(Registered(), ", "))
+	}
+
+	strategy, err := factory(cfg, deps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create anomaly detector %q: %w", name, err)
+	}
+	return strategy, nil
+}
+
+// Chain runs several strategies in sequence and collects all their findings
+type Chain struct {
+	strategies []Strategy
+}
+
+// NewChain creates a chain of the given strategies
+func NewChain(strategies ...Strategy) *Chain {
+	return &Chain{strategies: strategies}
+}
+
+// NewChainFromConfig builds the chain of strategies named in cfg.Detectors,
+// in order
+func NewChainFromConfig(cfg config.AnomalyConfig, deps Deps) (*Chain, error) {
+	strategies := make([]Strategy, 0, len(cfg.Detectors))
+	for _, name := range cfg.Detectors {
+		strategy, err := New(name, cfg, deps)
+		if err != nil {
+			return nil, err
+		}
+		strategies = append(strategies, strategy)
+	}
+	return NewChain(strategies...), nil
+}
+
+// Name returns the names of the chained strategies
+func (c *Chain) Name() string {
+	names := make([]string, len(c.strategies))
+	for i, s := range c.strategies {
+		names[i] = s.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Check runs every strategy and returns their findings in chain order
+func (c *Chain) Check(ctx context.Context, series Series, candidate Candidate) []Finding {
+	var findings []Finding
+	for _, s := range c.strategies {
+		findings = append(findings, s.Check(ctx, series, candidate)...)
+	}
+	return findings
+}
+
+// Reason joins the messages of findings into the anomaly reason stored with
+// a reading
+func Reason(findings []Finding) string {
+	messages := make([]string, len(findings))
+	for i, f := range findings {
+		messages[i] = f.Message
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,65 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+func init() {
+	Register("zscore", func(cfg config.AnomalyConfig, deps Deps) (Strategy, error) {
+		return NewZScoreDetector(Bounds{Upper: cfg.ZScoreUpper, Lower: cfg.ZScoreLower}, cfg.MinDataPointsForDetection)
+	})
+}
+
+// ZScoreDetector flags values more than a number of standard deviations
+// away from the mean of the history, in either direction
+type ZScoreDetector struct {
+	bounds    Bounds
+	minPoints int
+}
+
+// NewZScoreDetector creates a z-score detector
+func NewZScoreDetector(bounds Bounds, minPoints int) (*ZScoreDetector, error) {
+	if err := bounds.validate("z-score"); err != nil {
+		return nil, err
+	}
+	return &ZScoreDetector{bounds: bounds, minPoints: max(minPoints, 2)}, nil
+}
+
+// Name returns the registry name of the detector
+func (d *ZScoreDetector) Name() string {
+	return "zscore"
+}
+
+// Check implements Strategy. Flat histories have no spread to measure
+// against and are skipped.
+func (d *ZScoreDetector) Check(ctx context.Context, series Series, candidate Candidate) []Finding {
+	if len(series) < d.minPoints {
+		return nil
+	}
+
+	values := series.Values()
+	m := mean(values)
+	sd := stddev(values, m)
+	if sd == 0 {
+		return nil
+	}
+
+	z := (candidate.Value - m) / sd
+	side, ok := d.bounds.exceeds(z)
+	if !ok {
+		return nil
+	}
+
+	threshold := d.bounds.threshold(side)
+	return []Finding{{
+		Detector: d.Name(),
+		Code:     "zscore_" + side,
+		Severity: severity(z, threshold),
+		Score:    z,
+		Message: fmt.Sprintf("z-score %.2f outside ±%.1f: value %.2f vs mean %.2f (stddev %.2f)",
+			z, threshold, candidate.Value, m, sd),
+	}}
+}
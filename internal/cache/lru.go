@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"container/list"
+	"time"
+)
+
+// LRU is a size-bounded least-recently-used cache whose entries also expire
+// a fixed time after they were last written. It is not safe for concurrent
+// use; callers guard it with their own lock.
+type LRU[K comparable, V any] struct {
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	order *list.List // front is most recently used
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// NewLRU creates a cache holding at most capacity entries. A ttl of zero
+// disables expiry.
+func NewLRU[K comparable, V any](capacity int, ttl time.Duration) *LRU[K, V] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &LRU[K, V]{
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+// WithClock replaces the time source, for tests
+func (c *LRU[K, V]) WithClock(now func() time.Time) *LRU[K, V] {
+	c.now = now
+	return c
+}
+
+// Get returns the value for key and marks it as recently used. Expired
+// entries are removed and reported as missing.
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	entry := elem.Value.(*lruEntry[K, V])
+	if c.ttl > 0 && !c.now().Before(entry.expiresAt) {
+		c.removeElement(elem)
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// Set stores value for key, restarting its ttl, and evicts the least
+// recently used entry when the cache is full
+func (c *LRU[K, V]) Set(key K, value V) {
+	expiresAt := c.now().Add(c.ttl)
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry[K, V])
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expiresAt: expiresAt})
+
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Delete removes key from the cache
+func (c *LRU[K, V]) Delete(key K) {
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// Len returns the number of cached entries, including expired ones not yet
+// evicted
+func (c *LRU[K, V]) Len() int {
+	return c.order.Len()
+}
+
+func (c *LRU[K, V]) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry[K, V]).key)
+}
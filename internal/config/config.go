@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds all application configuration
@@ -14,11 +16,20 @@ type Config struct {
 	RabbitMQ    RabbitMQConfig
 	Validation  ValidationConfig
 	Anomaly     AnomalyConfig
+	Outbox      OutboxConfig
+	Offline     OfflineConfig
+	Partition   PartitionConfig
+	Rollup      RollupConfig
+	Retention   RetentionConfig
+	Client      ClientConfig
+	Tracing     TracingConfig
 }
 
 // DatabaseConfig holds database connection settings
 type DatabaseConfig struct {
-	URL string
+	URL         string
+	AutoMigrate bool   // apply pending schema migrations on start
+	Storage     string // auto, timescale or postgres (native partitioning)
 }
 
 // RabbitMQConfig holds RabbitMQ connection and queue settings
@@ -31,17 +42,178 @@ type RabbitMQConfig struct {
 	WorkerRoutingKey string
 	DLQQueue         string
 	PrefetchCount    int
+	Concurrency      int
+
+	// Routing keys of the events published besides accepted readings
+	StuckRoutingKey      string // meter.stuck events
+	PartialRoutingKey    string // partial-success events
+	OfflineRoutingKey    string // metrics that stopped reporting
+	BackOnlineRoutingKey string // metrics that resumed reporting
+
+	// ReconnectInitialBackoff and ReconnectMaxBackoff bound the exponential
+	// backoff used when re-dialing a dropped broker connection.
+	ReconnectInitialBackoff time.Duration
+	ReconnectMaxBackoff     time.Duration
+
+	// RetryDelays lists the delay tiers a failed delivery waits in before
+	// being redelivered; MaxRetries bounds the attempts before dead-lettering.
+	RetryDelays []time.Duration
+	MaxRetries  int
+
+	// PublishConfirmTimeout bounds how long a publish waits for the broker ack
+	PublishConfirmTimeout time.Duration
 }
 
 // ValidationConfig holds validation settings
 type ValidationConfig struct {
 	TimestampToleranceMinutes int
+
+	// IsolateReadings inserts each reading under a savepoint, so that a
+	// reading failing to insert is rejected alone instead of failing the
+	// whole message
+	IsolateReadings bool
+
+	// Metrics matching CounterMetrics globs are cumulative counters that
+	// must not decrease, except when the register wraps at
+	// CounterRolloverMax (0 disables) or restarts at most at CounterResetMax
+	CounterMetrics     []string
+	CounterRolloverMax float64
+	CounterResetMax    float64
+
+	// ConsistencyRules are formulas that metrics reported at the same
+	// instant must satisfy, e.g. "active_power = voltage * current *
+	// power_factor ~ 5%"
+	ConsistencyRules []string
+
+	// RulesFile is a YAML or JSON file of per-metric validation rules
+	RulesFile string
 }
 
 // AnomalyConfig holds anomaly detection settings
 type AnomalyConfig struct {
 	SpikeThreshold            float64
 	MinDataPointsForDetection int
+	HistoryWindow             int // recent readings per metric used as baseline
+
+	// Detectors names the registered anomaly strategies to run, in order
+	Detectors []string
+
+	// Two-sided thresholds of the statistical detectors: a value is flagged
+	// above +Upper or below -Lower; zero disables that side
+	ZScoreUpper float64
+	ZScoreLower float64
+	MADUpper    float64
+	MADLower    float64
+	EWMAAlpha   float64 // weight of the newest reading
+	EWMAUpper   float64
+	EWMALower   float64
+
+	// The seasonal detector compares readings with the statistics of the
+	// same hour-of-week in SeasonalLocation, once a bucket holds at least
+	// SeasonalMinSamples readings. Looked-up buckets are cached for
+	// SeasonalCacheTTL.
+	SeasonalLocation        *time.Location
+	SeasonalUpper           float64
+	SeasonalLower           float64
+	SeasonalMinSamples      int
+	SeasonalCacheMaxEntries int
+	SeasonalCacheTTL        time.Duration
+
+	// The flatline detector flags FlatlineMinPoints consecutive readings, or
+	// a run spanning FlatlineMinDuration, within FlatlineEpsilon of each
+	// other. Metrics matching FlatlineExemptMetrics globs are skipped.
+	FlatlineMinPoints     int
+	FlatlineMinDuration   time.Duration
+	FlatlineEpsilon       float64
+	FlatlineExemptMetrics []string
+
+	// The baseline cache holds at most BaselineCacheMaxEntries client
+	// metrics, each reloaded from the database BaselineCacheTTL after load
+	BaselineCacheMaxEntries int
+	BaselineCacheTTL        time.Duration
+}
+
+// OutboxConfig holds transactional outbox relay settings
+type OutboxConfig struct {
+	PollInterval        time.Duration
+	BatchSize           int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	Retention           time.Duration // how long sent and parked events are kept
+	// MaxAttempts is how many times an event is published before it is
+	// parked as failed
+	MaxAttempts int
+	// ClaimLease is how long claimed events stay hidden from other relays
+	// while they are published; it must outlast a batch's broker confirms
+	ClaimLease time.Duration
+}
+
+// OfflineConfig holds settings of the job that detects client metrics that
+// stopped reporting. A metric is offline once no data was received for
+// After before the newest message processed; every CheckInterval one
+// replica marks up to BatchSize metrics offline and back online.
+type OfflineConfig struct {
+	CheckInterval time.Duration
+	After         time.Duration
+	BatchSize     int
+
+	// Once a metric's reporting interval is learned it is offline after
+	// MissedIntervals intervals without data instead, but never before
+	// MinAfter
+	MissedIntervals int
+	MinAfter        time.Duration
+}
+
+// PartitionConfig holds settings of the job that maintains the daily
+// partitions of meter_readings_raw on PostgreSQL without TimescaleDB. Every
+// CheckInterval one replica creates partitions back to the oldest valid
+// reading timestamp (see ValidationConfig.TimestampToleranceMinutes) and
+// PremakeDays ahead, and drops those older than RetentionDays (0 keeps them
+// all). On TimescaleDB RetentionDays sets the hypertable retention policy
+// instead.
+type PartitionConfig struct {
+	CheckInterval time.Duration
+	PremakeDays   int
+	RetentionDays int
+}
+
+// RollupConfig holds settings of the job that refreshes the reading rollup
+// tables on PostgreSQL without TimescaleDB. Every RefreshInterval one
+// replica recomputes the buckets whose readings changed since, BatchSize
+// 15-minute buckets per transaction. Changes older than Lookback, which
+// the 7-day window of the TimescaleDB refresh policies would leave out,
+// are still refreshed but counted and logged as late.
+type RollupConfig struct {
+	RefreshInterval time.Duration
+	Lookback        time.Duration
+	BatchSize       int
+}
+
+// RetentionConfig holds settings of the job that purges bookkeeping rows.
+// Every PurgeInterval one replica deletes sent outbox events older than
+// OutboxConfig.Retention, processed requests older than ProcessedRequests,
+// which bounds how late a redelivered request is still recognized as a
+// duplicate, and ingest messages stored more than IngestMessages ago (0 keeps
+// them all).
+type RetentionConfig struct {
+	PurgeInterval     time.Duration
+	ProcessedRequests time.Duration
+	IngestMessages    time.Duration
+}
+
+// ClientConfig holds client resolution settings
+type ClientConfig struct {
+	CacheMaxEntries       int
+	CacheTTL              time.Duration
+	LastSeenFlushInterval time.Duration
+}
+
+// TracingConfig holds OpenTelemetry tracing settings. The OTLP exporter
+// reads its endpoint and headers from the standard OTEL_EXPORTER_OTLP_*
+// variables.
+type TracingConfig struct {
+	Exporter    string  // none, otlp or stdout
+	SampleRatio float64 // fraction of root traces sampled
 }
 
 // Load loads configuration from environment variables
@@ -49,9 +221,6 @@ func Load() (*Config, error) {
 	cfg := &Config{
 		ServiceName: getEnv("SERVICE_NAME", "energy-metering-worker"),
 		ServicePort: getEnvAsInt("SERVICE_PORT", 8081),
-		Database: DatabaseConfig{
-			URL: getEnv("DATABASE_URL", ""),
-		},
 		RabbitMQ: RabbitMQConfig{
 			URL:              getEnv("RABBITMQ_URL", ""),
 			IngestExchange:   getEnv("RABBITMQ_INGEST_EXCHANGE", "energy-metering.ingest.exchange"),
@@ -61,24 +230,132 @@ func Load() (*Config, error) {
 			WorkerRoutingKey: getEnv("RABBITMQ_WORKER_ROUTING_KEY", "meter.reading.accepted"),
 			DLQQueue:         getEnv("RABBITMQ_DLQ_QUEUE", "energy-metering.ingest.dlq"),
 			PrefetchCount:    getEnvAsInt("RABBITMQ_PREFETCH", 10),
+			Concurrency:      getEnvAsInt("RABBITMQ_CONCURRENCY", 4),
+
+			StuckRoutingKey:      getEnv("RABBITMQ_STUCK_ROUTING_KEY", "meter.stuck"),
+			PartialRoutingKey:    getEnv("RABBITMQ_PARTIAL_ROUTING_KEY", "meter.message.partial"),
+			OfflineRoutingKey:    getEnv("RABBITMQ_OFFLINE_ROUTING_KEY", "meter.offline"),
+			BackOnlineRoutingKey: getEnv("RABBITMQ_BACK_ONLINE_ROUTING_KEY", "meter.back_online"),
+
+			ReconnectInitialBackoff: getEnvAsDuration("RABBITMQ_RECONNECT_INITIAL_BACKOFF", time.Second),
+			ReconnectMaxBackoff:     getEnvAsDuration("RABBITMQ_RECONNECT_MAX_BACKOFF", 30*time.Second),
+
+			RetryDelays: getEnvAsDurationList("RABBITMQ_RETRY_DELAYS", []time.Duration{5 * time.Second, 30 * time.Second, 5 * time.Minute}),
+			MaxRetries:  getEnvAsInt("RABBITMQ_MAX_RETRIES", 3),
+
+			PublishConfirmTimeout: getEnvAsDuration("RABBITMQ_PUBLISH_CONFIRM_TIMEOUT", 5*time.Second),
 		},
 		Validation: ValidationConfig{
 			TimestampToleranceMinutes: getEnvAsInt("VALIDATION_TIMESTAMP_TOLERANCE_MINUTES", 10080),
+			IsolateReadings:           getEnvAsBool("VALIDATION_ISOLATE_READINGS", false),
+			CounterMetrics:            getEnvAsList("VALIDATION_COUNTER_METRICS", nil),
+			CounterRolloverMax:        getEnvAsFloat("VALIDATION_COUNTER_ROLLOVER_MAX", 0),
+			CounterResetMax:           getEnvAsFloat("VALIDATION_COUNTER_RESET_MAX", 1.0),
+			ConsistencyRules:          getEnvAsListSep("VALIDATION_CONSISTENCY_RULES", ";", nil),
+			RulesFile:                 getEnv("VALIDATION_RULES_FILE", ""),
 		},
 		Anomaly: AnomalyConfig{
 			SpikeThreshold:            getEnvAsFloat("ANOMALY_SPIKE_THRESHOLD", 3.0),
 			MinDataPointsForDetection: getEnvAsInt("ANOMALY_MIN_DATA_POINTS", 3),
+			HistoryWindow:             getEnvAsInt("ANOMALY_HISTORY_WINDOW", 10),
+			Detectors:                 getEnvAsList("ANOMALY_DETECTORS", []string{"spike"}),
+			ZScoreUpper:               getEnvAsFloat("ANOMALY_ZSCORE_UPPER", 3.0),
+			ZScoreLower:               getEnvAsFloat("ANOMALY_ZSCORE_LOWER", 3.0),
+			MADUpper:                  getEnvAsFloat("ANOMALY_MAD_UPPER", 3.5),
+			MADLower:                  getEnvAsFloat("ANOMALY_MAD_LOWER", 3.5),
+			EWMAAlpha:                 getEnvAsFloat("ANOMALY_EWMA_ALPHA", 0.3),
+			EWMAUpper:                 getEnvAsFloat("ANOMALY_EWMA_UPPER", 3.0),
+			EWMALower:                 getEnvAsFloat("ANOMALY_EWMA_LOWER", 3.0),
+			SeasonalUpper:             getEnvAsFloat("ANOMALY_SEASONAL_UPPER", 3.0),
+			SeasonalLower:             getEnvAsFloat("ANOMALY_SEASONAL_LOWER", 3.0),
+			SeasonalMinSamples:        getEnvAsInt("ANOMALY_SEASONAL_MIN_SAMPLES", 20),
+			SeasonalCacheMaxEntries:   getEnvAsInt("ANOMALY_SEASONAL_CACHE_MAX_ENTRIES", 100000),
+			SeasonalCacheTTL:          getEnvAsDuration("ANOMALY_SEASONAL_CACHE_TTL", time.Hour),
+			FlatlineMinPoints:         getEnvAsInt("ANOMALY_FLATLINE_MIN_POINTS", 6),
+			FlatlineMinDuration:       getEnvAsDuration("ANOMALY_FLATLINE_MIN_DURATION", 0),
+			FlatlineEpsilon:           getEnvAsFloat("ANOMALY_FLATLINE_EPSILON", 0),
+			FlatlineExemptMetrics:     getEnvAsList("ANOMALY_FLATLINE_EXEMPT_METRICS", nil),
+			BaselineCacheMaxEntries:   getEnvAsInt("ANOMALY_BASELINE_CACHE_MAX_ENTRIES", 100000),
+			BaselineCacheTTL:          getEnvAsDuration("ANOMALY_BASELINE_CACHE_TTL", 15*time.Minute),
+		},
+		Outbox: OutboxConfig{
+			PollInterval:        getEnvAsDuration("OUTBOX_POLL_INTERVAL", time.Second),
+			BatchSize:           getEnvAsInt("OUTBOX_BATCH_SIZE", 100),
+			RetryInitialBackoff: getEnvAsDuration("OUTBOX_RETRY_INITIAL_BACKOFF", 5*time.Second),
+			RetryMaxBackoff:     getEnvAsDuration("OUTBOX_RETRY_MAX_BACKOFF", 5*time.Minute),
+			Retention:           getEnvAsDuration("OUTBOX_RETENTION", 24*time.Hour),
+			ClaimLease:          getEnvAsDuration("OUTBOX_CLAIM_LEASE", time.Minute),
+			MaxAttempts:         getEnvAsInt("OUTBOX_MAX_ATTEMPTS", 20),
+		},
+		Offline: OfflineConfig{
+			CheckInterval: getEnvAsDuration("OFFLINE_CHECK_INTERVAL", time.Minute),
+			After:         getEnvAsDuration("OFFLINE_AFTER", 15*time.Minute),
+			BatchSize:     getEnvAsInt("OFFLINE_BATCH_SIZE", 500),
+
+			MissedIntervals: getEnvAsInt("OFFLINE_MISSED_INTERVALS", 3),
+			MinAfter:        getEnvAsDuration("OFFLINE_MIN_AFTER", 5*time.Minute),
+		},
+		Partition: PartitionConfig{
+			CheckInterval: getEnvAsDuration("PARTITION_CHECK_INTERVAL", time.Hour),
+			PremakeDays:   getEnvAsInt("PARTITION_PREMAKE_DAYS", 7),
+			RetentionDays: getEnvAsInt("PARTITION_RETENTION_DAYS", 90),
+		},
+		Rollup: RollupConfig{
+			RefreshInterval: getEnvAsDuration("ROLLUP_REFRESH_INTERVAL", 5*time.Minute),
+			Lookback:        getEnvAsDuration("ROLLUP_REFRESH_LOOKBACK", 7*24*time.Hour),
+			BatchSize:       getEnvAsInt("ROLLUP_REFRESH_BATCH_SIZE", 10000),
+		},
+		Retention: RetentionConfig{
+			PurgeInterval:     getEnvAsDuration("RETENTION_PURGE_INTERVAL", time.Hour),
+			ProcessedRequests: getEnvAsDuration("RETENTION_PROCESSED_REQUESTS", 7*24*time.Hour),
+			IngestMessages:    getEnvAsDuration("RETENTION_INGEST_MESSAGES", 90*24*time.Hour),
+		},
+		Client: ClientConfig{
+			CacheMaxEntries:       getEnvAsInt("CLIENT_CACHE_MAX_ENTRIES", 50000),
+			CacheTTL:              getEnvAsDuration("CLIENT_CACHE_TTL", time.Hour),
+			LastSeenFlushInterval: getEnvAsDuration("CLIENT_LAST_SEEN_FLUSH_INTERVAL", 30*time.Second),
+		},
+		Tracing: TracingConfig{
+			Exporter:    getEnv("TRACING_EXPORTER", "none"),
+			SampleRatio: getEnvAsFloat("TRACING_SAMPLE_RATIO", 1.0),
 		},
 	}
 
 	// Validate required fields
-	if cfg.Database.URL == "" {
-		return nil, fmt.Errorf("DATABASE_URL is required but not set in environment variables")
+	database, err := LoadDatabase()
+	if err != nil {
+		return nil, err
 	}
+	cfg.Database = database
 	if cfg.RabbitMQ.URL == "" {
 		return nil, fmt.Errorf("RABBITMQ_URL is required but not set in environment variables")
 	}
 
+	loc, err := time.LoadLocation(getEnv("ANOMALY_SEASONAL_TIMEZONE", "UTC"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ANOMALY_SEASONAL_TIMEZONE: %w", err)
+	}
+	cfg.Anomaly.SeasonalLocation = loc
+
+	return cfg, nil
+}
+
+// LoadDatabase loads only the database settings, for commands that do not
+// need the rest of the configuration
+func LoadDatabase() (DatabaseConfig, error) {
+	cfg := DatabaseConfig{
+		URL:         getEnv("DATABASE_URL", ""),
+		AutoMigrate: getEnvAsBool("DB_AUTO_MIGRATE", false),
+		Storage:     getEnv("DB_STORAGE", "auto"),
+	}
+	if cfg.URL == "" {
+		return cfg, fmt.Errorf("DATABASE_URL is required but not set in environment variables")
+	}
+	switch cfg.Storage {
+	case "auto", "timescale", "postgres":
+	default:
+		return cfg, fmt.Errorf("invalid DB_STORAGE %q: must be auto, timescale or postgres", cfg.Storage)
+	}
 	return cfg, nil
 }
 
@@ -101,6 +378,18 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return value
 }
 
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func getEnvAsFloat(key string, defaultValue float64) float64 {
 	valueStr := os.Getenv(key)
 	if valueStr == "" {
@@ -112,3 +401,53 @@ func getEnvAsFloat(key string, defaultValue float64) float64 {
 	}
 	return value
 }
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvAsList(key string, defaultValue []string) []string {
+	return getEnvAsListSep(key, ",", defaultValue)
+}
+
+func getEnvAsListSep(key, sep string, defaultValue []string) []string {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	var values []string
+	for _, part := range strings.Split(valueStr, sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
+func getEnvAsDurationList(key string, defaultValue []time.Duration) []time.Duration {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	var values []time.Duration
+	for _, part := range strings.Split(valueStr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		value, err := time.ParseDuration(part)
+		if err != nil || value <= 0 {
+			return defaultValue
+		}
+		values = append(values, value)
+	}
+	return values
+}
@@ -17,6 +17,14 @@ type MeterClient struct {
 	CreatedAt         time.Time
 }
 
+// ClientSighting records that a client was seen with a network identity
+type ClientSighting struct {
+	ClientID  uuid.UUID
+	IPAddress string
+	UserAgent string
+	SeenAt    time.Time
+}
+
 // MeterReading represents a meter reading in the database
 type MeterReading struct {
 	ID               uuid.UUID
@@ -27,5 +35,109 @@ type MeterReading struct {
 	ReceivedAt       time.Time
 	ValidationStatus string
 	AnomalyReason    *string
-	RawPayload       []byte
+	RawPayload       []byte   // full message, only on readings stored before ingest_messages
+	IngestMessageID  *int64   // originating message in ingest_messages
+	DeltaValue       *float64 // counter consumption since the previous reading
+	CounterEvent     *string  // counter rollover or reset, if any
+}
+
+// IngestMessage is a raw ingest message as consumed, stored once and
+// referenced by all of its readings
+type IngestMessage struct {
+	ID          int64
+	RequestID   string
+	ClientID    uuid.UUID
+	ReceivedAt  time.Time // when the message was received upstream
+	Payload     []byte    // message body
+	Headers     []byte    // AMQP headers as JSON
+	MessageID   string
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	RetryCount  int
+	PublishedAt *time.Time
+	StoredAt    time.Time
+}
+
+// MetricPoint is a single historical value of a client metric
+type MetricPoint struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// ReadingRollup aggregates the valid readings of a client metric within one
+// time bucket
+type ReadingRollup struct {
+	ClientID    uuid.UUID
+	MetricName  string
+	Bucket      time.Time // bucket start
+	Min         float64
+	Max         float64
+	Avg         float64
+	Last        float64 // value of the latest reading in the bucket
+	SampleCount int64
+	DeltaSum    *float64 // counter consumption within the bucket, nil for gauges
+}
+
+// RollupInvalidation marks a 15-minute bucket of a client whose readings
+// changed since the rollups were last refreshed
+type RollupInvalidation struct {
+	ClientID uuid.UUID
+	Bucket   time.Time // bucket start
+}
+
+// SeasonalStat holds the running count, mean and sum of squared deviations
+// (Welford's M2) of a client metric within one hour-of-week bucket
+type SeasonalStat struct {
+	ClientID   uuid.UUID
+	MetricName string
+	Bucket     int // hour of week, 0 = Sunday 00:00
+	Count      int64
+	Mean       float64
+	M2         float64
+}
+
+// MetricSighting records that a client metric reported data
+type MetricSighting struct {
+	MetricName string
+	ReadingAt  time.Time // newest reading timestamp
+	ReceivedAt time.Time // when the newest message was received upstream
+}
+
+// ReadingGap is an interval in which a client metric reported no data. The
+// gap is open (GapEnd nil) while the metric is offline.
+type ReadingGap struct {
+	ID         int64
+	ClientID   uuid.UUID
+	MetricName string
+	GapStart   time.Time  // last reading before the silence
+	GapEnd     *time.Time // first reading after it
+	DetectedAt time.Time
+	ResolvedAt *time.Time
+}
+
+// RejectedReading is a reading that failed to insert while the rest of its
+// message was stored
+type RejectedReading struct {
+	ID         int64
+	RequestID  string
+	ClientID   uuid.UUID
+	MetricName string
+	Entry      []byte // original PM entry as JSON
+	Error      string
+	RejectedAt time.Time
+}
+
+// OutboxEvent represents an event waiting in the transactional outbox
+type OutboxEvent struct {
+	ID            int64
+	EventID       uuid.UUID
+	RoutingKey    string
+	Payload       []byte
+	CreatedAt     time.Time
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     *string
+	SentAt        *time.Time
+	TraceContext  map[string]string // W3C trace context of the producing message
 }
@@ -0,0 +1,129 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds how long a single dependency check may take
+const checkTimeout = 2 * time.Second
+
+// Kind tells which probes a check takes part in
+type Kind int
+
+const (
+	// Readiness checks gate /readyz only: a failing dependency should take
+	// the worker out of rotation but not restart it
+	Readiness Kind = iota
+	// Liveness checks gate both /livez and /readyz: failing means the
+	// process is stuck and should be restarted
+	Liveness
+)
+
+// CheckFunc reports whether a dependency is healthy
+type CheckFunc func(ctx context.Context) error
+
+// CheckResult is the status of one dependency
+type CheckResult struct {
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	CheckedAt   time.Time  `json:"checked_at"`
+}
+
+// Report is the outcome of a probe
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Healthy reports whether every check relevant to the probe passed
+func (r Report) Healthy() bool {
+	return r.Status == StatusUp
+}
+
+// Status values used in reports
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Checker runs registered dependency checks and remembers the last error
+// each one reported
+type Checker struct {
+	mu     sync.Mutex
+	checks []*check
+}
+
+type check struct {
+	name        string
+	kind        Kind
+	fn          CheckFunc
+	lastError   string
+	lastErrorAt *time.Time
+}
+
+// NewChecker creates an empty checker
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Register adds a named dependency check
+func (c *Checker) Register(name string, kind Kind, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, &check{name: name, kind: kind, fn: fn})
+}
+
+// Check runs every check and reports the status of the probe. The report
+// always includes every dependency; only checks of the probe's kind (all
+// checks for Readiness, liveness checks for Liveness) decide the status.
+func (c *Checker) Check(ctx context.Context, probe Kind) Report {
+	c.mu.Lock()
+	checks := append([]*check(nil), c.checks...)
+	c.mu.Unlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, chk := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx, chk)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, Checks: make(map[string]CheckResult, len(checks))}
+	for i, chk := range checks {
+		report.Checks[chk.name] = results[i]
+		if results[i].Status != StatusUp && (probe == Readiness || chk.kind == Liveness) {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, chk *check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	err := chk.fn(ctx)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := CheckResult{Status: StatusUp, CheckedAt: now}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+		chk.lastError = err.Error()
+		chk.lastErrorAt = &now
+	}
+	result.LastError = chk.lastError
+	result.LastErrorAt = chk.lastErrorAt
+	return result
+}
@@ -0,0 +1,89 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// Server exposes the probe endpoints over HTTP
+type Server struct {
+	mux     *http.ServeMux
+	server  *http.Server
+	checker *Checker
+	logger  *zap.Logger
+}
+
+// NewServer creates the HTTP server on port and binds it to the Fx lifecycle
+func NewServer(lc fx.Lifecycle, port int, checker *Checker, logger *zap.Logger) *Server {
+	s := &Server{
+		mux:     http.NewServeMux(),
+		checker: checker,
+		logger:  logger,
+	}
+	s.server = &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           s.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	s.mux.HandleFunc("GET /healthz", s.handleHealthz)
+	s.mux.HandleFunc("GET /livez", s.handleProbe(Liveness))
+	s.mux.HandleFunc("GET /readyz", s.handleProbe(Readiness))
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			ln, err := net.Listen("tcp", s.server.Addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", s.server.Addr, err)
+			}
+			go func() {
+				if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logger.Error("http server stopped unexpectedly", zap.Error(err))
+				}
+			}()
+			logger.Info("http server listening", zap.String("addr", s.server.Addr))
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return s.server.Shutdown(ctx)
+		},
+	})
+
+	return s
+}
+
+// Handle registers an additional handler on the server
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// handleHealthz answers as long as the process is able to serve requests
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Report{Status: StatusUp})
+}
+
+func (s *Server) handleProbe(probe Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := s.checker.Check(r.Context(), probe)
+
+		status := http.StatusOK
+		if !report.Healthy() {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "energy_worker"
+
+// Registry holds every metric exposed by the worker
+var Registry = prometheus.NewRegistry()
+
+var (
+	// MessagesConsumed counts deliveries received from the ingest queue
+	MessagesConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Deliveries received from the ingest queue.",
+	}, []string{"queue"})
+
+	// MessagesAcked counts acknowledged deliveries. result is "processed"
+	// or "retry_scheduled".
+	MessagesAcked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_acked_total",
+		Help:      "Deliveries acknowledged, by result.",
+	}, []string{"queue", "result"})
+
+	// MessagesNacked counts rejected deliveries. result is "dead_lettered"
+	// or "requeued".
+	MessagesNacked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_nacked_total",
+		Help:      "Deliveries rejected, by result.",
+	}, []string{"queue", "result"})
+
+	// DeliveriesInFlight is the number of deliveries handed to workers and
+	// not yet settled
+	DeliveriesInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deliveries_in_flight",
+		Help:      "Deliveries dispatched to workers and not yet acked or nacked.",
+	}, []string{"queue"})
+
+	// ReadingsStored counts readings written to meter_readings_raw
+	ReadingsStored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_stored_total",
+		Help:      "Readings stored, by validation status.",
+	}, []string{"validation_status"})
+
+	// ReadingsDuplicate counts readings skipped because they were already stored
+	ReadingsDuplicate = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_duplicate_total",
+		Help:      "Readings skipped because they were already stored.",
+	})
+
+	// ReadingsInvalid counts stored invalid readings by reason category
+	ReadingsInvalid = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_invalid_total",
+		Help:      "Invalid readings stored, by anomaly reason category.",
+	}, []string{"reason"})
+
+	// ReadingsRejected counts readings that failed to insert and were
+	// recorded in rejected_readings while the rest of the message was stored
+	ReadingsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_rejected_total",
+		Help:      "Readings rejected on insert while the rest of their message was stored.",
+	})
+
+	// CounterEvents counts counter readings accepted across a register
+	// rollover or reset
+	CounterEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "counter_events_total",
+		Help:      "Counter readings stored across a register rollover or reset, by event.",
+	}, []string{"event"})
+
+	// MeterTransitions counts client metrics marked offline or back online
+	// by the offline job. state is "offline" or "back_online".
+	MeterTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "meter_transitions_total",
+		Help:      "Client metrics marked offline or back online, by state.",
+	}, []string{"state"})
+
+	// ReadingPartitions counts daily reading partitions changed by the
+	// partition job. action is "created" or "dropped".
+	ReadingPartitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reading_partitions_total",
+		Help:      "Daily reading partitions created or dropped, by action.",
+	}, []string{"action"})
+
+	// RowsPurged counts bookkeeping rows deleted past retention by the
+	// retention job, by table
+	RowsPurged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rows_purged_total",
+		Help:      "Rows deleted past retention, by table.",
+	}, []string{"table"})
+
+	// RollupLateBuckets counts 15-minute buckets the rollup job refreshed
+	// for readings changed further back than ROLLUP_REFRESH_LOOKBACK
+	RollupLateBuckets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollup_late_buckets_total",
+		Help:      "Rollup buckets refreshed for readings changed past the refresh lookback.",
+	})
+
+	// OutboxEventsParked counts outbox events the relay gave up on after
+	// OUTBOX_MAX_ATTEMPTS, by routing key
+	OutboxEventsParked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_events_parked_total",
+		Help:      "Outbox events parked after exhausting their publish attempts, by routing key.",
+	}, []string{"routing_key"})
+
+	// AnomalyFindings counts findings raised by anomaly strategies
+	AnomalyFindings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "anomaly_findings_total",
+		Help:      "Anomaly findings, by detector, code and severity.",
+	}, []string{"detector", "code", "severity"})
+
+	// ProcessDuration observes ProcessMessage latency. result is "success"
+	// or "error".
+	ProcessDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "process_message_duration_seconds",
+		Help:      "Time spent processing one ingest message.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// DBQueryDuration observes repository call latency by operation
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database call latency, by repository operation.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "result"})
+
+	// PublishDuration observes publish latency including broker confirms
+	PublishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "publish_duration_seconds",
+		Help:      "Time to publish and confirm events, by mode.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"mode", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		MessagesConsumed,
+		MessagesAcked,
+		MessagesNacked,
+		DeliveriesInFlight,
+		ReadingsStored,
+		ReadingsDuplicate,
+		ReadingsInvalid,
+		ReadingsRejected,
+		CounterEvents,
+		MeterTransitions,
+		ReadingPartitions,
+		RowsPurged,
+		RollupLateBuckets,
+		OutboxEventsParked,
+		AnomalyFindings,
+		ProcessDuration,
+		DBQueryDuration,
+		PublishDuration,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Result returns the result label of an operation
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// ObserveDBQuery records the latency of a repository operation started at start
+func ObserveDBQuery(operation string, start time.Time, err error) {
+	DBQueryDuration.WithLabelValues(operation, Result(err)).Observe(time.Since(start).Seconds())
+}
+
+// reasonCategories maps anomaly reason prefixes to bounded label values
+var reasonCategories = []struct {
+	prefix   string
+	category string
+}{
+	{"empty metric name", "empty_metric_name"},
+	{"invalid metric value", "invalid_value"},
+	{"negative value", "negative_value"},
+	{"invalid timestamp", "invalid_timestamp"},
+	{"timestamp outside tolerance", "timestamp_out_of_tolerance"},
+	{"sudden spike", "spike"},
+	{"z-score", "zscore"},
+	{"modified z-score", "mad"},
+	{"outside EWMA band", "ewma"},
+	{"seasonal z-score", "seasonal"},
+	{"stuck meter", "stuck_meter"},
+	{"counter went backwards", "counter_backwards"},
+	{"counter value above register maximum", "counter_overflow"},
+	{"inconsistent metrics", "consistency"},
+	{"rule ", "rule"},
+}
+
+// ReasonCategory maps a free-form anomaly reason onto a small set of label
+// values so that reasons carrying numbers do not explode cardinality
+func ReasonCategory(reason string) string {
+	for _, rc := range reasonCategories {
+		if strings.HasPrefix(reason, rc.prefix) {
+			return rc.category
+		}
+	}
+	return "other"
+}
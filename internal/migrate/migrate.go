@@ -0,0 +1,550 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// lockName names the advisory lock that keeps migrations to one replica at
+// a time
+const lockName = "energy-metering-worker.migrate"
+
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+// Storage variants. Migrations that depend on how readings are stored come
+// in one file per variant; the others apply to both.
+const (
+	VariantAuto      = "auto"
+	VariantTimescale = "timescale"
+	VariantPostgres  = "postgres"
+)
+
+// variants lists the variants a variant-specific migration must provide
+var variants = []string{VariantTimescale, VariantPostgres}
+
+// fileName matches migration files: <version>_<name>[.<variant>].<up|down>.sql
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)(?:\.(timescale|postgres))?\.(up|down)\.sql$`)
+
+// noTransaction, as the first line of an up file, applies the migration
+// outside a transaction, one statement at a time, for statements such as
+// refresh_continuous_aggregate that refuse to run in a transaction block.
+// Statements end with a semicolon at the end of a line outside $$ quoted
+// bodies.
+const noTransaction = "-- migrate:no-transaction"
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version  int64
+	Name     string
+	Variant  string // storage variant the migration is for, empty for all
+	Up       string
+	Down     string // empty when the migration cannot be reverted
+	Checksum string // SHA-256 of Up
+
+	// NoTransaction applies Up statement by statement outside a
+	// transaction; it is recorded once all statements succeeded
+	NoTransaction bool
+}
+
+// Status describes a migration known to the binary, the database, or both
+type Status struct {
+	Version   int64
+	Name      string
+	Variant   string
+	AppliedAt *time.Time // nil while pending
+	Modified  bool       // applied with a different checksum
+	Missing   bool       // applied but not known to this binary
+}
+
+// Embedded returns the migrations compiled into the binary
+func Embedded() ([]Migration, error) {
+	sub, err := fs.Sub(embedded, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded migrations: %w", err)
+	}
+	return Load(sub)
+}
+
+// Load reads the migrations in the root of fsys, ordered by version and
+// variant. A version either applies to all variants or has one migration
+// per variant.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	type key struct {
+		version int64
+		variant string
+	}
+	byKey := make(map[key]*Migration)
+	names := make(map[int64]string)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m := fileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", entry.Name())
+		}
+
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", entry.Name(), err)
+		}
+
+		if name, ok := names[version]; ok && name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %q and %q", version, name, m[2])
+		}
+		names[version] = m[2]
+
+		k := key{version, m[3]}
+		mig, ok := byKey[k]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2], Variant: m[3]}
+			byKey[k] = mig
+		}
+		if m[4] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byKey))
+	for _, mig := range byKey {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %s has no up file", mig.file())
+		}
+		sum := sha256.Sum256([]byte(mig.Up))
+		mig.Checksum = hex.EncodeToString(sum[:])
+		mig.NoTransaction = strings.HasPrefix(mig.Up, noTransaction+"\n")
+		migrations = append(migrations, *mig)
+	}
+
+	for version, name := range names {
+		_, common := byKey[key{version, ""}]
+		for _, variant := range variants {
+			_, ok := byKey[key{version, variant}]
+			if common && ok {
+				return nil, fmt.Errorf("migration %d_%s has both a common and a %s file", version, name, variant)
+			}
+			if !common && !ok {
+				return nil, fmt.Errorf("migration %d_%s has no %s variant", version, name, variant)
+			}
+		}
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		if migrations[i].Version != migrations[j].Version {
+			return migrations[i].Version < migrations[j].Version
+		}
+		return migrations[i].Variant < migrations[j].Variant
+	})
+
+	return migrations, nil
+}
+
+// Select returns the migrations that apply to a storage variant, in order
+func Select(migrations []Migration, variant string) []Migration {
+	selected := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		if m.Variant == "" || m.Variant == variant {
+			selected = append(selected, m)
+		}
+	}
+	return selected
+}
+
+// file names a migration for messages
+func (m Migration) file() string {
+	if m.Variant == "" {
+		return fmt.Sprintf("%d_%s", m.Version, m.Name)
+	}
+	return fmt.Sprintf("%d_%s.%s", m.Version, m.Name, m.Variant)
+}
+
+// Plan compares migrations with the applied ones, by version, and returns
+// the status of each. Migrations applied with a different checksum are
+// marked Modified, applied versions the binary does not know Missing.
+func Plan(migrations []Migration, applied map[int64]AppliedMigration) []Status {
+	statuses := make([]Status, 0, len(migrations))
+	known := make(map[int64]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+		status := Status{Version: m.Version, Name: m.Name, Variant: m.Variant}
+		if a, ok := applied[m.Version]; ok {
+			appliedAt := a.AppliedAt
+			status.AppliedAt = &appliedAt
+			status.Modified = a.Checksum != m.Checksum
+		}
+		statuses = append(statuses, status)
+	}
+	for version, a := range applied {
+		if !known[version] {
+			appliedAt := a.AppliedAt
+			statuses = append(statuses, Status{Version: version, Name: a.Name, Variant: a.Variant, AppliedAt: &appliedAt, Missing: true})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses
+}
+
+// AppliedMigration is a row of schema_migrations
+type AppliedMigration struct {
+	Version   int64
+	Name      string
+	Variant   string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+	storage    string // VariantAuto, VariantTimescale or VariantPostgres
+	logger     *zap.Logger
+}
+
+// New creates a migrator for the embedded migrations. storage picks the
+// storage variant; VariantAuto uses TimescaleDB when the extension is
+// available and native partitioning otherwise.
+func New(pool *pgxpool.Pool, storage string, logger *zap.Logger) (*Migrator, error) {
+	switch storage {
+	case VariantAuto, VariantTimescale, VariantPostgres:
+	default:
+		return nil, fmt.Errorf("invalid storage variant %q", storage)
+	}
+
+	migrations, err := Embedded()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: migrations, storage: storage, logger: logger}, nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction.
+// It refuses to run when an applied migration was modified, or when the
+// database is ahead of the binary. It returns the migrations applied.
+func (m *Migrator) Up(ctx context.Context) (applied []Migration, err error) {
+	err = m.locked(ctx, func(conn *pgxpool.Conn) error {
+		statuses, selected, err := m.status(ctx, conn, true)
+		if err != nil {
+			return err
+		}
+		if err := checkConsistent(statuses); err != nil {
+			return err
+		}
+
+		pending := make(map[int64]bool)
+		for _, s := range statuses {
+			if s.AppliedAt == nil {
+				pending[s.Version] = true
+			}
+		}
+
+		for _, mig := range selected {
+			if !pending[mig.Version] {
+				continue
+			}
+			start := time.Now()
+			if err := m.apply(ctx, conn, mig); err != nil {
+				return err
+			}
+			m.logger.Info("migration applied",
+				zap.Int64("version", mig.Version),
+				zap.String("name", mig.Name),
+				zap.String("variant", mig.Variant),
+				zap.Duration("duration", time.Since(start)),
+			)
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the latest steps applied migrations, newest first
+func (m *Migrator) Down(ctx context.Context, steps int) (reverted []Migration, err error) {
+	err = m.locked(ctx, func(conn *pgxpool.Conn) error {
+		statuses, selected, err := m.status(ctx, conn, true)
+		if err != nil {
+			return err
+		}
+		if err := checkConsistent(statuses); err != nil {
+			return err
+		}
+
+		byVersion := make(map[int64]Migration, len(selected))
+		for _, mig := range selected {
+			byVersion[mig.Version] = mig
+		}
+
+		for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+			if statuses[i].AppliedAt == nil {
+				continue
+			}
+			mig := byVersion[statuses[i].Version]
+			if mig.Down == "" {
+				return fmt.Errorf("migration %s cannot be reverted: no down file", mig.file())
+			}
+			if err := m.revert(ctx, conn, mig); err != nil {
+				return err
+			}
+			m.logger.Info("migration reverted", zap.Int64("version", mig.Version), zap.String("name", mig.Name))
+			reverted = append(reverted, mig)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status reports every migration known to the binary or the database
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	statuses, _, err := m.status(ctx, conn, false)
+	return statuses, err
+}
+
+// status returns the status of the migrations of the database's storage
+// variant, and those migrations. prepare allows creating the timescaledb
+// extension while detecting the variant.
+func (m *Migrator) status(ctx context.Context, conn *pgxpool.Conn, prepare bool) ([]Status, []Migration, error) {
+	if err := ensureTable(ctx, conn); err != nil {
+		return nil, nil, err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	variant, err := m.variant(ctx, conn, applied, prepare)
+	if err != nil {
+		return nil, nil, err
+	}
+	selected := Select(m.migrations, variant)
+	return Plan(selected, applied), selected, nil
+}
+
+// variant returns the storage variant of the database: the one its
+// variant-specific migrations were applied with, else the configured one,
+// else TimescaleDB if the extension can be used. Without create, an
+// available but not yet created extension counts as usable.
+func (m *Migrator) variant(ctx context.Context, conn *pgxpool.Conn, applied map[int64]AppliedMigration, create bool) (string, error) {
+	for _, a := range applied {
+		if a.Variant != "" {
+			if m.storage != VariantAuto && m.storage != a.Variant {
+				return "", fmt.Errorf("database uses %s storage, configured %s", a.Variant, m.storage)
+			}
+			return a.Variant, nil
+		}
+	}
+	if m.storage != VariantAuto {
+		return m.storage, nil
+	}
+
+	var installed, available bool
+	err := conn.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb'),
+		       EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb')
+	`).Scan(&installed, &available)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect timescaledb: %w", err)
+	}
+	if installed || (available && !create) {
+		return VariantTimescale, nil
+	}
+	if available {
+		// The extension also has to be preloaded; fall back when it is not
+		_, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS timescaledb")
+		if err == nil {
+			m.logger.Info("timescaledb extension created")
+			return VariantTimescale, nil
+		}
+		m.logger.Warn("timescaledb available but cannot be created, using native partitioning", zap.Error(err))
+	}
+	return VariantPostgres, nil
+}
+
+// locked runs fn on a dedicated connection holding the migration advisory
+// lock. Replicas starting together wait for each other, so only the first
+// applies the pending migrations.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock(hashtext($1))", lockName); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		// Unlock even when ctx is done; a lost connection releases it anyway
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", lockName); err != nil {
+			m.logger.Warn("failed to release migration lock", zap.Error(err))
+		}
+	}()
+
+	return fn(conn)
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, mig Migration) error {
+	if mig.NoTransaction {
+		return m.applyEach(ctx, conn, mig)
+	}
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, mig.Up); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", mig.file(), err)
+		}
+		_, err := tx.Exec(ctx,
+			"INSERT INTO schema_migrations (version, name, variant, checksum, applied_at) VALUES ($1, $2, $3, $4, $5)",
+			mig.Version, mig.Name, mig.Variant, mig.Checksum, time.Now(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record migration %s: %w", mig.file(), err)
+		}
+		return nil
+	})
+}
+
+// applyEach applies a no-transaction migration one statement at a time. A
+// failure leaves the statements before it applied and the migration
+// pending, so such migrations must be safe to rerun.
+func (m *Migrator) applyEach(ctx context.Context, conn *pgxpool.Conn, mig Migration) error {
+	for _, stmt := range statements(mig.Up) {
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", mig.file(), err)
+		}
+	}
+
+	_, err := conn.Exec(ctx,
+		"INSERT INTO schema_migrations (version, name, variant, checksum, applied_at) VALUES ($1, $2, $3, $4, $5)",
+		mig.Version, mig.Name, mig.Variant, mig.Checksum, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record migration %s: %w", mig.file(), err)
+	}
+	return nil
+}
+
+// statements splits sql after each line ending with a semicolon outside a
+// $$ quoted body, dropping parts holding only comments and blank lines
+func statements(sql string) []string {
+	var stmts []string
+	var current strings.Builder
+	code, quoted := false, false
+	for _, line := range strings.SplitAfter(sql, "\n") {
+		current.WriteString(line)
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			code = true
+		}
+		if strings.Count(line, "$$")%2 == 1 {
+			quoted = !quoted
+		}
+		if strings.HasSuffix(trimmed, ";") && code && !quoted {
+			stmts = append(stmts, current.String())
+			current.Reset()
+			code = false
+		}
+	}
+	if code {
+		stmts = append(stmts, current.String())
+	}
+	return stmts
+}
+
+func (m *Migrator) revert(ctx context.Context, conn *pgxpool.Conn, mig Migration) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, mig.Down); err != nil {
+			return fmt.Errorf("failed to revert migration %s: %w", mig.file(), err)
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.Version); err != nil {
+			return fmt.Errorf("failed to unrecord migration %s: %w", mig.file(), err)
+		}
+		return nil
+	})
+}
+
+// checkConsistent rejects databases whose applied migrations were modified
+// or are unknown to this binary
+func checkConsistent(statuses []Status) error {
+	var errs []error
+	for _, s := range statuses {
+		switch {
+		case s.Modified:
+			errs = append(errs, fmt.Errorf("migration %d_%s was modified after it was applied", s.Version, s.Name))
+		case s.Missing:
+			errs = append(errs, fmt.Errorf("migration %d_%s is applied but unknown to this binary", s.Version, s.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func ensureTable(ctx context.Context, conn *pgxpool.Conn) error {
+	_, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			variant TEXT NOT NULL DEFAULT '',
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS variant TEXT NOT NULL DEFAULT '';
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int64]AppliedMigration, error) {
+	rows, err := conn.Query(ctx, "SELECT version, name, variant, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]AppliedMigration)
+	for rows.Next() {
+		var a AppliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.Variant, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema migration: %w", err)
+		}
+		applied[a.Version] = a
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,12 @@
+-- Drops every table of the worker, including all stored readings
+DROP TABLE IF EXISTS event_outbox;
+DROP TABLE IF EXISTS rejected_readings;
+DROP TABLE IF EXISTS reading_gaps;
+DROP TABLE IF EXISTS meter_metric_status;
+DROP TABLE IF EXISTS metric_stuck_state;
+DROP TABLE IF EXISTS metric_seasonal_stats;
+DROP TABLE IF EXISTS processed_requests;
+DROP TABLE IF EXISTS meter_readings_raw;
+DROP TABLE IF EXISTS ingest_messages;
+DROP TABLE IF EXISTS meter_client_identities;
+DROP TABLE IF EXISTS meter_clients;
@@ -0,0 +1,208 @@
+-- Core schema of the energy metering worker. Idempotent, so databases
+-- created from the former schema.sql can be brought under migrations.
+
+-- Meter clients table
+CREATE TABLE IF NOT EXISTS meter_clients (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    client_fingerprint TEXT UNIQUE NOT NULL,
+    ip_address INET NOT NULL,
+    user_agent TEXT,
+    first_seen_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- Index for fast client lookup
+CREATE UNIQUE INDEX IF NOT EXISTS idx_meter_clients_fingerprint ON meter_clients (client_fingerprint);
+
+-- Network identities (IP address / user agent) seen per client over time
+CREATE TABLE IF NOT EXISTS meter_client_identities (
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    ip_address INET NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    first_seen_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (client_id, ip_address, user_agent)
+);
+
+-- Raw ingest messages, stored once per consumed message with its delivery
+-- metadata; readings reference their message by ID
+CREATE TABLE IF NOT EXISTS ingest_messages (
+    id BIGSERIAL PRIMARY KEY,
+    request_id TEXT,
+    client_id UUID REFERENCES meter_clients(id),
+    received_at TIMESTAMPTZ NOT NULL,
+    payload JSONB NOT NULL,
+    headers JSONB,
+    message_id TEXT,
+    exchange TEXT NOT NULL DEFAULT '',
+    routing_key TEXT NOT NULL DEFAULT '',
+    redelivered BOOLEAN NOT NULL DEFAULT false,
+    retry_count INTEGER NOT NULL DEFAULT 0,
+    published_at TIMESTAMPTZ,
+    stored_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_ingest_messages_request_id ON ingest_messages (request_id);
+CREATE INDEX IF NOT EXISTS idx_ingest_messages_client_received ON ingest_messages (client_id, received_at DESC);
+CREATE INDEX IF NOT EXISTS idx_ingest_messages_stored_at ON ingest_messages (stored_at);
+
+-- Meter readings raw table
+CREATE TABLE IF NOT EXISTS meter_readings_raw (
+    id UUID DEFAULT gen_random_uuid(),
+    client_id UUID REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    metric_value DOUBLE PRECISION NOT NULL,
+    reading_timestamp TIMESTAMPTZ NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    validation_status TEXT NOT NULL,
+    anomaly_reason TEXT,
+    raw_payload JSONB,
+    ingest_message_id BIGINT,
+    delta_value DOUBLE PRECISION,
+    counter_event TEXT,
+    PRIMARY KEY (id, reading_timestamp)
+);
+
+-- Added for counter metrics: consumption since the previous reading and
+-- register rollover/reset markers; no-op on fresh installs
+ALTER TABLE meter_readings_raw ADD COLUMN IF NOT EXISTS delta_value DOUBLE PRECISION;
+ALTER TABLE meter_readings_raw ADD COLUMN IF NOT EXISTS counter_event TEXT;
+
+-- Added for normalized message storage: new readings reference
+-- ingest_messages instead of carrying the whole message in raw_payload, which
+-- is kept for older readings. No foreign key, so both tables can follow their
+-- own retention. On hypertables with compression enabled, DROP NOT NULL needs
+-- TimescaleDB 2.11+; no-op on fresh installs.
+ALTER TABLE meter_readings_raw ADD COLUMN IF NOT EXISTS ingest_message_id BIGINT;
+ALTER TABLE meter_readings_raw ALTER COLUMN raw_payload DROP NOT NULL;
+
+-- Indexes for performance
+CREATE INDEX IF NOT EXISTS idx_mrr_client_ts ON meter_readings_raw (client_id, reading_timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_mrr_metric_ts ON meter_readings_raw (metric_name, reading_timestamp DESC);
+
+-- Databases from before the natural key may hold redelivered duplicates;
+-- keep the first stored reading of each so the unique index can be built.
+-- On hypertables with compressed chunks, DELETE needs TimescaleDB 2.11+.
+DO $$
+BEGIN
+    IF to_regclass('idx_mrr_natural_key') IS NULL THEN
+        DELETE FROM meter_readings_raw r
+        USING (
+            SELECT id, reading_timestamp,
+                row_number() OVER (PARTITION BY client_id, metric_name, reading_timestamp ORDER BY received_at, id) AS n
+            FROM meter_readings_raw
+        ) d
+        WHERE d.n > 1 AND r.id = d.id AND r.reading_timestamp = d.reading_timestamp;
+    END IF;
+END
+$$;
+
+-- Natural key: one reading per client, metric and instant (makes redelivered readings a no-op)
+CREATE UNIQUE INDEX IF NOT EXISTS idx_mrr_natural_key ON meter_readings_raw (client_id, metric_name, reading_timestamp);
+
+-- Ledger of ingest requests already stored, checked in the reading transaction
+CREATE TABLE IF NOT EXISTS processed_requests (
+    request_id TEXT PRIMARY KEY,
+    client_id UUID REFERENCES meter_clients(id),
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_processed_requests_processed_at ON processed_requests (processed_at);
+
+-- Seasonal baselines: running statistics per client, metric and hour-of-week
+-- bucket (0 = Sunday 00:00), merged in with every committed batch of valid readings
+CREATE TABLE IF NOT EXISTS metric_seasonal_stats (
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    bucket SMALLINT NOT NULL CHECK (bucket BETWEEN 0 AND 167),
+    sample_count BIGINT NOT NULL,
+    mean DOUBLE PRECISION NOT NULL,
+    m2 DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (client_id, metric_name, bucket)
+);
+
+-- Client metrics currently reporting a flat value; a row marks an ongoing
+-- stuck episode so meter.stuck is emitted once per episode
+CREATE TABLE IF NOT EXISTS metric_stuck_state (
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    stuck_value DOUBLE PRECISION NOT NULL,
+    stuck_since TIMESTAMPTZ NOT NULL,
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (client_id, metric_name)
+);
+
+-- Reporting status per client metric, maintained with every stored batch and
+-- watched by the offline job; offline_since is the gap start while offline
+CREATE TABLE IF NOT EXISTS meter_metric_status (
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    last_reading_at TIMESTAMPTZ NOT NULL,
+    last_received_at TIMESTAMPTZ NOT NULL,
+    offline_since TIMESTAMPTZ,
+    -- Learned reporting interval: moving average of the time between
+    -- received messages, NULL until the metric reported twice
+    expected_interval INTERVAL,
+    PRIMARY KEY (client_id, metric_name)
+);
+
+ALTER TABLE meter_metric_status ADD COLUMN IF NOT EXISTS expected_interval INTERVAL;
+
+CREATE INDEX IF NOT EXISTS idx_meter_metric_status_reporting ON meter_metric_status (last_received_at) WHERE offline_since IS NULL;
+CREATE INDEX IF NOT EXISTS idx_meter_metric_status_offline ON meter_metric_status (client_id, metric_name) WHERE offline_since IS NOT NULL;
+
+-- Intervals in which a client metric reported no data; gap_end is NULL while
+-- the metric is still offline
+CREATE TABLE IF NOT EXISTS reading_gaps (
+    id BIGSERIAL PRIMARY KEY,
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    gap_start TIMESTAMPTZ NOT NULL,
+    gap_end TIMESTAMPTZ,
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_reading_gaps_open ON reading_gaps (client_id, metric_name) WHERE gap_end IS NULL;
+CREATE INDEX IF NOT EXISTS idx_reading_gaps_client_start ON reading_gaps (client_id, gap_start DESC);
+
+-- Readings that failed to insert while the rest of their message was stored
+-- (VALIDATION_ISOLATE_READINGS), with the original PM entry for replay
+CREATE TABLE IF NOT EXISTS rejected_readings (
+    id BIGSERIAL PRIMARY KEY,
+    request_id TEXT,
+    client_id UUID REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    pm_entry JSONB NOT NULL,
+    error TEXT NOT NULL,
+    rejected_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rejected_readings_client_at ON rejected_readings (client_id, rejected_at DESC);
+
+-- Transactional outbox: events written with the readings, relayed to RabbitMQ by the worker
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_id UUID NOT NULL DEFAULT gen_random_uuid(),
+    routing_key TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT,
+    sent_at TIMESTAMPTZ,
+    trace_context JSONB,
+    -- Set when the relay gave up after OUTBOX_MAX_ATTEMPTS; parked events are
+    -- no longer published and are purged like sent ones
+    failed_at TIMESTAMPTZ
+);
+
+-- Added for trace propagation; no-op on fresh installs
+ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS trace_context JSONB;
+ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS failed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_event_outbox_pending ON event_outbox (next_attempt_at) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_event_outbox_sent ON event_outbox (sent_at) WHERE sent_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_event_outbox_failed ON event_outbox (failed_at) WHERE failed_at IS NOT NULL;
@@ -0,0 +1,18 @@
+-- Moves the readings back into a plain table and drops the partitions
+ALTER TABLE meter_readings_raw RENAME TO meter_readings_raw_partitioned;
+
+CREATE TABLE meter_readings_raw (LIKE meter_readings_raw_partitioned INCLUDING DEFAULTS);
+
+INSERT INTO meter_readings_raw SELECT * FROM meter_readings_raw_partitioned;
+
+DROP TABLE meter_readings_raw_partitioned;
+
+ALTER TABLE meter_readings_raw ADD PRIMARY KEY (id, reading_timestamp);
+ALTER TABLE meter_readings_raw ADD FOREIGN KEY (client_id) REFERENCES meter_clients(id);
+
+CREATE INDEX IF NOT EXISTS idx_mrr_client_ts ON meter_readings_raw (client_id, reading_timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_mrr_metric_ts ON meter_readings_raw (metric_name, reading_timestamp DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_mrr_natural_key ON meter_readings_raw (client_id, metric_name, reading_timestamp);
+
+DROP FUNCTION IF EXISTS drop_reading_partitions(DATE);
+DROP FUNCTION IF EXISTS create_reading_partitions(DATE, DATE);
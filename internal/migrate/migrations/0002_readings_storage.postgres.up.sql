@@ -0,0 +1,93 @@
+-- Native range partitioning of meter_readings_raw by reading_timestamp, one
+-- partition per UTC day, for PostgreSQL without TimescaleDB. The worker's
+-- partition job creates partitions ahead and drops expired ones.
+
+-- Creates the missing daily partitions from from_day to to_day inclusive.
+-- Each is built detached, takes over the readings of its day from the
+-- default partition and is then attached.
+CREATE OR REPLACE FUNCTION create_reading_partitions(from_day DATE, to_day DATE) RETURNS INTEGER AS $$
+DECLARE
+    part_day DATE;
+    part TEXT;
+    lower_bound TIMESTAMPTZ;
+    upper_bound TIMESTAMPTZ;
+    created INTEGER := 0;
+BEGIN
+    FOR part_day IN SELECT generate_series(from_day, to_day, INTERVAL '1 day')::date LOOP
+        part := 'meter_readings_raw_p' || to_char(part_day, 'YYYYMMDD');
+        IF to_regclass(part) IS NULL THEN
+            lower_bound := part_day::timestamp AT TIME ZONE 'UTC';
+            upper_bound := (part_day + 1)::timestamp AT TIME ZONE 'UTC';
+            EXECUTE format('CREATE TABLE %I (LIKE meter_readings_raw INCLUDING DEFAULTS)', part);
+            IF to_regclass('meter_readings_raw_default') IS NOT NULL THEN
+                EXECUTE format(
+                    'WITH moved AS (DELETE FROM meter_readings_raw_default WHERE reading_timestamp >= %L AND reading_timestamp < %L RETURNING *) '
+                    'INSERT INTO %I SELECT * FROM moved',
+                    lower_bound, upper_bound, part
+                );
+            END IF;
+            EXECUTE format(
+                'ALTER TABLE meter_readings_raw ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+                part, lower_bound, upper_bound
+            );
+            created := created + 1;
+        END IF;
+    END LOOP;
+    RETURN created;
+END
+$$ LANGUAGE plpgsql;
+
+-- Drops the daily partitions of days before before_day, and deletes the
+-- readings of those days from the default partition
+CREATE OR REPLACE FUNCTION drop_reading_partitions(before_day DATE) RETURNS INTEGER AS $$
+DECLARE
+    part TEXT;
+    dropped INTEGER := 0;
+BEGIN
+    IF to_regclass('meter_readings_raw_default') IS NOT NULL THEN
+        DELETE FROM meter_readings_raw_default
+        WHERE reading_timestamp < before_day::timestamp AT TIME ZONE 'UTC';
+    END IF;
+    FOR part IN
+        SELECT c.relname
+        FROM pg_inherits i
+        JOIN pg_class c ON c.oid = i.inhrelid
+        WHERE i.inhparent = 'meter_readings_raw'::regclass
+          AND c.relname ~ '^meter_readings_raw_p[0-9]{8}$'
+          AND to_date(right(c.relname, 8), 'YYYYMMDD') < before_day
+    LOOP
+        EXECUTE format('DROP TABLE %I', part);
+        dropped := dropped + 1;
+    END LOOP;
+    RETURN dropped;
+END
+$$ LANGUAGE plpgsql;
+
+-- Swap the plain table for a partitioned one and move existing readings
+-- over. Keys and indexes are added after the copy; the legacy table still
+-- owns their names until it is dropped. Partitions start a week back, the
+-- default timestamp tolerance, so late readings find theirs; readings of days
+-- without one, such as those of meters with a wrong clock, go to the default
+-- partition.
+ALTER TABLE meter_readings_raw RENAME TO meter_readings_raw_legacy;
+
+CREATE TABLE meter_readings_raw (LIKE meter_readings_raw_legacy INCLUDING DEFAULTS)
+    PARTITION BY RANGE (reading_timestamp);
+
+SELECT create_reading_partitions(
+    LEAST((SELECT min(reading_timestamp AT TIME ZONE 'UTC')::date FROM meter_readings_raw_legacy), (now() AT TIME ZONE 'UTC')::date - 7),
+    GREATEST((SELECT max(reading_timestamp AT TIME ZONE 'UTC')::date FROM meter_readings_raw_legacy), (now() AT TIME ZONE 'UTC')::date + 7)
+);
+
+CREATE TABLE meter_readings_raw_default PARTITION OF meter_readings_raw DEFAULT;
+
+INSERT INTO meter_readings_raw SELECT * FROM meter_readings_raw_legacy;
+
+DROP TABLE meter_readings_raw_legacy;
+
+ALTER TABLE meter_readings_raw ADD PRIMARY KEY (id, reading_timestamp);
+ALTER TABLE meter_readings_raw ADD FOREIGN KEY (client_id) REFERENCES meter_clients(id);
+
+CREATE INDEX IF NOT EXISTS idx_mrr_client_ts ON meter_readings_raw (client_id, reading_timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_mrr_metric_ts ON meter_readings_raw (metric_name, reading_timestamp DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_mrr_natural_key ON meter_readings_raw (client_id, metric_name, reading_timestamp);
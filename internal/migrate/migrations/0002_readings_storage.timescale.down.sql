@@ -0,0 +1,4 @@
+-- Removes the compression and retention policies. The table stays a
+-- hypertable; TimescaleDB cannot convert it back in place.
+SELECT remove_retention_policy('meter_readings_raw', if_exists => TRUE);
+SELECT remove_compression_policy('meter_readings_raw', if_exists => TRUE);
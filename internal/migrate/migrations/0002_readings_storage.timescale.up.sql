@@ -0,0 +1,25 @@
+-- Convert meter_readings_raw to a TimescaleDB hypertable with compression
+-- and retention. Requires the timescaledb extension.
+SELECT create_hypertable('meter_readings_raw', 'reading_timestamp', if_not_exists => TRUE, migrate_data => TRUE);
+
+-- Enable compression unless already enabled (changing the settings fails
+-- once chunks are compressed)
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM timescaledb_information.hypertables
+        WHERE hypertable_name = 'meter_readings_raw' AND compression_enabled
+    ) THEN
+        ALTER TABLE meter_readings_raw SET (
+            timescaledb.compress,
+            timescaledb.compress_segmentby = 'client_id,metric_name'
+        );
+    END IF;
+END
+$$;
+
+-- Compress chunks older than 7 days
+SELECT add_compression_policy('meter_readings_raw', INTERVAL '7 days', if_not_exists => TRUE);
+
+-- Drop chunks older than 90 days
+SELECT add_retention_policy('meter_readings_raw', INTERVAL '90 days', if_not_exists => TRUE);
@@ -0,0 +1,11 @@
+DROP TRIGGER IF EXISTS rollup_invalidate_delete ON meter_readings_raw;
+DROP TRIGGER IF EXISTS rollup_invalidate_update_new ON meter_readings_raw;
+DROP TRIGGER IF EXISTS rollup_invalidate_update_old ON meter_readings_raw;
+DROP TRIGGER IF EXISTS rollup_invalidate_insert ON meter_readings_raw;
+DROP FUNCTION IF EXISTS invalidate_reading_rollups();
+DROP FUNCTION IF EXISTS refresh_reading_rollup(REGCLASS, INTERVAL, TIMESTAMPTZ, TIMESTAMPTZ);
+DROP FUNCTION IF EXISTS refresh_reading_rollup_buckets(REGCLASS, INTERVAL, UUID[], TIMESTAMPTZ[]);
+DROP TABLE IF EXISTS reading_rollup_invalidations;
+DROP TABLE IF EXISTS meter_readings_1d;
+DROP TABLE IF EXISTS meter_readings_1h;
+DROP TABLE IF EXISTS meter_readings_15m;
@@ -0,0 +1,161 @@
+-- Rollup tables of valid readings per client, metric and bucket: 15
+-- minutes, hourly and daily. Writes to meter_readings_raw log the buckets
+-- they touch, and the worker's rollup job recomputes just those with
+-- refresh_reading_rollup_buckets. Needs PostgreSQL 14+ (date_bin).
+
+CREATE TABLE IF NOT EXISTS meter_readings_15m (
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    min_value DOUBLE PRECISION NOT NULL,
+    max_value DOUBLE PRECISION NOT NULL,
+    avg_value DOUBLE PRECISION NOT NULL,
+    last_value DOUBLE PRECISION NOT NULL,
+    sample_count BIGINT NOT NULL,
+    delta_sum DOUBLE PRECISION,
+    PRIMARY KEY (client_id, metric_name, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS meter_readings_1h (
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    min_value DOUBLE PRECISION NOT NULL,
+    max_value DOUBLE PRECISION NOT NULL,
+    avg_value DOUBLE PRECISION NOT NULL,
+    last_value DOUBLE PRECISION NOT NULL,
+    sample_count BIGINT NOT NULL,
+    delta_sum DOUBLE PRECISION,
+    PRIMARY KEY (client_id, metric_name, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS meter_readings_1d (
+    client_id UUID NOT NULL REFERENCES meter_clients(id),
+    metric_name TEXT NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    min_value DOUBLE PRECISION NOT NULL,
+    max_value DOUBLE PRECISION NOT NULL,
+    avg_value DOUBLE PRECISION NOT NULL,
+    last_value DOUBLE PRECISION NOT NULL,
+    sample_count BIGINT NOT NULL,
+    delta_sum DOUBLE PRECISION,
+    PRIMARY KEY (client_id, metric_name, bucket)
+);
+
+-- 15-minute buckets of each client with readings inserted, updated or
+-- deleted since the rollup job last ran. Hourly and daily buckets are made of
+-- whole 15-minute buckets.
+CREATE TABLE IF NOT EXISTS reading_rollup_invalidations (
+    client_id UUID NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (client_id, bucket)
+);
+
+-- Logs the buckets of the readings changed by a statement. Buckets are
+-- aligned like TimescaleDB's time_bucket, so both variants agree.
+CREATE OR REPLACE FUNCTION invalidate_reading_rollups() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO reading_rollup_invalidations (client_id, bucket)
+    SELECT DISTINCT client_id, date_bin(INTERVAL '15 minutes', reading_timestamp, TIMESTAMPTZ '2000-01-03 00:00:00+00')
+    FROM changed_readings
+    WHERE client_id IS NOT NULL
+    ON CONFLICT DO NOTHING;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS rollup_invalidate_insert ON meter_readings_raw;
+CREATE TRIGGER rollup_invalidate_insert AFTER INSERT ON meter_readings_raw
+    REFERENCING NEW TABLE AS changed_readings
+    FOR EACH STATEMENT EXECUTE FUNCTION invalidate_reading_rollups();
+
+DROP TRIGGER IF EXISTS rollup_invalidate_update_old ON meter_readings_raw;
+CREATE TRIGGER rollup_invalidate_update_old AFTER UPDATE ON meter_readings_raw
+    REFERENCING OLD TABLE AS changed_readings
+    FOR EACH STATEMENT EXECUTE FUNCTION invalidate_reading_rollups();
+
+DROP TRIGGER IF EXISTS rollup_invalidate_update_new ON meter_readings_raw;
+CREATE TRIGGER rollup_invalidate_update_new AFTER UPDATE ON meter_readings_raw
+    REFERENCING NEW TABLE AS changed_readings
+    FOR EACH STATEMENT EXECUTE FUNCTION invalidate_reading_rollups();
+
+DROP TRIGGER IF EXISTS rollup_invalidate_delete ON meter_readings_raw;
+CREATE TRIGGER rollup_invalidate_delete AFTER DELETE ON meter_readings_raw
+    REFERENCING OLD TABLE AS changed_readings
+    FOR EACH STATEMENT EXECUTE FUNCTION invalidate_reading_rollups();
+
+-- Recomputes the buckets of rollup holding the given 15-minute buckets of
+-- the given clients (pairwise) and returns how many rows it wrote. Buckets
+-- left without valid readings are deleted.
+CREATE OR REPLACE FUNCTION refresh_reading_rollup_buckets(rollup REGCLASS, bucket_width INTERVAL, clients UUID[], buckets TIMESTAMPTZ[]) RETURNS BIGINT AS $$
+DECLARE
+    origin CONSTANT TIMESTAMPTZ := '2000-01-03 00:00:00+00';
+    refreshed BIGINT;
+BEGIN
+    EXECUTE format($sql$
+        DELETE FROM %s r
+        USING (SELECT DISTINCT client_id, date_bin($1, bucket, $2) AS bucket FROM unnest($3, $4) AS u(client_id, bucket)) t
+        WHERE r.client_id = t.client_id AND r.bucket = t.bucket
+    $sql$, rollup) USING bucket_width, origin, clients, buckets;
+
+    EXECUTE format($sql$
+        INSERT INTO %s (client_id, metric_name, bucket, min_value, max_value, avg_value, last_value, sample_count, delta_sum)
+        SELECT
+            r.client_id,
+            r.metric_name,
+            t.bucket,
+            min(r.metric_value),
+            max(r.metric_value),
+            avg(r.metric_value),
+            (array_agg(r.metric_value ORDER BY r.reading_timestamp DESC))[1],
+            count(*),
+            sum(r.delta_value)
+        FROM (SELECT DISTINCT client_id, date_bin($1, bucket, $2) AS bucket FROM unnest($3, $4) AS u(client_id, bucket)) t
+        JOIN meter_readings_raw r ON r.client_id = t.client_id
+            AND r.reading_timestamp >= t.bucket AND r.reading_timestamp < t.bucket + $1
+        WHERE r.validation_status = 'valid'
+        GROUP BY 1, 2, 3
+    $sql$, rollup) USING bucket_width, origin, clients, buckets;
+
+    GET DIAGNOSTICS refreshed = ROW_COUNT;
+    RETURN refreshed;
+END
+$$ LANGUAGE plpgsql;
+
+-- Recomputes the buckets of rollup overlapping [from_ts, to_ts) from the
+-- raw readings, for backfills, and returns how many rows it wrote. Buckets
+-- left without valid readings are deleted.
+CREATE OR REPLACE FUNCTION refresh_reading_rollup(rollup REGCLASS, bucket_width INTERVAL, from_ts TIMESTAMPTZ, to_ts TIMESTAMPTZ) RETURNS BIGINT AS $$
+DECLARE
+    origin CONSTANT TIMESTAMPTZ := '2000-01-03 00:00:00+00';
+    refreshed BIGINT;
+BEGIN
+    from_ts := date_bin(bucket_width, from_ts, origin);
+    to_ts := date_bin(bucket_width, to_ts, origin) + bucket_width;
+
+    EXECUTE format($sql$
+        DELETE FROM %s
+        WHERE bucket >= $1 AND bucket < $2
+    $sql$, rollup) USING from_ts, to_ts;
+
+    EXECUTE format($sql$
+        INSERT INTO %s (client_id, metric_name, bucket, min_value, max_value, avg_value, last_value, sample_count, delta_sum)
+        SELECT
+            client_id,
+            metric_name,
+            date_bin($1, reading_timestamp, $2),
+            min(metric_value),
+            max(metric_value),
+            avg(metric_value),
+            (array_agg(metric_value ORDER BY reading_timestamp DESC))[1],
+            count(*),
+            sum(delta_value)
+        FROM meter_readings_raw
+        WHERE validation_status = 'valid' AND reading_timestamp >= $3 AND reading_timestamp < $4
+        GROUP BY 1, 2, 3
+    $sql$, rollup) USING bucket_width, origin, from_ts, to_ts;
+
+    GET DIAGNOSTICS refreshed = ROW_COUNT;
+    RETURN refreshed;
+END
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,3 @@
+DROP MATERIALIZED VIEW IF EXISTS meter_readings_1d;
+DROP MATERIALIZED VIEW IF EXISTS meter_readings_1h;
+DROP MATERIALIZED VIEW IF EXISTS meter_readings_15m;
@@ -0,0 +1,67 @@
+-- Continuous aggregates of valid readings per client, metric and bucket:
+-- 15 minutes, hourly and daily. Created empty so they can be created inside
+-- the migration transaction; the refresh policies fill them, and queries
+-- include not yet materialized readings (real-time aggregation).
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS meter_readings_15m
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT
+    client_id,
+    metric_name,
+    time_bucket(INTERVAL '15 minutes', reading_timestamp) AS bucket,
+    min(metric_value) AS min_value,
+    max(metric_value) AS max_value,
+    avg(metric_value) AS avg_value,
+    last(metric_value, reading_timestamp) AS last_value,
+    count(*) AS sample_count,
+    sum(delta_value) AS delta_sum
+FROM meter_readings_raw
+WHERE validation_status = 'valid'
+GROUP BY client_id, metric_name, bucket
+WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS meter_readings_1h
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT
+    client_id,
+    metric_name,
+    time_bucket(INTERVAL '1 hour', reading_timestamp) AS bucket,
+    min(metric_value) AS min_value,
+    max(metric_value) AS max_value,
+    avg(metric_value) AS avg_value,
+    last(metric_value, reading_timestamp) AS last_value,
+    count(*) AS sample_count,
+    sum(delta_value) AS delta_sum
+FROM meter_readings_raw
+WHERE validation_status = 'valid'
+GROUP BY client_id, metric_name, bucket
+WITH NO DATA;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS meter_readings_1d
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT
+    client_id,
+    metric_name,
+    time_bucket(INTERVAL '1 day', reading_timestamp) AS bucket,
+    min(metric_value) AS min_value,
+    max(metric_value) AS max_value,
+    avg(metric_value) AS avg_value,
+    last(metric_value, reading_timestamp) AS last_value,
+    count(*) AS sample_count,
+    sum(delta_value) AS delta_sum
+FROM meter_readings_raw
+WHERE validation_status = 'valid'
+GROUP BY client_id, metric_name, bucket
+WITH NO DATA;
+
+-- Refresh the last 7 days (the default timestamp tolerance) so late readings
+-- are picked up; only invalidated buckets are recomputed
+SELECT add_continuous_aggregate_policy('meter_readings_15m',
+    start_offset => INTERVAL '7 days', end_offset => INTERVAL '15 minutes', schedule_interval => INTERVAL '5 minutes',
+    if_not_exists => TRUE);
+SELECT add_continuous_aggregate_policy('meter_readings_1h',
+    start_offset => INTERVAL '7 days', end_offset => INTERVAL '1 hour', schedule_interval => INTERVAL '30 minutes',
+    if_not_exists => TRUE);
+SELECT add_continuous_aggregate_policy('meter_readings_1d',
+    start_offset => INTERVAL '7 days', end_offset => INTERVAL '1 day', schedule_interval => INTERVAL '1 hour',
+    if_not_exists => TRUE);
@@ -0,0 +1,15 @@
+-- Moves backfilled messages, the ones carrying the x-backfilled header, back
+-- into raw_payload
+CREATE TEMPORARY TABLE legacy_messages ON COMMIT DROP AS
+SELECT id, payload
+FROM ingest_messages
+WHERE headers @> '{"x-backfilled": true}';
+
+UPDATE meter_readings_raw r
+SET raw_payload = l.payload, ingest_message_id = NULL
+FROM legacy_messages l
+WHERE r.ingest_message_id = l.id;
+
+DELETE FROM ingest_messages m
+USING legacy_messages l
+WHERE m.id = l.id;
@@ -0,0 +1,59 @@
+-- migrate:no-transaction
+-- Moves the messages of readings stored before ingest_messages existed out
+-- of raw_payload. All readings of a message share its client, receive time
+-- and payload, so each distinct triple becomes one ingest message, without
+-- delivery metadata and stored at its receive time so retention applies as
+-- if it had been stored then. Backfilled messages carry the x-backfilled
+-- header. Messages move in batches, each committed on its own, so a large
+-- table is neither locked nor rewritten in one transaction and an
+-- interrupted run resumes where it stopped. Chunks compressed by TimescaleDB
+-- are updated in place (2.11+); on large tables run it outside peak hours.
+
+-- Readings still holding their payload, keyed by receive time and payload
+-- hash; dropped once the backfill is done
+CREATE INDEX IF NOT EXISTS idx_meter_readings_raw_legacy_payload
+ON meter_readings_raw (received_at, md5(raw_payload::text))
+WHERE raw_payload IS NOT NULL AND ingest_message_id IS NULL;
+
+DO $$
+DECLARE
+    moved BIGINT;
+BEGIN
+    LOOP
+        WITH legacy AS (
+            SELECT DISTINCT received_at, md5(raw_payload::text) AS payload_md5, client_id
+            FROM meter_readings_raw
+            WHERE raw_payload IS NOT NULL AND ingest_message_id IS NULL
+            LIMIT 1000
+        ), messages AS (
+            INSERT INTO ingest_messages (request_id, client_id, received_at, payload, headers, stored_at)
+            SELECT p.raw_payload->>'request_id', l.client_id, l.received_at, p.raw_payload,
+                   '{"x-backfilled": true}', l.received_at
+            FROM legacy l
+            CROSS JOIN LATERAL (
+                SELECT r.raw_payload
+                FROM meter_readings_raw r
+                WHERE r.raw_payload IS NOT NULL AND r.ingest_message_id IS NULL
+                  AND r.received_at = l.received_at
+                  AND md5(r.raw_payload::text) = l.payload_md5
+                  AND r.client_id IS NOT DISTINCT FROM l.client_id
+                LIMIT 1
+            ) p
+            RETURNING id, client_id, received_at, md5(payload::text) AS payload_md5
+        )
+        UPDATE meter_readings_raw r
+        SET ingest_message_id = m.id, raw_payload = NULL
+        FROM messages m
+        WHERE r.raw_payload IS NOT NULL AND r.ingest_message_id IS NULL
+          AND r.received_at = m.received_at
+          AND md5(r.raw_payload::text) = m.payload_md5
+          AND r.client_id IS NOT DISTINCT FROM m.client_id;
+
+        GET DIAGNOSTICS moved = ROW_COUNT;
+        EXIT WHEN moved = 0;
+        COMMIT;
+    END LOOP;
+END
+$$;
+
+DROP INDEX IF EXISTS idx_meter_readings_raw_legacy_payload;
@@ -0,0 +1,2 @@
+-- The backfilled buckets are kept; the rollups are dropped with
+-- 0003_reading_rollups.
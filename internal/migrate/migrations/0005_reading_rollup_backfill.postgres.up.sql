@@ -0,0 +1,11 @@
+-- The rollup tables only learn about readings through the invalidation
+-- trigger of 0003_reading_rollups, so compute the buckets of the readings
+-- stored before it once, over their whole time range.
+SELECT refresh_reading_rollup(v.rollup, v.bucket_width, r.first_ts, r.last_ts)
+FROM (SELECT min(reading_timestamp) AS first_ts, max(reading_timestamp) AS last_ts FROM meter_readings_raw) r,
+    (VALUES
+        ('meter_readings_15m'::regclass, INTERVAL '15 minutes'),
+        ('meter_readings_1h'::regclass, INTERVAL '1 hour'),
+        ('meter_readings_1d'::regclass, INTERVAL '1 day')
+    ) AS v(rollup, bucket_width)
+WHERE r.first_ts IS NOT NULL;
@@ -0,0 +1,8 @@
+-- migrate:no-transaction
+-- The continuous aggregates of 0003_reading_rollups were created empty and
+-- their policies only refresh the last 7 days, so materialize the readings
+-- stored before them once. refresh_continuous_aggregate cannot run inside a
+-- transaction block.
+CALL refresh_continuous_aggregate('meter_readings_15m', NULL, NULL);
+CALL refresh_continuous_aggregate('meter_readings_1h', NULL, NULL);
+CALL refresh_continuous_aggregate('meter_readings_1d', NULL, NULL);
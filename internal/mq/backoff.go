@@ -0,0 +1,52 @@
+package mq
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff describes an exponential backoff with jitter
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Duration returns the delay before the given (zero-based) attempt.
+// The delay doubles on every attempt up to Max, and a random jitter of up to
+// half the delay is applied so that replicas do not reconnect in lockstep.
+func (b Backoff) Duration(attempt int) time.Duration {
+	initial := b.Initial
+	if initial <= 0 {
+		initial = time.Second
+	}
+	max := b.Max
+	if max < initial {
+		max = initial
+	}
+
+	delay := initial
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int64N(int64(half)+1))
+}
+
+// sleep waits for d or until ctx is cancelled, reporting whether the full
+// delay elapsed
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -2,20 +2,37 @@ package mq
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
 
-// Connection wraps RabbitMQ connection
+// ErrNotConnected is returned when a channel is requested while the
+// connection is being re-established
+var ErrNotConnected = errors.New("rabbitmq connection is not available")
+
+// Connection wraps a RabbitMQ connection and re-dials it with backoff
+// whenever the broker closes it unexpectedly
 type Connection struct {
-	conn *amqp.Connection
+	url     string
+	backoff Backoff
+	logger  *zap.Logger
+
+	mu    sync.RWMutex
+	conn  *amqp.Connection
+	ready chan struct{} // closed while conn is usable
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 // NewConnection creates a new RabbitMQ connection
-func NewConnection(lc fx.Lifecycle, logger *zap.Logger, url string) (*Connection, error) {
+func NewConnection(lc fx.Lifecycle, logger *zap.Logger, url string, backoff Backoff) (*Connection, error) {
 	logger.Info("attempting to connect to RabbitMQ...")
 
 	conn, err := amqp.Dial(url)
@@ -24,7 +41,20 @@ func NewConnection(lc fx.Lifecycle, logger *zap.Logger, url string) (*Connection
 		return nil, fmt.Errorf("[RABBITMQ CONNECTION FAILED] cannot connect to RabbitMQ. Please check: 1) RabbitMQ is running, 2) RABBITMQ_URL is correct, 3) Credentials are valid. Error: %w", err)
 	}
 
-	mqConn := &Connection{conn: conn}
+	ctx, cancel := context.WithCancel(context.Background())
+	mqConn := &Connection{
+		url:     url,
+		backoff: backoff,
+		logger:  logger,
+		conn:    conn,
+		ready:   make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	close(mqConn.ready)
+
+	mqConn.wg.Add(1)
+	go mqConn.supervise(conn)
 
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
@@ -32,12 +62,7 @@ func NewConnection(lc fx.Lifecycle, logger *zap.Logger, url string) (*Connection
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
-			if err := conn.Close(); err != nil {
-				logger.Error("failed to close rabbitmq connection", zap.Error(err))
-				return err
-			}
-			logger.Info("rabbitmq connection closed")
-			return nil
+			return mqConn.Close()
 		},
 	})
 
@@ -46,5 +71,122 @@ func NewConnection(lc fx.Lifecycle, logger *zap.Logger, url string) (*Connection
 
 // Channel creates a new RabbitMQ channel
 func (c *Connection) Channel() (*amqp.Channel, error) {
-	return c.conn.Channel()
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+// IsConnected reports whether the underlying connection is currently open
+func (c *Connection) IsConnected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn != nil && !c.conn.IsClosed()
+}
+
+// WaitReady blocks until the connection is open or ctx is done
+func (c *Connection) WaitReady(ctx context.Context) error {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-c.ctx.Done():
+		return ErrNotConnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops reconnecting and closes the underlying connection
+func (c *Connection) Close() error {
+	c.cancel()
+	c.wg.Wait()
+
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil
+	}
+	if err := conn.Close(); err != nil {
+		c.logger.Error("failed to close rabbitmq connection", zap.Error(err))
+		return err
+	}
+	c.logger.Info("rabbitmq connection closed")
+	return nil
+}
+
+// supervise watches the connection and replaces it when the broker drops it
+func (c *Connection) supervise(conn *amqp.Connection) {
+	defer c.wg.Done()
+
+	for {
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case amqpErr, ok := <-closed:
+			if !ok || amqpErr == nil {
+				// Closed by us
+				return
+			}
+			c.logger.Warn("rabbitmq connection lost, reconnecting",
+				zap.String("reason", amqpErr.Reason),
+				zap.Int("code", amqpErr.Code),
+			)
+		}
+
+		c.mu.Lock()
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		next := c.redial()
+		if next == nil {
+			return
+		}
+		conn = next
+	}
+}
+
+// redial dials until it succeeds or the connection is closed
+func (c *Connection) redial() *amqp.Connection {
+	for attempt := 0; ; attempt++ {
+		delay := c.backoff.Duration(attempt)
+		if !sleep(c.ctx, delay) {
+			return nil
+		}
+
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			c.logger.Warn("rabbitmq reconnect attempt failed",
+				zap.Int("attempt", attempt+1),
+				zap.Duration("delay", delay),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.ctx.Err() != nil {
+			c.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		c.conn = conn
+		close(c.ready)
+		c.mu.Unlock()
+
+		c.logger.Info("rabbitmq connection re-established", zap.Int("attempts", attempt+1))
+		return conn
+	}
 }
@@ -2,27 +2,46 @@ package mq
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
-	"go.uber.org/fx"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 // MessageHandler is a function that processes a message
-type MessageHandler func(ctx context.Context, body []byte) error
+type MessageHandler func(ctx context.Context, delivery Delivery) error
 
 // Consumer handles message consumption from RabbitMQ
 type Consumer struct {
 	conn             *Connection
-	channel          *amqp.Channel
 	queue            string
 	dlqQueue         string
 	exchange         string
 	routingKey       string
 	prefetchCount    int
+	retryDelays      []time.Duration
+	maxRetries       int
+	concurrency      int
+	shardKey         ShardKeyFunc
+	backoff          Backoff
 	logger           *zap.Logger
 	messageProcessor MessageHandler
+	retries          *retryPublisher
+
+	mu      sync.Mutex
+	channel *amqp.Channel
+
+	running atomic.Bool
+	done    chan struct{} // closed once consumption stopped and workers drained
 }
 
 // ConsumerConfig holds consumer configuration
@@ -33,19 +52,58 @@ type ConsumerConfig struct {
 	Exchange         string
 	RoutingKey       string
 	PrefetchCount    int
+	RetryDelays      []time.Duration // delay tiers; empty disables retries
+	MaxRetries       int             // attempts before dead-lettering
+	ConfirmTimeout   time.Duration   // wait for the broker to confirm a retry copy
+	Concurrency      int             // number of processing workers
+	ShardKey         ShardKeyFunc    // per-key ordering; nil spreads messages evenly
+	Backoff          Backoff
 	Logger           *zap.Logger
 	MessageProcessor MessageHandler
 }
 
 // NewConsumer creates a new RabbitMQ consumer
 func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
-	ch, err := cfg.Connection.Channel()
+	c := &Consumer{
+		conn:             cfg.Connection,
+		queue:            cfg.Queue,
+		dlqQueue:         cfg.DLQQueue,
+		exchange:         cfg.Exchange,
+		routingKey:       cfg.RoutingKey,
+		prefetchCount:    cfg.PrefetchCount,
+		retryDelays:      cfg.RetryDelays,
+		maxRetries:       cfg.MaxRetries,
+		concurrency:      cfg.Concurrency,
+		shardKey:         cfg.ShardKey,
+		backoff:          cfg.Backoff,
+		logger:           cfg.Logger,
+		messageProcessor: cfg.MessageProcessor,
+		retries:          &retryPublisher{conn: cfg.Connection, confirmTimeout: cfg.ConfirmTimeout},
+		done:             make(chan struct{}),
+	}
+	if c.concurrency < 1 {
+		c.concurrency = 1
+	}
+
+	ch, err := c.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	c.channel = ch
+
+	return c, nil
+}
+
+// openChannel opens a channel and declares the exchange, queue and DLQ
+// topology on it. It is used both on startup and after a reconnect.
+func (c *Consumer) openChannel() (*amqp.Channel, error) {
+	ch, err := c.conn.Channel()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create channel: %w", err)
 	}
 
 	// Set QoS (prefetch)
-	err = ch.Qos(cfg.PrefetchCount, 0, false)
+	err = ch.Qos(c.prefetchCount, 0, false)
 	if err != nil {
 		ch.Close()
 		return nil, fmt.Errorf("failed to set QoS: %w", err)
@@ -53,7 +111,7 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 
 	// Declare exchange
 	err = ch.ExchangeDeclare(
-		cfg.Exchange,
+		c.exchange,
 		"topic",
 		true,  // durable
 		false, // auto-deleted
@@ -70,10 +128,10 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	// Try to declare with DLX, if fails due to precondition, try without DLX
 	args := map[string]interface{}{
 		"x-dead-letter-exchange":    "",
-		"x-dead-letter-routing-key": cfg.DLQQueue,
+		"x-dead-letter-routing-key": c.dlqQueue,
 	}
 	_, err = ch.QueueDeclare(
-		cfg.Queue,
+		c.queue,
 		true,  // durable
 		false, // delete when unused
 		false, // exclusive
@@ -81,11 +139,22 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 		args,
 	)
 	if err != nil {
-		// If queue already exists with different args, try without DLX
-		cfg.Logger.Warn("failed to declare queue with DLX, trying without DLX",
+		// If queue already exists with different args, try without DLX.
+		// The broker closes the channel on a precondition failure, so the
+		// retry needs a fresh one.
+		c.logger.Warn("failed to declare queue with DLX, trying without DLX",
 			zap.Error(err))
+		ch.Close()
+		ch, err = c.conn.Channel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create channel: %w", err)
+		}
+		if err = ch.Qos(c.prefetchCount, 0, false); err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("failed to set QoS: %w", err)
+		}
 		_, err = ch.QueueDeclare(
-			cfg.Queue,
+			c.queue,
 			true,  // durable
 			false, // delete when unused
 			false, // exclusive
@@ -100,7 +169,7 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 
 	// Declare DLQ
 	_, err = ch.QueueDeclare(
-		cfg.DLQQueue,
+		c.dlqQueue,
 		true,  // durable
 		false, // delete when unused
 		false, // exclusive
@@ -112,11 +181,17 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 		return nil, fmt.Errorf("failed to declare DLQ: %w", err)
 	}
 
+	// Declare delayed retry queues
+	if err := c.declareRetryQueues(ch); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
 	// Bind queue to exchange
 	err = ch.QueueBind(
-		cfg.Queue,
-		cfg.RoutingKey,
-		cfg.Exchange,
+		c.queue,
+		c.routingKey,
+		c.exchange,
 		false,
 		nil,
 	)
@@ -125,22 +200,77 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 		return nil, fmt.Errorf("failed to bind queue: %w", err)
 	}
 
-	return &Consumer{
-		conn:             cfg.Connection,
-		channel:          ch,
-		queue:            cfg.Queue,
-		dlqQueue:         cfg.DLQQueue,
-		exchange:         cfg.Exchange,
-		routingKey:       cfg.RoutingKey,
-		prefetchCount:    cfg.PrefetchCount,
-		logger:           cfg.Logger,
-		messageProcessor: cfg.MessageProcessor,
-	}, nil
+	return ch, nil
 }
 
 // Start starts consuming messages
 func (c *Consumer) Start(ctx context.Context) error {
-	msgs, err := c.channel.Consume(
+	msgs, err := c.consume()
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("consumer started",
+		zap.String("queue", c.queue),
+		zap.Int("prefetch", c.prefetchCount),
+		zap.Int("concurrency", c.concurrency),
+	)
+
+	// In-flight work keeps running after ctx is cancelled so that shutdown
+	// drains it instead of failing it halfway
+	workCtx := context.WithoutCancel(ctx)
+	pool := newWorkerPool(c.concurrency, c.prefetchCount, func(msg amqp.Delivery) {
+		c.processMessage(workCtx, msg)
+	})
+
+	c.running.Store(true)
+	go func() {
+		defer close(c.done)
+		defer c.running.Store(false)
+		c.run(ctx, msgs, pool)
+		pool.close()
+		pool.wait()
+	}()
+
+	return nil
+}
+
+// IsRunning reports whether the consume loop is active. It stays true while
+// the consumer recovers from a lost channel.
+func (c *Consumer) IsRunning() bool {
+	return c.running.Load()
+}
+
+// IsChannelOpen reports whether the consumer currently has an open channel
+func (c *Consumer) IsChannelOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channel != nil && !c.channel.IsClosed()
+}
+
+// Wait blocks until the consumer stopped and all in-flight deliveries were
+// processed, or ctx is done. Call it after cancelling the Start context and
+// before Close.
+func (c *Consumer) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out draining in-flight messages: %w", ctx.Err())
+	}
+}
+
+// consume registers a consumer on the current channel
+func (c *Consumer) consume() (<-chan amqp.Delivery, error) {
+	c.mu.Lock()
+	ch := c.channel
+	c.mu.Unlock()
+
+	if ch == nil {
+		return nil, fmt.Errorf("failed to start consuming: channel is closed")
+	}
+
+	msgs, err := ch.Consume(
 		c.queue,
 		"",    // consumer tag
 		false, // auto-ack
@@ -150,86 +280,204 @@ func (c *Consumer) Start(ctx context.Context) error {
 		nil,   // args
 	)
 	if err != nil {
-		return fmt.Errorf("failed to start consuming: %w", err)
+		return nil, fmt.Errorf("failed to start consuming: %w", err)
 	}
+	return msgs, nil
+}
 
-	c.logger.Info("consumer started",
-		zap.String("queue", c.queue),
-		zap.Int("prefetch", c.prefetchCount),
-	)
+// run processes deliveries and re-establishes the channel whenever the
+// delivery stream ends before ctx is cancelled
+func (c *Consumer) run(ctx context.Context, msgs <-chan amqp.Delivery, pool *workerPool) {
+	for {
+		c.dispatch(ctx, msgs, pool)
+		if ctx.Err() != nil {
+			c.logger.Info("consumer context cancelled, stopping")
+			return
+		}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				c.logger.Info("consumer context cancelled, stopping")
+		c.logger.Warn("message channel closed, recovering consumer")
+		msgs = c.recover(ctx)
+		if msgs == nil {
+			c.logger.Info("consumer context cancelled, stopping")
+			return
+		}
+		c.logger.Info("consumer recovered", zap.String("queue", c.queue))
+	}
+}
+
+// dispatch hands deliveries to the worker pool until ctx is cancelled or
+// msgs is closed. Deliveries left unprocessed are requeued by the broker
+// when the channel closes.
+func (c *Consumer) dispatch(ctx context.Context, msgs <-chan amqp.Delivery, pool *workerPool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			metrics.MessagesConsumed.WithLabelValues(c.queue).Inc()
+			metrics.DeliveriesInFlight.WithLabelValues(c.queue).Inc()
+			if !pool.submit(ctx, c.messageKey(msg), msg) {
+				metrics.DeliveriesInFlight.WithLabelValues(c.queue).Dec()
 				return
-			case msg, ok := <-msgs:
-				if !ok {
-					c.logger.Warn("message channel closed")
-					return
-				}
-				c.processMessage(ctx, msg)
 			}
 		}
-	}()
+	}
+}
 
-	return nil
+// messageKey returns the shard key of a delivery
+func (c *Consumer) messageKey(msg amqp.Delivery) string {
+	if c.shardKey != nil {
+		return c.shardKey(msg.Body)
+	}
+	return strconv.FormatUint(msg.DeliveryTag, 10)
+}
+
+// recover re-opens the channel, re-declares the topology and resumes
+// consumption, retrying with backoff. It returns nil once ctx is cancelled.
+func (c *Consumer) recover(ctx context.Context) <-chan amqp.Delivery {
+	for attempt := 0; ; attempt++ {
+		if err := c.conn.WaitReady(ctx); err != nil {
+			return nil
+		}
+
+		ch, err := c.openChannel()
+		if err == nil {
+			if ctx.Err() != nil {
+				ch.Close()
+				return nil
+			}
+
+			c.mu.Lock()
+			c.channel = ch
+			c.mu.Unlock()
+
+			var msgs <-chan amqp.Delivery
+			msgs, err = c.consume()
+			if err == nil {
+				return msgs
+			}
+		}
+
+		delay := c.backoff.Duration(attempt)
+		c.logger.Warn("failed to recover consumer, retrying",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		if !sleep(ctx, delay) {
+			return nil
+		}
+	}
 }
 
 func (c *Consumer) processMessage(ctx context.Context, msg amqp.Delivery) {
+	defer metrics.DeliveriesInFlight.WithLabelValues(c.queue).Dec()
+
 	c.logger.Info("received message from queue",
 		zap.String("queue", c.queue),
 		zap.String("routing_key", msg.RoutingKey),
 		zap.Int("body_size", len(msg.Body)),
 	)
 
+	// Continue the trace of the publisher, if it propagated one
+	ctx, span := tracing.Tracer().Start(tracing.ExtractAMQP(ctx, msg.Headers), "consume "+c.queue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination.name", c.queue),
+			attribute.String("messaging.rabbitmq.destination.routing_key", msg.RoutingKey),
+			attribute.String("messaging.message.id", msg.MessageId),
+			attribute.Int("messaging.message.body.size", len(msg.Body)),
+			attribute.Int("messaging.rabbitmq.retry_count", RetryCount(msg.Headers)),
+		),
+	)
+	defer span.End()
+
 	// Process message with message processor
-	err := c.messageProcessor(ctx, msg.Body)
+	err := c.messageProcessor(ctx, newDelivery(msg))
+	tracing.RecordError(span, err)
 	if err != nil {
-		c.logger.Error("failed to process message",
-			zap.Error(err),
+		c.handleFailure(ctx, msg, err)
+		return
+	}
+
+	// ACK message after successful processing
+	if ackErr := msg.Ack(false); ackErr != nil {
+		c.logger.Error("failed to ACK message", zap.Error(ackErr))
+	} else {
+		metrics.MessagesAcked.WithLabelValues(c.queue, "processed").Inc()
+		c.logger.Info("message processed and acknowledged successfully",
 			zap.String("routing_key", msg.RoutingKey),
 		)
+	}
+}
+
+// handleFailure schedules a delayed retry for transient failures and
+// dead-letters permanent failures or messages that exhausted their attempts.
+// A delivery is only acknowledged once the broker confirmed its retry copy.
+func (c *Consumer) handleFailure(ctx context.Context, msg amqp.Delivery, err error) {
+	attempt := RetryCount(msg.Headers)
+	logger := c.logger.With(
+		zap.Error(err),
+		zap.String("routing_key", msg.RoutingKey),
+		zap.Int("attempt", attempt+1),
+	)
+
+	if IsPermanent(err) || len(c.retryDelays) == 0 || attempt >= c.maxRetries {
+		logger.Error("failed to process message, sending to DLQ",
+			zap.Bool("permanent", IsPermanent(err)),
+		)
 
 		// NACK with requeue=false sends to DLQ
 		if nackErr := msg.Nack(false, false); nackErr != nil {
 			c.logger.Error("failed to NACK message", zap.Error(nackErr))
+		} else {
+			metrics.MessagesNacked.WithLabelValues(c.queue, "dead_lettered").Inc()
 		}
 		return
 	}
 
-	// ACK message after successful processing
+	delay := retryDelay(c.retryDelays, attempt)
+	retryQueue := RetryQueueName(c.queue, delay)
+
+	pubErr := c.retries.publish(ctx, retryQueue, retryPublishing(msg, attempt+1, err))
+	if pubErr != nil {
+		// Requeue rather than dead-letter a message that may well succeed.
+		// A copy that was nacked or timed out may still be queued, in which
+		// case the request ledger skips the duplicate.
+		logger.Error("failed to schedule retry, requeueing message", zap.NamedError("publish_error", pubErr))
+		if nackErr := msg.Nack(false, true); nackErr != nil {
+			c.logger.Error("failed to NACK message", zap.Error(nackErr))
+		} else {
+			metrics.MessagesNacked.WithLabelValues(c.queue, "requeued").Inc()
+		}
+		return
+	}
+
+	logger.Warn("failed to process message, retry scheduled",
+		zap.String("retry_queue", retryQueue),
+		zap.Duration("delay", delay),
+	)
 	if ackErr := msg.Ack(false); ackErr != nil {
 		c.logger.Error("failed to ACK message", zap.Error(ackErr))
 	} else {
-		c.logger.Info("message processed and acknowledged successfully",
-			zap.String("routing_key", msg.RoutingKey),
-		)
+		metrics.MessagesAcked.WithLabelValues(c.queue, "retry_scheduled").Inc()
 	}
 }
 
-// Close closes the consumer channel
+// Close closes the consumer and retry channels
 func (c *Consumer) Close() error {
-	if c.channel != nil {
-		return c.channel.Close()
-	}
-	return nil
-}
+	c.mu.Lock()
+	ch := c.channel
+	c.channel = nil
+	c.mu.Unlock()
 
-// RegisterLifecycle registers the consumer with Fx lifecycle
-func (c *Consumer) RegisterLifecycle(lc fx.Lifecycle, ctx context.Context) {
-	lc.Append(fx.Hook{
-		OnStart: func(startCtx context.Context) error {
-			return c.Start(ctx)
-		},
-		OnStop: func(stopCtx context.Context) error {
-			if err := c.channel.Close(); err != nil {
-				c.logger.Error("failed to close consumer channel", zap.Error(err))
-				return err
-			}
-			c.logger.Info("consumer stopped")
-			return nil
-		},
-	})
+	retryErr := c.retries.close()
+	if ch != nil && !ch.IsClosed() {
+		return errors.Join(ch.Close(), retryErr)
+	}
+	return retryErr
 }
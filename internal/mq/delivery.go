@@ -0,0 +1,38 @@
+package mq
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Delivery is a consumed message with the broker metadata handlers may
+// want to keep alongside it
+type Delivery struct {
+	Body        []byte
+	Headers     amqp.Table
+	MessageID   string
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	RetryCount  int       // delayed retries so far, from the x-retry-count header
+	Timestamp   time.Time // publisher timestamp, zero if unset
+	ConsumerTag string
+	DeliveryTag uint64
+}
+
+// newDelivery copies the metadata of an AMQP delivery
+func newDelivery(msg amqp.Delivery) Delivery {
+	return Delivery{
+		Body:        msg.Body,
+		Headers:     msg.Headers,
+		MessageID:   msg.MessageId,
+		Exchange:    msg.Exchange,
+		RoutingKey:  msg.RoutingKey,
+		Redelivered: msg.Redelivered,
+		RetryCount:  RetryCount(msg.Headers),
+		Timestamp:   msg.Timestamp,
+		ConsumerTag: msg.ConsumerTag,
+		DeliveryTag: msg.DeliveryTag,
+	}
+}
@@ -0,0 +1,79 @@
+package mq
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ShardKeyFunc extracts the ordering key of a message body. Messages with the
+// same key are always processed by the same worker, in delivery order.
+type ShardKeyFunc func(body []byte) string
+
+// workerPool runs a fixed number of workers, each draining its own queue of
+// deliveries
+type workerPool struct {
+	shards []chan amqp.Delivery
+	wg     sync.WaitGroup
+}
+
+// newWorkerPool starts size workers that call handle for every delivery
+// submitted to their shard. Each shard buffers up to buffer deliveries.
+func newWorkerPool(size, buffer int, handle func(amqp.Delivery)) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	p := &workerPool{shards: make([]chan amqp.Delivery, size)}
+	for i := range p.shards {
+		shard := make(chan amqp.Delivery, buffer)
+		p.shards[i] = shard
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range shard {
+				handle(msg)
+			}
+		}()
+	}
+	return p
+}
+
+// submit hands msg to the worker owning key, blocking while that worker's
+// queue is full. It returns false if ctx is cancelled first.
+func (p *workerPool) submit(ctx context.Context, key string, msg amqp.Delivery) bool {
+	select {
+	case p.shards[ShardIndex(key, len(p.shards))] <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close stops accepting deliveries; workers exit once their queues are empty
+func (p *workerPool) close() {
+	for _, shard := range p.shards {
+		close(shard)
+	}
+}
+
+// wait blocks until all workers have exited
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// ShardIndex maps a key onto one of n shards
+func ShardIndex(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
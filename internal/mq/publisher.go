@@ -3,30 +3,109 @@ package mq
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// maxPublishBatch bounds how many messages await confirmation at once. The
+// returns buffer must hold every basic.return of a batch, otherwise the
+// connection reader blocks before delivering the confirms.
+const maxPublishBatch = 256
+
+var (
+	// ErrPublishNacked is returned when the broker refused a message
+	ErrPublishNacked = errors.New("publish nacked by broker")
+
+	// ErrConfirmTimeout is returned when the broker did not confirm a
+	// message within the confirm timeout
+	ErrConfirmTimeout = errors.New("timed out waiting for publish confirm")
+
+	// ErrUnroutable is returned when a mandatory message matched no queue
+	ErrUnroutable = errors.New("message is unroutable")
+)
+
+// UnroutableError describes a message the broker returned because no queue
+// is bound for its routing key. It matches ErrUnroutable with errors.Is.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to exchange %q with routing key %q was returned: %d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// Is reports whether target is ErrUnroutable
+func (e *UnroutableError) Is(target error) bool {
+	return target == ErrUnroutable
+}
+
+// Message is an event to publish on the events exchange
+type Message struct {
+	RoutingKey string
+	Body       []byte
+	MessageID  string // generated when empty; consumers deduplicate on it
+
+	// TraceContext is the propagated trace context of the work that produced
+	// the message. The publish span becomes its child; when empty, the span
+	// is parented on the publishing context instead.
+	TraceContext map[string]string
+}
+
 // Publisher handles message publishing to RabbitMQ
 type Publisher struct {
-	conn     *Connection
-	channel  *amqp.Channel
-	exchange string
-	logger   *zap.Logger
+	conn           *Connection
+	exchange       string
+	confirmTimeout time.Duration
+	logger         *zap.Logger
+
+	// mu serializes publishing so that returned messages can be matched to
+	// the batch awaiting confirmation
+	mu      sync.Mutex
+	channel *amqp.Channel
+	returns chan amqp.Return
 }
 
 // NewPublisher creates a new RabbitMQ publisher
-func NewPublisher(conn *Connection, exchange string, logger *zap.Logger) (*Publisher, error) {
-	ch, err := conn.Channel()
+func NewPublisher(conn *Connection, exchange string, confirmTimeout time.Duration, logger *zap.Logger) (*Publisher, error) {
+	p := &Publisher{
+		conn:           conn,
+		exchange:       exchange,
+		confirmTimeout: confirmTimeout,
+		logger:         logger,
+	}
+
+	if err := p.openChannel(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// openChannel opens a channel in confirm mode and declares the events
+// exchange on it. p.mu must be held, except during construction.
+func (p *Publisher) openChannel() error {
+	ch, err := p.conn.Channel()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create channel: %w", err)
+		return fmt.Errorf("failed to create channel: %w", err)
 	}
 
 	// Declare exchange
 	err = ch.ExchangeDeclare(
-		exchange,
+		p.exchange,
 		"topic",
 		true,  // durable
 		false, // auto-deleted
@@ -36,24 +115,94 @@ func NewPublisher(conn *Connection, exchange string, logger *zap.Logger) (*Publi
 	)
 	if err != nil {
 		ch.Close()
-		return nil, fmt.Errorf("failed to declare exchange: %w", err)
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+
+	// Enable publisher confirms so a publish only succeeds once the broker
+	// has taken responsibility for the message
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to enable confirm mode: %w", err)
+	}
+
+	p.channel = ch
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, maxPublishBatch))
+	return nil
+}
+
+// ensureChannel re-opens the channel if it or the underlying connection was
+// closed since the last publish. p.mu must be held.
+func (p *Publisher) ensureChannel() error {
+	if p.channel != nil && !p.channel.IsClosed() {
+		return nil
 	}
 
-	return &Publisher{
-		conn:     conn,
-		channel:  ch,
-		exchange: exchange,
-		logger:   logger,
-	}, nil
+	reopened := p.channel != nil
+	if err := p.openChannel(); err != nil {
+		return err
+	}
+	if reopened {
+		p.logger.Info("publisher channel re-opened", zap.String("exchange", p.exchange))
+	}
+	return nil
 }
 
 // ProcessedEvent represents the event published after processing
 type ProcessedEvent struct {
+	ClientID         string   `json:"client_id"`
+	MetricName       string   `json:"metric_name"`
+	MetricValue      float64  `json:"metric_value"`
+	ReadingTimestamp string   `json:"reading_timestamp"`
+	ValidationStatus string   `json:"validation_status"`
+	DeltaValue       *float64 `json:"delta_value,omitempty"`   // counter metrics only
+	CounterEvent     string   `json:"counter_event,omitempty"` // rollover or reset
+}
+
+// MeterStuckEvent is published when a client metric starts repeating the
+// same value
+type MeterStuckEvent struct {
 	ClientID         string  `json:"client_id"`
 	MetricName       string  `json:"metric_name"`
 	MetricValue      float64 `json:"metric_value"`
+	StuckSince       string  `json:"stuck_since"`
 	ReadingTimestamp string  `json:"reading_timestamp"`
-	ValidationStatus string  `json:"validation_status"`
+	RunLength        int     `json:"run_length"`
+}
+
+// MeterOfflineEvent is published when a client metric stopped reporting
+type MeterOfflineEvent struct {
+	ClientID      string `json:"client_id"`
+	MetricName    string `json:"metric_name"`
+	LastReadingAt string `json:"last_reading_at"`
+	DetectedAt    string `json:"detected_at"`
+}
+
+// MeterBackOnlineEvent is published when an offline client metric reports
+// again, describing the gap it left
+type MeterBackOnlineEvent struct {
+	ClientID   string `json:"client_id"`
+	MetricName string `json:"metric_name"`
+	GapStart   string `json:"gap_start"`
+	GapEnd     string `json:"gap_end"`
+	GapSeconds int64  `json:"gap_seconds"`
+}
+
+// PartialSuccessEvent is published when some readings of a message were
+// stored and others rejected
+type PartialSuccessEvent struct {
+	RequestID         string      `json:"request_id"`
+	ClientID          string      `json:"client_id"`
+	ReadingsTotal     int         `json:"readings_total"`
+	ReadingsStored    int         `json:"readings_stored"`
+	ReadingsDuplicate int         `json:"readings_duplicate"` // already stored, skipped
+	ReadingsRejected  int         `json:"readings_rejected"`
+	Rejections        []Rejection `json:"rejections"`
+}
+
+// Rejection describes one rejected reading
+type Rejection struct {
+	MetricName string `json:"metric_name"`
+	Error      string `json:"error"`
 }
 
 // PublishProcessedEvent publishes a processed meter reading event
@@ -63,21 +212,8 @@ func (p *Publisher) PublishProcessedEvent(ctx context.Context, event ProcessedEv
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	err = p.channel.PublishWithContext(
-		ctx,
-		p.exchange,
-		routingKey,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         body,
-			DeliveryMode: amqp.Persistent,
-		},
-	)
-
-	if err != nil {
-		return fmt.Errorf("failed to publish event: %w", err)
+	if err := p.Publish(ctx, routingKey, body, ""); err != nil {
+		return err
 	}
 
 	p.logger.Debug("published processed event",
@@ -89,9 +225,162 @@ func (p *Publisher) PublishProcessedEvent(ctx context.Context, event ProcessedEv
 	return nil
 }
 
+// Publish publishes a JSON body to the events exchange and waits for the
+// broker to confirm it. messageID, when set, lets consumers deduplicate
+// redelivered events.
+func (p *Publisher) Publish(ctx context.Context, routingKey string, body []byte, messageID string) error {
+	return p.PublishBatch(ctx, []Message{{
+		RoutingKey: routingKey,
+		Body:       body,
+		MessageID:  messageID,
+	}})[0]
+}
+
+// PublishBatch publishes messages as mandatory and waits for all of their
+// confirms. The returned slice holds one error per message, nil on success;
+// failures are ErrPublishNacked, ErrConfirmTimeout or an *UnroutableError.
+func (p *Publisher) PublishBatch(ctx context.Context, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+	start := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for from := 0; from < len(msgs); from += maxPublishBatch {
+		to := min(from+maxPublishBatch, len(msgs))
+		p.publishChunk(ctx, msgs[from:to], errs[from:to])
+	}
+
+	mode := "batch"
+	if len(msgs) == 1 {
+		mode = "single"
+	}
+	metrics.PublishDuration.WithLabelValues(mode, metrics.Result(errors.Join(errs...))).Observe(time.Since(start).Seconds())
+
+	return errs
+}
+
+// publishChunk publishes up to maxPublishBatch messages. p.mu must be held.
+func (p *Publisher) publishChunk(ctx context.Context, msgs []Message, errs []error) {
+	if err := p.ensureChannel(); err != nil {
+		for i := range errs {
+			errs[i] = fmt.Errorf("failed to publish event: %w", err)
+		}
+		return
+	}
+
+	confirms := make([]*amqp.DeferredConfirmation, len(msgs))
+	pending := make(map[string]int, len(msgs))
+	spans := make([]trace.Span, len(msgs))
+	defer func() {
+		for i, span := range spans {
+			tracing.RecordError(span, errs[i])
+			span.End()
+		}
+	}()
+
+	for i, msg := range msgs {
+		messageID := msg.MessageID
+		if messageID == "" {
+			messageID = uuid.NewString()
+		}
+
+		spanCtx, span := tracing.Tracer().Start(tracing.ExtractMap(ctx, msg.TraceContext), "publish "+msg.RoutingKey,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "rabbitmq"),
+				attribute.String("messaging.destination.name", p.exchange),
+				attribute.String("messaging.rabbitmq.destination.routing_key", msg.RoutingKey),
+				attribute.String("messaging.message.id", messageID),
+			),
+		)
+		spans[i] = span
+
+		confirm, err := p.channel.PublishWithDeferredConfirmWithContext(
+			ctx,
+			p.exchange,
+			msg.RoutingKey,
+			true,  // mandatory: unroutable messages come back as returns
+			false, // immediate
+			amqp.Publishing{
+				Headers:      tracing.InjectAMQP(spanCtx, nil),
+				ContentType:  "application/json",
+				Body:         msg.Body,
+				DeliveryMode: amqp.Persistent,
+				MessageId:    messageID,
+				Timestamp:    time.Now(),
+			},
+		)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to publish event: %w", err)
+			continue
+		}
+		confirms[i] = confirm
+		pending[messageID] = i
+	}
+
+	waitCtx := ctx
+	if p.confirmTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.confirmTimeout)
+		defer cancel()
+	}
+
+	for i, confirm := range confirms {
+		if confirm == nil {
+			continue
+		}
+		acked, err := confirm.WaitContext(waitCtx)
+		switch {
+		case err != nil && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			errs[i] = ErrConfirmTimeout
+		case err != nil:
+			errs[i] = fmt.Errorf("failed to confirm event: %w", err)
+		case !acked:
+			errs[i] = ErrPublishNacked
+		}
+	}
+
+	p.collectReturns(pending, errs)
+}
+
+// collectReturns matches returned messages to the current batch. The broker
+// sends basic.return before the confirm of the same message, so every
+// return of an acknowledged batch is already buffered. p.mu must be held.
+func (p *Publisher) collectReturns(pending map[string]int, errs []error) {
+	for {
+		select {
+		case ret, ok := <-p.returns:
+			if !ok {
+				return
+			}
+			unroutable := &UnroutableError{
+				Exchange:   ret.Exchange,
+				RoutingKey: ret.RoutingKey,
+				ReplyCode:  ret.ReplyCode,
+				ReplyText:  ret.ReplyText,
+			}
+			i, found := pending[ret.MessageId]
+			if !found {
+				p.logger.Warn("discarding return for message outside current batch",
+					zap.String("message_id", ret.MessageId),
+					zap.Error(unroutable),
+				)
+				continue
+			}
+			errs[i] = unroutable
+		default:
+			return
+		}
+	}
+}
+
 // Close closes the publisher channel
 func (p *Publisher) Close() error {
-	if p.channel != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel != nil && !p.channel.IsClosed() {
 		return p.channel.Close()
 	}
 	return nil
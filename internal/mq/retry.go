@@ -0,0 +1,267 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RetryCountHeader carries the number of delivery attempts already made
+const RetryCountHeader = "x-retry-count"
+
+// lastErrorHeader carries the error of the most recent failed attempt
+const lastErrorHeader = "x-last-error"
+
+// maxLastErrorLength bounds the size of the error stored in message headers
+const maxLastErrorLength = 512
+
+// PermanentError marks a processing failure that cannot succeed on retry,
+// such as a malformed message body
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so that the consumer dead-letters the message
+// immediately instead of scheduling a retry
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// RetryQueueName returns the name of the delay queue for the given tier
+func RetryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, formatDelay(delay))
+}
+
+// formatDelay renders a delay in the largest whole unit, e.g. "5s" or "5m"
+func formatDelay(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	default:
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+}
+
+// RetryCount returns the number of attempts recorded in the delivery headers
+func RetryCount(headers amqp.Table) int {
+	switch v := headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// retryDelay returns the delay tier for the given attempt. Attempts beyond
+// the configured tiers reuse the longest one.
+func retryDelay(delays []time.Duration, attempt int) time.Duration {
+	if attempt >= len(delays) {
+		return delays[len(delays)-1]
+	}
+	return delays[attempt]
+}
+
+// declareRetryQueues declares one TTL queue per delay tier. Expired messages
+// are dead-lettered back to the ingest exchange with the ingest routing key.
+func (c *Consumer) declareRetryQueues(ch *amqp.Channel) error {
+	for _, delay := range c.retryDelays {
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    c.exchange,
+			"x-dead-letter-routing-key": c.routingKey,
+		}
+		_, err := ch.QueueDeclare(
+			RetryQueueName(c.queue, delay),
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			args,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare retry queue for %s: %w", delay, err)
+		}
+	}
+	return nil
+}
+
+// retryPublishing copies a delivery into a publishing for the retry queue,
+// incrementing the attempt counter
+func retryPublishing(msg amqp.Delivery, attempt int, cause error) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[RetryCountHeader] = int32(attempt)
+
+	lastErr := cause.Error()
+	if len(lastErr) > maxLastErrorLength {
+		lastErr = lastErr[:maxLastErrorLength]
+	}
+	headers[lastErrorHeader] = lastErr
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   msg.CorrelationId,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// retryPublisher publishes retry copies on a dedicated confirm-mode channel,
+// so that a failed delivery is only acknowledged once the broker has taken
+// its copy
+type retryPublisher struct {
+	conn           *Connection
+	confirmTimeout time.Duration
+
+	// mu serializes publishing so that a return belongs to the pending copy
+	mu      sync.Mutex
+	channel *amqp.Channel
+	returns chan amqp.Return
+}
+
+// ensureChannel opens the channel in confirm mode if it or the underlying
+// connection was closed since the last publish. p.mu must be held.
+func (p *retryPublisher) ensureChannel() error {
+	if p.channel != nil && !p.channel.IsClosed() {
+		return nil
+	}
+
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to create retry channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to enable confirm mode: %w", err)
+	}
+
+	// Room for the late returns of copies that timed out, so that the
+	// connection reader never blocks on them
+	p.channel = ch
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 16))
+	return nil
+}
+
+// publish routes msg to queue through the default exchange as mandatory and
+// waits for the broker to confirm it. Failures are ErrPublishNacked,
+// ErrConfirmTimeout or an *UnroutableError.
+func (p *retryPublisher) publish(ctx context.Context, queue string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ensureChannel(); err != nil {
+		return err
+	}
+	// Drop returns of earlier copies that timed out waiting for their confirm
+	p.drainReturns()
+
+	confirm, err := p.channel.PublishWithDeferredConfirmWithContext(ctx,
+		"", // default exchange routes straight to the retry queue
+		queue,
+		true,  // mandatory: a missing retry queue comes back as a return
+		false, // immediate
+		msg,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish retry: %w", err)
+	}
+
+	waitCtx := ctx
+	if p.confirmTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.confirmTimeout)
+		defer cancel()
+	}
+	acked, err := confirm.WaitContext(waitCtx)
+	switch {
+	case err != nil && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		return ErrConfirmTimeout
+	case err != nil:
+		return fmt.Errorf("failed to confirm retry: %w", err)
+	case !acked:
+		return ErrPublishNacked
+	}
+
+	// The broker sends basic.return before the confirm of the same message
+	if ret, ok := p.drainReturns(); ok {
+		return &UnroutableError{
+			Exchange:   ret.Exchange,
+			RoutingKey: ret.RoutingKey,
+			ReplyCode:  ret.ReplyCode,
+			ReplyText:  ret.ReplyText,
+		}
+	}
+	return nil
+}
+
+// drainReturns empties the returns buffer and reports the last return in it.
+// p.mu must be held.
+func (p *retryPublisher) drainReturns() (amqp.Return, bool) {
+	var last amqp.Return
+	found := false
+	for {
+		select {
+		case ret, ok := <-p.returns:
+			if !ok {
+				return last, found
+			}
+			last, found = ret, true
+		default:
+			return last, found
+		}
+	}
+}
+
+// close closes the retry channel
+func (p *retryPublisher) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel != nil && !p.channel.IsClosed() {
+		return p.channel.Close()
+	}
+	return nil
+}
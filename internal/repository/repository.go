@@ -2,13 +2,16 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
 )
 
 // Tx is an alias for pgx.Tx
@@ -24,17 +27,34 @@ func NewRepository(pool *pgxpool.Pool) *Repository {
 	return &Repository{pool: pool}
 }
 
-// GetOrCreateClient retrieves or creates a meter client
-func (r *Repository) GetOrCreateClient(ctx context.Context, fingerprint string, ipAddress string, userAgent *string) (*db.MeterClient, error) {
-	// Try to get existing client
+// UpsertClient creates the client for fingerprint or, if it exists, records
+// its current IP address and user agent, in a single statement that is safe
+// against concurrent workers. The identity is also recorded in the client's
+// identity history.
+func (r *Repository) UpsertClient(ctx context.Context, fingerprint string, ipAddress string, userAgent *string) (_ *db.MeterClient, err error) {
+	defer observe("upsert_client", time.Now(), &err)
+
 	query := `
+		WITH client AS (
+			INSERT INTO meter_clients (client_fingerprint, ip_address, user_agent, first_seen_at, last_seen_at, created_at)
+			VALUES ($1, $2, $3, $4, $4, $4)
+			ON CONFLICT (client_fingerprint) DO UPDATE
+			SET ip_address = EXCLUDED.ip_address,
+				user_agent = EXCLUDED.user_agent,
+				last_seen_at = GREATEST(meter_clients.last_seen_at, EXCLUDED.last_seen_at)
+			RETURNING id, client_fingerprint, ip_address, user_agent, first_seen_at, last_seen_at, created_at
+		), identity AS (
+			INSERT INTO meter_client_identities (client_id, ip_address, user_agent, first_seen_at, last_seen_at)
+			SELECT id, ip_address, COALESCE(user_agent, ''), $4, $4 FROM client
+			ON CONFLICT (client_id, ip_address, user_agent) DO UPDATE
+			SET last_seen_at = GREATEST(meter_client_identities.last_seen_at, EXCLUDED.last_seen_at)
+		)
 		SELECT id, client_fingerprint, ip_address::text, user_agent, first_seen_at, last_seen_at, created_at
-		FROM meter_clients
-		WHERE client_fingerprint = $1
+		FROM client
 	`
 
 	var client db.MeterClient
-	err := r.pool.QueryRow(ctx, query, fingerprint).Scan(
+	err = r.pool.QueryRow(ctx, query, fingerprint, ipAddress, userAgent, time.Now()).Scan(
 		&client.ID,
 		&client.ClientFingerprint,
 		&client.IPAddress,
@@ -44,62 +64,95 @@ func (r *Repository) GetOrCreateClient(ctx context.Context, fingerprint string,
 		&client.CreatedAt,
 	)
 
-	if err == nil {
-		// Client exists, update last_seen_at
-		updateQuery := `
-			UPDATE meter_clients
-			SET last_seen_at = $1
-			WHERE id = $2
-		`
-		now := time.Now()
-		_, err = r.pool.Exec(ctx, updateQuery, now, client.ID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to update client last_seen_at: %w", err)
-		}
-		client.LastSeenAt = now
-		return &client, nil
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert client: %w", err)
+	}
+
+	return &client, nil
+}
+
+// TouchClients advances last_seen_at of clients and of the identities they
+// were seen with. It applies the sightings coalesced since the last call in
+// one transaction.
+func (r *Repository) TouchClients(ctx context.Context, sightings []db.ClientSighting) (err error) {
+	defer observe("touch_clients", time.Now(), &err)
+
+	if len(sightings) == 0 {
+		return nil
 	}
 
-	if err != pgx.ErrNoRows {
-		return nil, fmt.Errorf("failed to query client: %w", err)
+	ids := make([]uuid.UUID, len(sightings))
+	ips := make([]string, len(sightings))
+	userAgents := make([]string, len(sightings))
+	seenAt := make([]time.Time, len(sightings))
+	for i, s := range sightings {
+		ids[i] = s.ClientID
+		ips[i] = s.IPAddress
+		userAgents[i] = s.UserAgent
+		seenAt[i] = s.SeenAt
 	}
 
-	// Client doesn't exist, create new one
-	insertQuery := `
-		INSERT INTO meter_clients (client_fingerprint, ip_address, user_agent, first_seen_at, last_seen_at, created_at)
-		VALUES ($1, $2, $3, $4, $4, $4)
-		RETURNING id, client_fingerprint, ip_address::text, user_agent, first_seen_at, last_seen_at, created_at
+	clientsQuery := `
+		UPDATE meter_clients c
+		SET last_seen_at = GREATEST(c.last_seen_at, v.seen_at)
+		FROM unnest($1::uuid[], $2::timestamptz[]) AS v(id, seen_at)
+		WHERE c.id = v.id
 	`
 
-	now := time.Now()
-	err = r.pool.QueryRow(ctx, insertQuery, fingerprint, ipAddress, userAgent, now).Scan(
-		&client.ID,
-		&client.ClientFingerprint,
-		&client.IPAddress,
-		&client.UserAgent,
-		&client.FirstSeenAt,
-		&client.LastSeenAt,
-		&client.CreatedAt,
-	)
+	identitiesQuery := `
+		UPDATE meter_client_identities i
+		SET last_seen_at = GREATEST(i.last_seen_at, v.seen_at)
+		FROM unnest($1::uuid[], $2::text[], $3::text[], $4::timestamptz[]) AS v(client_id, ip_address, user_agent, seen_at)
+		WHERE i.client_id = v.client_id AND i.ip_address = v.ip_address::inet AND i.user_agent = v.user_agent
+	`
 
+	tx, err := r.pool.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	return &client, nil
+	if _, err := tx.Exec(ctx, clientsQuery, ids, seenAt); err != nil {
+		return fmt.Errorf("failed to update client last_seen_at: %w", err)
+	}
+	if _, err := tx.Exec(ctx, identitiesQuery, ids, ips, userAgents, seenAt); err != nil {
+		return fmt.Errorf("failed to update client identity last_seen_at: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit client last_seen_at: %w", err)
+	}
+
+	return nil
 }
 
-// InsertMeterReading inserts a meter reading
-func (r *Repository) InsertMeterReading(ctx context.Context, reading *db.MeterReading) error {
+// observe records the latency of a repository operation. Defer it with a
+// pointer to the operation's named error result.
+func observe(operation string, start time.Time, err *error) {
+	metrics.ObserveDBQuery(operation, start, *err)
+}
+
+// BeginTx starts a new transaction
+func (r *Repository) BeginTx(ctx context.Context) (pgx.Tx, error) {
+	return r.pool.Begin(ctx)
+}
+
+// InsertMeterReadingTx inserts a meter reading within a transaction. It
+// reports false when a reading with the same natural key is already stored.
+func (r *Repository) InsertMeterReadingTx(ctx context.Context, tx pgx.Tx, reading *db.MeterReading) (_ bool, err error) {
+	defer observe("insert_reading", time.Now(), &err)
+
 	query := `
 		INSERT INTO meter_readings_raw (
 			client_id, metric_name, metric_value, reading_timestamp,
-			received_at, validation_status, anomaly_reason, raw_payload
+			received_at, validation_status, anomaly_reason, ingest_message_id,
+			delta_value, counter_event
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (client_id, metric_name, reading_timestamp) DO NOTHING
 	`
 
-	_, err := r.pool.Exec(ctx, query,
+	tag, err := tx.Exec(ctx, query,
 		reading.ClientID,
 		reading.MetricName,
 		reading.MetricValue,
@@ -107,72 +160,422 @@ func (r *Repository) InsertMeterReading(ctx context.Context, reading *db.MeterRe
 		reading.ReceivedAt,
 		reading.ValidationStatus,
 		reading.AnomalyReason,
-		reading.RawPayload,
+		reading.IngestMessageID,
+		reading.DeltaValue,
+		reading.CounterEvent,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to insert meter reading: %w", err)
+		return false, fmt.Errorf("failed to insert meter reading: %w", err)
 	}
 
-	return nil
+	return tag.RowsAffected() == 1, nil
 }
 
-// BeginTx starts a new transaction
-func (r *Repository) BeginTx(ctx context.Context) (pgx.Tx, error) {
-	return r.pool.Begin(ctx)
+// ClaimRequestTx records requestID in the processed-requests ledger within
+// the reading transaction. It reports false when the request was already
+// stored by an earlier delivery.
+func (r *Repository) ClaimRequestTx(ctx context.Context, tx pgx.Tx, requestID string, clientID uuid.UUID) (_ bool, err error) {
+	defer observe("claim_request", time.Now(), &err)
+
+	query := `
+		INSERT INTO processed_requests (request_id, client_id, processed_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (request_id) DO NOTHING
+	`
+
+	tag, err := tx.Exec(ctx, query, requestID, clientID, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("failed to claim request: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
 }
 
-// InsertMeterReadingTx inserts a meter reading within a transaction
-func (r *Repository) InsertMeterReadingTx(ctx context.Context, tx pgx.Tx, reading *db.MeterReading) error {
+// DeleteProcessedRequestsTx removes ledger entries of requests processed
+// before the given time
+func (r *Repository) DeleteProcessedRequestsTx(ctx context.Context, tx pgx.Tx, processedBefore time.Time) (_ int64, err error) {
+	defer observe("delete_processed_requests", time.Now(), &err)
+
 	query := `
-		INSERT INTO meter_readings_raw (
-			client_id, metric_name, metric_value, reading_timestamp,
-			received_at, validation_status, anomaly_reason, raw_payload
+		DELETE FROM processed_requests
+		WHERE processed_at < $1
+	`
+
+	tag, err := tx.Exec(ctx, query, processedBefore)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete processed requests: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// InsertIngestMessageTx stores a raw ingest message within the reading
+// transaction and returns its ID
+func (r *Repository) InsertIngestMessageTx(ctx context.Context, tx pgx.Tx, m *db.IngestMessage) (_ int64, err error) {
+	defer observe("insert_ingest_message", time.Now(), &err)
+
+	query := `
+		INSERT INTO ingest_messages (
+			request_id, client_id, received_at, payload, headers,
+			message_id, exchange, routing_key, redelivered, retry_count, published_at
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
 	`
 
-	_, err := tx.Exec(ctx, query,
-		reading.ClientID,
-		reading.MetricName,
-		reading.MetricValue,
-		reading.ReadingTimestamp,
-		reading.ReceivedAt,
-		reading.ValidationStatus,
-		reading.AnomalyReason,
-		reading.RawPayload,
+	var id int64
+	err = tx.QueryRow(ctx, query,
+		nullString(m.RequestID),
+		m.ClientID,
+		m.ReceivedAt,
+		m.Payload,
+		m.Headers,
+		nullString(m.MessageID),
+		m.Exchange,
+		m.RoutingKey,
+		m.Redelivered,
+		m.RetryCount,
+		m.PublishedAt,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert ingest message: %w", err)
+	}
+
+	return id, nil
+}
+
+// DeleteIngestMessagesTx deletes ingest messages stored before storedBefore.
+// Readings keep their ingest_message_id; their message is then reported as
+// not found.
+func (r *Repository) DeleteIngestMessagesTx(ctx context.Context, tx pgx.Tx, storedBefore time.Time) (_ int64, err error) {
+	defer observe("delete_ingest_messages", time.Now(), &err)
+
+	query := `
+		DELETE FROM ingest_messages
+		WHERE stored_at < $1
+	`
+
+	tag, err := tx.Exec(ctx, query, storedBefore)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete ingest messages: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// GetIngestMessage gets a stored ingest message by ID. It reports false when
+// there is none.
+func (r *Repository) GetIngestMessage(ctx context.Context, id int64) (_ db.IngestMessage, _ bool, err error) {
+	defer observe("get_ingest_message", time.Now(), &err)
+
+	query := `
+		SELECT id, COALESCE(request_id, ''), client_id, received_at, payload, headers,
+			COALESCE(message_id, ''), exchange, routing_key, redelivered, retry_count,
+			published_at, stored_at
+		FROM ingest_messages
+		WHERE id = $1
+	`
+
+	var m db.IngestMessage
+	err = r.pool.QueryRow(ctx, query, id).Scan(
+		&m.ID, &m.RequestID, &m.ClientID, &m.ReceivedAt, &m.Payload, &m.Headers,
+		&m.MessageID, &m.Exchange, &m.RoutingKey, &m.Redelivered, &m.RetryCount,
+		&m.PublishedAt, &m.StoredAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, fmt.Errorf("failed to get ingest message: %w", err)
+	}
+
+	return m, true, nil
+}
+
+// GetMessageForReading gets the message a reading was stored from, by the
+// reading's natural key. Readings stored before ingest_messages existed
+// yield a message rebuilt from their raw_payload, with ID 0 and no delivery
+// metadata. It reports false when the reading or its message is not found.
+func (r *Repository) GetMessageForReading(ctx context.Context, clientID uuid.UUID, metricName string, readingTimestamp time.Time) (_ db.IngestMessage, _ bool, err error) {
+	defer observe("get_message_for_reading", time.Now(), &err)
+
+	query := `
+		SELECT m.id, COALESCE(m.request_id, ''), m.received_at, COALESCE(m.payload, r.raw_payload), m.headers,
+			COALESCE(m.message_id, ''), COALESCE(m.exchange, ''), COALESCE(m.routing_key, ''),
+			COALESCE(m.redelivered, false), COALESCE(m.retry_count, 0), m.published_at, m.stored_at,
+			r.received_at
+		FROM meter_readings_raw r
+		LEFT JOIN ingest_messages m ON m.id = r.ingest_message_id
+		WHERE r.client_id = $1 AND r.metric_name = $2 AND r.reading_timestamp = $3
+	`
+
+	var (
+		id                   *int64
+		receivedAt, storedAt *time.Time
+		readingReceivedAt    time.Time
+	)
+	m := db.IngestMessage{ClientID: clientID}
+	err = r.pool.QueryRow(ctx, query, clientID, metricName, readingTimestamp).Scan(
+		&id, &m.RequestID, &receivedAt, &m.Payload, &m.Headers,
+		&m.MessageID, &m.Exchange, &m.RoutingKey,
+		&m.Redelivered, &m.RetryCount, &m.PublishedAt, &storedAt,
+		&readingReceivedAt,
 	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, fmt.Errorf("failed to get message for reading: %w", err)
+	}
+	if m.Payload == nil {
+		return m, false, nil
+	}
+
+	if id != nil {
+		m.ID = *id
+		m.ReceivedAt = *receivedAt
+		m.StoredAt = *storedAt
+	} else {
+		m.ReceivedAt = readingReceivedAt
+	}
+
+	return m, true, nil
+}
+
+// nullString maps an empty string to NULL
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// ClaimOutboxEvents claims up to limit events that are due for publishing
+// by moving their next attempt lease into the future, in one statement.
+// Rows claimed by another replica are skipped; events whose claimer died
+// become due again once the lease expires.
+func (r *Repository) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) (_ []db.OutboxEvent, err error) {
+	defer observe("claim_outbox_events", time.Now(), &err)
+
+	query := `
+		WITH due AS (
+			SELECT id
+			FROM event_outbox
+			WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= $1
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE event_outbox e
+		SET next_attempt_at = $3
+		FROM due
+		WHERE e.id = due.id
+		RETURNING e.id, e.event_id, e.routing_key, e.payload, e.created_at, e.attempts, e.next_attempt_at, e.last_error, e.sent_at, e.trace_context
+	`
+
+	now := time.Now()
+	rows, err := r.pool.Query(ctx, query, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []db.OutboxEvent
+	for rows.Next() {
+		var event db.OutboxEvent
+		if err := rows.Scan(
+			&event.ID,
+			&event.EventID,
+			&event.RoutingKey,
+			&event.Payload,
+			&event.CreatedAt,
+			&event.Attempts,
+			&event.NextAttemptAt,
+			&event.LastError,
+			&event.SentAt,
+			&event.TraceContext,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	return events, nil
+}
+
+// MarkOutboxEventsSent marks outbox events as published
+func (r *Repository) MarkOutboxEventsSent(ctx context.Context, ids []int64) (err error) {
+	defer observe("mark_outbox_events_sent", time.Now(), &err)
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `
+		UPDATE event_outbox
+		SET sent_at = $1, attempts = attempts + 1, last_error = NULL
+		WHERE id = ANY($2)
+	`
 
+	_, err = r.pool.Exec(ctx, query, time.Now(), ids)
 	if err != nil {
-		return fmt.Errorf("failed to insert meter reading: %w", err)
+		return fmt.Errorf("failed to mark outbox events sent: %w", err)
 	}
 
 	return nil
 }
 
-// GetRecentReadingsForClient gets recent readings for anomaly detection
-func (r *Repository) GetRecentReadingsForClient(ctx context.Context, clientID uuid.UUID, metricName string, limit int) ([]float64, error) {
+// MarkOutboxEventFailed records a failed publish attempt and schedules the
+// next one
+func (r *Repository) MarkOutboxEventFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) (err error) {
+	defer observe("mark_outbox_event_failed", time.Now(), &err)
+
 	query := `
-		SELECT metric_value
-		FROM meter_readings_raw
-		WHERE client_id = $1 AND metric_name = $2 AND validation_status = 'valid'
-		ORDER BY reading_timestamp DESC
-		LIMIT $3
+		UPDATE event_outbox
+		SET attempts = attempts + 1, last_error = $1, next_attempt_at = $2
+		WHERE id = $3
 	`
 
-	rows, err := r.pool.Query(ctx, query, clientID, metricName, limit)
+	_, err = r.pool.Exec(ctx, query, lastError, nextAttemptAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox event failed: %w", err)
+	}
+
+	return nil
+}
+
+// ParkOutboxEvent records the last failed publish attempt of an event and
+// stops retrying it
+func (r *Repository) ParkOutboxEvent(ctx context.Context, id int64, lastError string) (err error) {
+	defer observe("park_outbox_event", time.Now(), &err)
+
+	query := `
+		UPDATE event_outbox
+		SET attempts = attempts + 1, last_error = $1, failed_at = $2
+		WHERE id = $3
+	`
+
+	_, err = r.pool.Exec(ctx, query, lastError, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to park outbox event: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFinishedOutboxEventsTx removes events published or parked before
+// the given time
+func (r *Repository) DeleteFinishedOutboxEventsTx(ctx context.Context, tx pgx.Tx, before time.Time) (_ int64, err error) {
+	defer observe("delete_finished_outbox_events", time.Now(), &err)
+
+	query := `
+		DELETE FROM event_outbox
+		WHERE (sent_at IS NOT NULL AND sent_at < $1)
+			OR (failed_at IS NOT NULL AND failed_at < $1)
+	`
+
+	tag, err := tx.Exec(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete finished outbox events: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// InsertMeterReadingsTx inserts all readings of a message in one round trip.
+// The returned slice reports, per reading, whether it was inserted (false
+// when a reading with the same natural key is already stored).
+func (r *Repository) InsertMeterReadingsTx(ctx context.Context, tx pgx.Tx, readings []*db.MeterReading) (_ []bool, err error) {
+	defer observe("insert_readings", time.Now(), &err)
+
+	if len(readings) == 0 {
+		return nil, nil
+	}
+
+	query := `
+		INSERT INTO meter_readings_raw (
+			client_id, metric_name, metric_value, reading_timestamp,
+			received_at, validation_status, anomaly_reason, ingest_message_id,
+			delta_value, counter_event
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (client_id, metric_name, reading_timestamp) DO NOTHING
+	`
+
+	batch := &pgx.Batch{}
+	for _, reading := range readings {
+		batch.Queue(query,
+			reading.ClientID,
+			reading.MetricName,
+			reading.MetricValue,
+			reading.ReadingTimestamp,
+			reading.ReceivedAt,
+			reading.ValidationStatus,
+			reading.AnomalyReason,
+			reading.IngestMessageID,
+			reading.DeltaValue,
+			reading.CounterEvent,
+		)
+	}
+
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	inserted := make([]bool, len(readings))
+	for i := range readings {
+		tag, err := results.Exec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert meter reading %s: %w", readings[i].MetricName, err)
+		}
+		inserted[i] = tag.RowsAffected() == 1
+	}
+
+	if err := results.Close(); err != nil {
+		return nil, fmt.Errorf("failed to insert meter readings: %w", err)
+	}
+
+	return inserted, nil
+}
+
+// GetRecentReadingsForMetrics gets up to limit recent valid values for each
+// of the given metrics of a client in a single query, newest first
+func (r *Repository) GetRecentReadingsForMetrics(ctx context.Context, clientID uuid.UUID, metricNames []string, limit int) (_ map[string][]db.MetricPoint, err error) {
+	defer observe("recent_readings", time.Now(), &err)
+
+	query := `
+		SELECT m.metric_name, recent.metric_value, recent.reading_timestamp
+		FROM unnest($2::text[]) AS m(metric_name)
+		CROSS JOIN LATERAL (
+			SELECT metric_value, reading_timestamp
+			FROM meter_readings_raw
+			WHERE client_id = $1 AND metric_name = m.metric_name AND validation_status = 'valid'
+			ORDER BY reading_timestamp DESC
+			LIMIT $3
+		) recent
+		ORDER BY m.metric_name, recent.reading_timestamp DESC
+	`
+
+	rows, err := r.pool.Query(ctx, query, clientID, metricNames, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query recent readings: %w", err)
 	}
 	defer rows.Close()
 
-	var values []float64
+	values := make(map[string][]db.MetricPoint, len(metricNames))
 	for rows.Next() {
-		var value float64
-		if err := rows.Scan(&value); err != nil {
+		var name string
+		var point db.MetricPoint
+		if err := rows.Scan(&name, &point.Value, &point.Timestamp); err != nil {
 			return nil, fmt.Errorf("failed to scan value: %w", err)
 		}
-		values = append(values, value)
+		values[name] = append(values[name], point)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -182,67 +585,659 @@ func (r *Repository) GetRecentReadingsForClient(ctx context.Context, clientID uu
 	return values, nil
 }
 
-// GetOrCreateClientTx retrieves or creates a meter client within a transaction
-func (r *Repository) GetOrCreateClientTx(ctx context.Context, tx pgx.Tx, fingerprint string, ipAddress string, userAgent *string) (*db.MeterClient, error) {
-	// Try to get existing client
+// InsertOutboxEventsTx queues several events for publishing within the
+// reading transaction using COPY
+func (r *Repository) InsertOutboxEventsTx(ctx context.Context, tx pgx.Tx, events []db.OutboxEvent) (err error) {
+	defer observe("insert_outbox_events", time.Now(), &err)
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	rows := make([][]any, len(events))
+	for i, event := range events {
+		rows[i] = []any{event.RoutingKey, event.Payload, event.TraceContext, now, now}
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"event_outbox"},
+		[]string{"routing_key", "payload", "trace_context", "created_at", "next_attempt_at"},
+		pgx.CopyFromRows(rows),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert outbox events: %w", err)
+	}
+
+	return nil
+}
+
+// MergeSeasonalStatsTx merges per-bucket statistics of new readings into the
+// stored seasonal statistics within the reading transaction. Each entry of
+// stats describes a batch (count, mean, M2) and is combined with the stored
+// row using Chan et al.'s parallel variance formula, so the table is updated
+// incrementally without rescanning readings. Entries must have distinct
+// (client, metric, bucket) keys.
+func (r *Repository) MergeSeasonalStatsTx(ctx context.Context, tx pgx.Tx, stats []db.SeasonalStat) (err error) {
+	defer observe("merge_seasonal_stats", time.Now(), &err)
+
+	if len(stats) == 0 {
+		return nil
+	}
+
+	clientIDs := make([]uuid.UUID, len(stats))
+	metricNames := make([]string, len(stats))
+	buckets := make([]int16, len(stats))
+	counts := make([]int64, len(stats))
+	means := make([]float64, len(stats))
+	m2s := make([]float64, len(stats))
+	for i, s := range stats {
+		clientIDs[i] = s.ClientID
+		metricNames[i] = s.MetricName
+		buckets[i] = int16(s.Bucket)
+		counts[i] = s.Count
+		means[i] = s.Mean
+		m2s[i] = s.M2
+	}
+
 	query := `
-		SELECT id, client_fingerprint, ip_address::text, user_agent, first_seen_at, last_seen_at, created_at
-		FROM meter_clients
-		WHERE client_fingerprint = $1
+		INSERT INTO metric_seasonal_stats AS s (client_id, metric_name, bucket, sample_count, mean, m2, updated_at)
+		SELECT *, $7::timestamptz
+		FROM unnest($1::uuid[], $2::text[], $3::smallint[], $4::bigint[], $5::float8[], $6::float8[])
+		ON CONFLICT (client_id, metric_name, bucket) DO UPDATE
+		SET sample_count = s.sample_count + EXCLUDED.sample_count,
+			mean = s.mean + (EXCLUDED.mean - s.mean) * EXCLUDED.sample_count / (s.sample_count + EXCLUDED.sample_count),
+			m2 = s.m2 + EXCLUDED.m2
+				+ (EXCLUDED.mean - s.mean) * (EXCLUDED.mean - s.mean)
+				* s.sample_count * EXCLUDED.sample_count / (s.sample_count + EXCLUDED.sample_count),
+			updated_at = EXCLUDED.updated_at
 	`
 
-	var client db.MeterClient
-	err := tx.QueryRow(ctx, query, fingerprint).Scan(
-		&client.ID,
-		&client.ClientFingerprint,
-		&client.IPAddress,
-		&client.UserAgent,
-		&client.FirstSeenAt,
-		&client.LastSeenAt,
-		&client.CreatedAt,
+	_, err = tx.Exec(ctx, query, clientIDs, metricNames, buckets, counts, means, m2s, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to merge seasonal stats: %w", err)
+	}
+
+	return nil
+}
+
+// GetSeasonalStat gets the seasonal statistics of a client metric for one
+// hour-of-week bucket. It reports false when no reading was recorded in
+// that bucket yet.
+func (r *Repository) GetSeasonalStat(ctx context.Context, clientID uuid.UUID, metricName string, bucket int) (_ db.SeasonalStat, _ bool, err error) {
+	defer observe("get_seasonal_stat", time.Now(), &err)
+
+	query := `
+		SELECT sample_count, mean, m2
+		FROM metric_seasonal_stats
+		WHERE client_id = $1 AND metric_name = $2 AND bucket = $3
+	`
+
+	stat := db.SeasonalStat{ClientID: clientID, MetricName: metricName, Bucket: bucket}
+	err = r.pool.QueryRow(ctx, query, clientID, metricName, int16(bucket)).Scan(&stat.Count, &stat.Mean, &stat.M2)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return stat, false, nil
+	}
+	if err != nil {
+		return stat, false, fmt.Errorf("failed to get seasonal stat: %w", err)
+	}
+
+	return stat, true, nil
+}
+
+// MarkMetricStuckTx records that a client metric started repeating value
+// at since. It reports false when the metric is already marked stuck, so
+// that an episode is only reported once.
+func (r *Repository) MarkMetricStuckTx(ctx context.Context, tx pgx.Tx, clientID uuid.UUID, metricName string, value float64, since time.Time) (_ bool, err error) {
+	defer observe("mark_metric_stuck", time.Now(), &err)
+
+	query := `
+		INSERT INTO metric_stuck_state (client_id, metric_name, stuck_value, stuck_since, detected_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (client_id, metric_name) DO NOTHING
+	`
+
+	tag, err := tx.Exec(ctx, query, clientID, metricName, value, since, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("failed to mark metric stuck: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// ClearStuckMetricsTx ends the stuck episodes of the given client metrics
+func (r *Repository) ClearStuckMetricsTx(ctx context.Context, tx pgx.Tx, clientID uuid.UUID, metricNames []string) (err error) {
+	defer observe("clear_stuck_metrics", time.Now(), &err)
+
+	if len(metricNames) == 0 {
+		return nil
+	}
+
+	query := `
+		DELETE FROM metric_stuck_state
+		WHERE client_id = $1 AND metric_name = ANY($2)
+	`
+
+	if _, err = tx.Exec(ctx, query, clientID, metricNames); err != nil {
+		return fmt.Errorf("failed to clear stuck metrics: %w", err)
+	}
+
+	return nil
+}
+
+// TouchMetricStatusTx records, within the reading transaction, that the
+// client metrics in sightings reported data. Timestamps only move forward,
+// so out-of-order messages never rewind a metric's status. The expected
+// reporting interval follows the time between received messages as an
+// exponential moving average; the silence of an offline metric is not
+// learned.
+func (r *Repository) TouchMetricStatusTx(ctx context.Context, tx pgx.Tx, clientID uuid.UUID, sightings []db.MetricSighting) (err error) {
+	defer observe("touch_metric_status", time.Now(), &err)
+
+	if len(sightings) == 0 {
+		return nil
+	}
+
+	metricNames := make([]string, len(sightings))
+	readingAts := make([]time.Time, len(sightings))
+	receivedAts := make([]time.Time, len(sightings))
+	for i, s := range sightings {
+		metricNames[i] = s.MetricName
+		readingAts[i] = s.ReadingAt
+		receivedAts[i] = s.ReceivedAt
+	}
+
+	query := `
+		INSERT INTO meter_metric_status AS s (client_id, metric_name, last_reading_at, last_received_at)
+		SELECT $1, *
+		FROM unnest($2::text[], $3::timestamptz[], $4::timestamptz[])
+		ON CONFLICT (client_id, metric_name) DO UPDATE
+		SET last_reading_at = GREATEST(s.last_reading_at, EXCLUDED.last_reading_at),
+			last_received_at = GREATEST(s.last_received_at, EXCLUDED.last_received_at),
+			expected_interval = CASE
+				WHEN s.offline_since IS NOT NULL OR EXCLUDED.last_received_at <= s.last_received_at
+					THEN s.expected_interval
+				ELSE COALESCE(
+					s.expected_interval * 0.8 + (EXCLUDED.last_received_at - s.last_received_at) * 0.2,
+					EXCLUDED.last_received_at - s.last_received_at)
+			END
+	`
+
+	_, err = tx.Exec(ctx, query, clientID, metricNames, readingAts, receivedAts)
+	if err != nil {
+		return fmt.Errorf("failed to update metric status: %w", err)
+	}
+
+	return nil
+}
+
+// TryAdvisoryLockTx takes the transaction-scoped advisory lock called name
+// without waiting. It reports false when another session holds it; the
+// lock is released when the transaction ends.
+func (r *Repository) TryAdvisoryLockTx(ctx context.Context, tx pgx.Tx, name string) (_ bool, err error) {
+	defer observe("try_advisory_lock", time.Now(), &err)
+
+	var locked bool
+	err = tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock(hashtext($1))`, name).Scan(&locked)
+	if err != nil {
+		return false, fmt.Errorf("failed to take advisory lock %s: %w", name, err)
+	}
+
+	return locked, nil
+}
+
+// OfflineThresholds bound how long a client metric may stay silent before
+// it is marked offline
+type OfflineThresholds struct {
+	After           time.Duration // until the reporting interval is learned
+	MissedIntervals int           // learned intervals without data
+	MinAfter        time.Duration // lower bound for learned intervals
+}
+
+// MarkMetricsOfflineTx marks up to limit reporting client metrics that went
+// silent for longer than their threshold as offline and opens a reading gap
+// for each, starting at its last reading. It returns the opened gaps.
+//
+// Silence is measured against the ingest watermark, the newest receive
+// time among reporting metrics, rather than the clock: after an outage or
+// while a backlog drains the watermark lags with the data, so metrics are
+// not marked offline for messages still queued.
+func (r *Repository) MarkMetricsOfflineTx(ctx context.Context, tx pgx.Tx, thresholds OfflineThresholds, limit int) (_ []db.ReadingGap, err error) {
+	defer observe("mark_metrics_offline", time.Now(), &err)
+
+	query := `
+		WITH watermark AS (
+			SELECT LEAST(max(last_received_at), $5) AS at
+			FROM meter_metric_status
+			WHERE offline_since IS NULL
+		), silent AS (
+			SELECT s.client_id, s.metric_name
+			FROM meter_metric_status s, watermark w
+			WHERE s.offline_since IS NULL
+				AND s.last_received_at < w.at - CASE
+					WHEN s.expected_interval IS NULL THEN $1::float8 * interval '1 second'
+					ELSE GREATEST(s.expected_interval * $2::float8, $3::float8 * interval '1 second')
+				END
+			ORDER BY s.last_received_at
+			LIMIT $4
+			FOR UPDATE OF s SKIP LOCKED
+		), marked AS (
+			UPDATE meter_metric_status s
+			SET offline_since = s.last_reading_at
+			FROM silent
+			WHERE s.client_id = silent.client_id AND s.metric_name = silent.metric_name
+			RETURNING s.client_id, s.metric_name, s.offline_since
+		)
+		INSERT INTO reading_gaps (client_id, metric_name, gap_start, detected_at)
+		SELECT client_id, metric_name, offline_since, $5 FROM marked
+		ON CONFLICT (client_id, metric_name) WHERE gap_end IS NULL DO NOTHING
+		RETURNING id, client_id, metric_name, gap_start, gap_end, detected_at, resolved_at
+	`
+
+	rows, err := tx.Query(ctx, query,
+		thresholds.After.Seconds(),
+		thresholds.MissedIntervals,
+		thresholds.MinAfter.Seconds(),
+		limit,
+		time.Now(),
 	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark metrics offline: %w", err)
+	}
 
-	if err == nil {
-		// Client exists, update last_seen_at
-		updateQuery := `
-			UPDATE meter_clients
-			SET last_seen_at = $1
-			WHERE id = $2
-		`
-		now := time.Now()
-		_, err = tx.Exec(ctx, updateQuery, now, client.ID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to update client last_seen_at: %w", err)
+	gaps, err := scanReadingGaps(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark metrics offline: %w", err)
+	}
+
+	return gaps, nil
+}
+
+// MarkMetricsOnlineTx clears the offline mark of up to limit client metrics
+// that reported a reading newer than their gap start, and closes their
+// gaps at the first reading after it. It returns the closed gaps.
+func (r *Repository) MarkMetricsOnlineTx(ctx context.Context, tx pgx.Tx, limit int) (_ []db.ReadingGap, err error) {
+	defer observe("mark_metrics_online", time.Now(), &err)
+
+	query := `
+		WITH resumed AS (
+			SELECT client_id, metric_name
+			FROM meter_metric_status
+			WHERE offline_since IS NOT NULL AND last_reading_at > offline_since
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), cleared AS (
+			UPDATE meter_metric_status s
+			SET offline_since = NULL
+			FROM resumed
+			WHERE s.client_id = resumed.client_id AND s.metric_name = resumed.metric_name
+			RETURNING s.client_id, s.metric_name
+		)
+		UPDATE reading_gaps g
+		SET gap_end = COALESCE((
+				SELECT min(m.reading_timestamp)
+				FROM meter_readings_raw m
+				WHERE m.client_id = g.client_id AND m.metric_name = g.metric_name
+					AND m.reading_timestamp > g.gap_start
+			), $2),
+			resolved_at = $2
+		FROM cleared
+		WHERE g.client_id = cleared.client_id AND g.metric_name = cleared.metric_name AND g.gap_end IS NULL
+		RETURNING g.id, g.client_id, g.metric_name, g.gap_start, g.gap_end, g.detected_at, g.resolved_at
+	`
+
+	rows, err := tx.Query(ctx, query, limit, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark metrics online: %w", err)
+	}
+
+	gaps, err := scanReadingGaps(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark metrics online: %w", err)
+	}
+
+	return gaps, nil
+}
+
+func scanReadingGaps(rows pgx.Rows) ([]db.ReadingGap, error) {
+	defer rows.Close()
+
+	var gaps []db.ReadingGap
+	for rows.Next() {
+		var g db.ReadingGap
+		if err := rows.Scan(&g.ID, &g.ClientID, &g.MetricName, &g.GapStart, &g.GapEnd, &g.DetectedAt, &g.ResolvedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan reading gap: %w", err)
 		}
-		client.LastSeenAt = now
-		return &client, nil
+		gaps = append(gaps, g)
 	}
 
-	if err != pgx.ErrNoRows {
-		return nil, fmt.Errorf("failed to query client: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
 	}
 
-	// Client doesn't exist, create new one
-	insertQuery := `
-		INSERT INTO meter_clients (client_fingerprint, ip_address, user_agent, first_seen_at, last_seen_at, created_at)
-		VALUES ($1, $2, $3, $4, $4, $4)
-		RETURNING id, client_fingerprint, ip_address::text, user_agent, first_seen_at, last_seen_at, created_at
-	`
+	return gaps, nil
+}
+
+// InsertRejectedReadingsTx records readings that failed to insert within the
+// transaction storing the rest of their message
+func (r *Repository) InsertRejectedReadingsTx(ctx context.Context, tx pgx.Tx, rejected []db.RejectedReading) (err error) {
+	defer observe("insert_rejected_readings", time.Now(), &err)
+
+	if len(rejected) == 0 {
+		return nil
+	}
 
 	now := time.Now()
-	err = tx.QueryRow(ctx, insertQuery, fingerprint, ipAddress, userAgent, now).Scan(
-		&client.ID,
-		&client.ClientFingerprint,
-		&client.IPAddress,
-		&client.UserAgent,
-		&client.FirstSeenAt,
-		&client.LastSeenAt,
-		&client.CreatedAt,
+	rows := make([][]any, len(rejected))
+	for i, rr := range rejected {
+		rows[i] = []any{nullString(rr.RequestID), rr.ClientID, rr.MetricName, rr.Entry, rr.Error, now}
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"rejected_readings"},
+		[]string{"request_id", "client_id", "metric_name", "pm_entry", "error", "rejected_at"},
+		pgx.CopyFromRows(rows),
 	)
+	if err != nil {
+		return fmt.Errorf("failed to insert rejected readings: %w", err)
+	}
+
+	return nil
+}
+
+// IsReadingsPartitionedTx reports whether meter_readings_raw is a natively
+// partitioned table, i.e. the database runs without TimescaleDB
+func (r *Repository) IsReadingsPartitionedTx(ctx context.Context, tx pgx.Tx) (_ bool, err error) {
+	defer observe("is_readings_partitioned", time.Now(), &err)
 
+	var partitioned bool
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE((SELECT relkind = 'p' FROM pg_class WHERE oid = to_regclass('meter_readings_raw')), false)
+	`).Scan(&partitioned)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client: %w", err)
+		return false, fmt.Errorf("failed to check readings partitioning: %w", err)
 	}
 
-	return &client, nil
+	return partitioned, nil
+}
+
+// IsReadingsHypertableTx reports whether meter_readings_raw is a TimescaleDB
+// hypertable
+func (r *Repository) IsReadingsHypertableTx(ctx context.Context, tx pgx.Tx) (_ bool, err error) {
+	defer observe("is_readings_hypertable", time.Now(), &err)
+
+	var installed bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&installed)
+	if err != nil {
+		return false, fmt.Errorf("failed to check timescaledb: %w", err)
+	}
+	if !installed {
+		return false, nil
+	}
+
+	var hypertable bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM timescaledb_information.hypertables
+			WHERE hypertable_schema = current_schema() AND hypertable_name = 'meter_readings_raw'
+		)
+	`).Scan(&hypertable)
+	if err != nil {
+		return false, fmt.Errorf("failed to check readings hypertable: %w", err)
+	}
+
+	return hypertable, nil
+}
+
+// SetReadingsRetentionPolicyTx makes the TimescaleDB retention policy of
+// meter_readings_raw drop chunks older than days, replacing a policy with
+// another interval, or removes the policy when days is 0. It reports
+// whether the policy changed.
+func (r *Repository) SetReadingsRetentionPolicyTx(ctx context.Context, tx pgx.Tx, days int) (_ bool, err error) {
+	defer observe("set_readings_retention_policy", time.Now(), &err)
+
+	var exists, current bool
+	err = tx.QueryRow(ctx, `
+		SELECT count(*) > 0, COALESCE(bool_and((config->>'drop_after')::interval = make_interval(days => $1)), false)
+		FROM timescaledb_information.jobs
+		WHERE proc_name = 'policy_retention'
+			AND hypertable_schema = current_schema() AND hypertable_name = 'meter_readings_raw'
+	`, days).Scan(&exists, &current)
+	if err != nil {
+		return false, fmt.Errorf("failed to query readings retention policy: %w", err)
+	}
+	if (days == 0 && !exists) || (days > 0 && current) {
+		return false, nil
+	}
+
+	if exists {
+		if _, err := tx.Exec(ctx, `SELECT remove_retention_policy('meter_readings_raw', if_exists => TRUE)`); err != nil {
+			return false, fmt.Errorf("failed to remove readings retention policy: %w", err)
+		}
+	}
+	if days > 0 {
+		if _, err := tx.Exec(ctx, `SELECT add_retention_policy('meter_readings_raw', make_interval(days => $1))`, days); err != nil {
+			return false, fmt.Errorf("failed to add readings retention policy: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// SetLockTimeoutTx bounds how long statements of the transaction wait for
+// locks, so that DDL fails instead of queueing other writers behind it
+func (r *Repository) SetLockTimeoutTx(ctx context.Context, tx pgx.Tx, timeout time.Duration) (err error) {
+	defer observe("set_lock_timeout", time.Now(), &err)
+
+	_, err = tx.Exec(ctx, `SELECT set_config('lock_timeout', $1, true)`, fmt.Sprintf("%dms", timeout.Milliseconds()))
+	if err != nil {
+		return fmt.Errorf("failed to set lock timeout: %w", err)
+	}
+
+	return nil
+}
+
+// CreateReadingPartitionsTx creates the missing daily partitions of
+// meter_readings_raw for the UTC days from through to, and returns how many
+// it created
+func (r *Repository) CreateReadingPartitionsTx(ctx context.Context, tx pgx.Tx, from, to time.Time) (_ int, err error) {
+	defer observe("create_reading_partitions", time.Now(), &err)
+
+	var created int
+	err = tx.QueryRow(ctx, `SELECT create_reading_partitions($1::date, $2::date)`, utcDay(from), utcDay(to)).Scan(&created)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create reading partitions: %w", err)
+	}
+
+	return created, nil
+}
+
+// DropReadingPartitionsTx drops the daily partitions of meter_readings_raw
+// for UTC days before before, and returns how many it dropped
+func (r *Repository) DropReadingPartitionsTx(ctx context.Context, tx pgx.Tx, before time.Time) (_ int, err error) {
+	defer observe("drop_reading_partitions", time.Now(), &err)
+
+	var dropped int
+	err = tx.QueryRow(ctx, `SELECT drop_reading_partitions($1::date)`, utcDay(before)).Scan(&dropped)
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop reading partitions: %w", err)
+	}
+
+	return dropped, nil
+}
+
+// utcDay returns the start of the UTC day of t
+func utcDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Rollup is a granularity of the reading rollups: a TimescaleDB continuous
+// aggregate, or a table refreshed by the worker on plain PostgreSQL
+type Rollup struct {
+	Name   string
+	Table  string
+	Bucket time.Duration
+}
+
+// Reading rollup granularities
+var (
+	Rollup15Min  = Rollup{Name: "15m", Table: "meter_readings_15m", Bucket: 15 * time.Minute}
+	RollupHourly = Rollup{Name: "1h", Table: "meter_readings_1h", Bucket: time.Hour}
+	RollupDaily  = Rollup{Name: "1d", Table: "meter_readings_1d", Bucket: 24 * time.Hour}
+
+	Rollups = []Rollup{Rollup15Min, RollupHourly, RollupDaily}
+)
+
+// GetReadings15Min gets the 15-minute rollups of a client in [from, to)
+func (r *Repository) GetReadings15Min(ctx context.Context, clientID uuid.UUID, metricNames []string, from, to time.Time) ([]db.ReadingRollup, error) {
+	return r.GetRollups(ctx, Rollup15Min, clientID, metricNames, from, to)
+}
+
+// GetReadingsHourly gets the hourly rollups of a client in [from, to)
+func (r *Repository) GetReadingsHourly(ctx context.Context, clientID uuid.UUID, metricNames []string, from, to time.Time) ([]db.ReadingRollup, error) {
+	return r.GetRollups(ctx, RollupHourly, clientID, metricNames, from, to)
+}
+
+// GetReadingsDaily gets the daily (UTC) rollups of a client in [from, to)
+func (r *Repository) GetReadingsDaily(ctx context.Context, clientID uuid.UUID, metricNames []string, from, to time.Time) ([]db.ReadingRollup, error) {
+	return r.GetRollups(ctx, RollupDaily, clientID, metricNames, from, to)
+}
+
+// GetRollups gets the rollups of a client whose bucket starts in [from, to),
+// ordered by metric and bucket. An empty metricNames selects all metrics.
+func (r *Repository) GetRollups(ctx context.Context, rollup Rollup, clientID uuid.UUID, metricNames []string, from, to time.Time) (_ []db.ReadingRollup, err error) {
+	defer observe("rollups_"+rollup.Name, time.Now(), &err)
+
+	query := fmt.Sprintf(`
+		SELECT metric_name, bucket, min_value, max_value, avg_value, last_value, sample_count, delta_sum
+		FROM %s
+		WHERE client_id = $1
+		  AND (cardinality($2::text[]) = 0 OR metric_name = ANY($2))
+		  AND bucket >= $3 AND bucket < $4
+		ORDER BY metric_name, bucket
+	`, pgx.Identifier{rollup.Table}.Sanitize())
+
+	if metricNames == nil {
+		metricNames = []string{}
+	}
+	rows, err := r.pool.Query(ctx, query, clientID, metricNames, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s rollups: %w", rollup.Name, err)
+	}
+	defer rows.Close()
+
+	var rollups []db.ReadingRollup
+	for rows.Next() {
+		ru := db.ReadingRollup{ClientID: clientID}
+		if err := rows.Scan(&ru.MetricName, &ru.Bucket, &ru.Min, &ru.Max, &ru.Avg, &ru.Last, &ru.SampleCount, &ru.DeltaSum); err != nil {
+			return nil, fmt.Errorf("failed to scan rollup: %w", err)
+		}
+		rollups = append(rollups, ru)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return rollups, nil
+}
+
+// RollupsMaintainedTx reports whether the rollups are plain tables the
+// worker has to refresh, rather than continuous aggregates
+func (r *Repository) RollupsMaintainedTx(ctx context.Context, tx pgx.Tx) (_ bool, err error) {
+	defer observe("rollups_maintained", time.Now(), &err)
+
+	var maintained bool
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE((SELECT relkind = 'r' FROM pg_class WHERE oid = to_regclass($1)), false)
+	`, Rollup15Min.Table).Scan(&maintained)
+	if err != nil {
+		return false, fmt.Errorf("failed to check rollup tables: %w", err)
+	}
+
+	return maintained, nil
+}
+
+// RefreshRollupTx recomputes the buckets of rollup overlapping [from, to)
+// from the raw readings, for backfills, and returns how many it wrote
+func (r *Repository) RefreshRollupTx(ctx context.Context, tx pgx.Tx, rollup Rollup, from, to time.Time) (_ int64, err error) {
+	defer observe("refresh_rollup_"+rollup.Name, time.Now(), &err)
+
+	var refreshed int64
+	err = tx.QueryRow(ctx, `SELECT refresh_reading_rollup($1::regclass, $2::interval, $3, $4)`,
+		rollup.Table, fmt.Sprintf("%d seconds", int64(rollup.Bucket.Seconds())), from, to,
+	).Scan(&refreshed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to refresh %s rollup: %w", rollup.Name, err)
+	}
+
+	return refreshed, nil
+}
+
+// TakeRollupInvalidationsTx deletes up to limit logged rollup invalidations,
+// most recent buckets first, and returns them
+func (r *Repository) TakeRollupInvalidationsTx(ctx context.Context, tx pgx.Tx, limit int) (_ []db.RollupInvalidation, err error) {
+	defer observe("take_rollup_invalidations", time.Now(), &err)
+
+	query := `
+		WITH taken AS (
+			DELETE FROM reading_rollup_invalidations
+			WHERE (client_id, bucket) IN (
+				SELECT client_id, bucket FROM reading_rollup_invalidations
+				ORDER BY bucket DESC
+				LIMIT $1
+			)
+			RETURNING client_id, bucket
+		)
+		SELECT client_id, bucket FROM taken
+	`
+
+	rows, err := tx.Query(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take rollup invalidations: %w", err)
+	}
+	defer rows.Close()
+
+	var invalidations []db.RollupInvalidation
+	for rows.Next() {
+		var inv db.RollupInvalidation
+		if err := rows.Scan(&inv.ClientID, &inv.Bucket); err != nil {
+			return nil, fmt.Errorf("failed to scan rollup invalidation: %w", err)
+		}
+		invalidations = append(invalidations, inv)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return invalidations, nil
+}
+
+// RefreshRollupBucketsTx recomputes the buckets of rollup holding the
+// invalidated 15-minute buckets and returns how many it wrote. Buckets left
+// without valid readings are deleted.
+func (r *Repository) RefreshRollupBucketsTx(ctx context.Context, tx pgx.Tx, rollup Rollup, invalidations []db.RollupInvalidation) (_ int64, err error) {
+	defer observe("refresh_rollup_buckets_"+rollup.Name, time.Now(), &err)
+
+	if len(invalidations) == 0 {
+		return 0, nil
+	}
+
+	clients := make([]uuid.UUID, len(invalidations))
+	buckets := make([]time.Time, len(invalidations))
+	for i, inv := range invalidations {
+		clients[i] = inv.ClientID
+		buckets[i] = inv.Bucket
+	}
+
+	var refreshed int64
+	err = tx.QueryRow(ctx, `SELECT refresh_reading_rollup_buckets($1::regclass, $2::interval, $3::uuid[], $4::timestamptz[])`,
+		rollup.Table, fmt.Sprintf("%d seconds", int64(rollup.Bucket.Seconds())), clients, buckets,
+	).Scan(&refreshed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to refresh %s rollup buckets: %w", rollup.Name, err)
+	}
+
+	return refreshed, nil
 }
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/cache"
+	"github.com/septivank/energy-metering-worker/internal/db"
+)
+
+// BaselineSource loads recent valid readings, newest first
+type BaselineSource interface {
+	GetRecentReadingsForMetrics(ctx context.Context, clientID uuid.UUID, metricNames []string, limit int) (map[string][]db.MetricPoint, error)
+}
+
+// BaselineCache keeps the most recent valid readings of each client metric
+// in memory so that anomaly detection normally needs no database reads.
+// Windows are loaded from the database on miss, extended after every
+// committed reading and dropped after a TTL so that readings stored by other
+// replicas are eventually picked up. Memory is bounded by maxEntries windows
+// of window points each.
+type BaselineCache struct {
+	source BaselineSource
+	window int
+
+	mu      sync.Mutex
+	entries *cache.LRU[baselineKey, *ring]
+}
+
+type baselineKey struct {
+	clientID   uuid.UUID
+	metricName string
+}
+
+// NewBaselineCache creates a baseline cache
+func NewBaselineCache(source BaselineSource, window, maxEntries int, ttl time.Duration) *BaselineCache {
+	if window < 1 {
+		window = 1
+	}
+	return &BaselineCache{
+		source:  source,
+		window:  window,
+		entries: cache.NewLRU[baselineKey, *ring](maxEntries, ttl),
+	}
+}
+
+// Recent returns the recent valid readings of each metric, newest first.
+// Metrics missing from the cache are loaded with a single query.
+func (c *BaselineCache) Recent(ctx context.Context, clientID uuid.UUID, metricNames []string) (map[string][]db.MetricPoint, error) {
+	result := make(map[string][]db.MetricPoint, len(metricNames))
+	var missing []string
+
+	c.mu.Lock()
+	for _, name := range metricNames {
+		if r, ok := c.entries.Get(baselineKey{clientID, name}); ok {
+			result[name] = r.newestFirst()
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	loaded, err := c.source.GetRecentReadingsForMetrics(ctx, clientID, missing, c.window)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range missing {
+		points := loaded[name]
+		r := newRing(c.window)
+		for i := len(points) - 1; i >= 0; i-- {
+			r.push(points[i])
+		}
+		c.entries.Set(baselineKey{clientID, name}, r)
+		result[name] = points
+	}
+
+	return result, nil
+}
+
+// Add extends the cached window of a metric with a committed valid reading.
+// Metrics that are not cached are left alone so that a partial window is
+// never mistaken for the full history. A reading older than the newest
+// cached one drops the window; it is reloaded in order on next use.
+func (c *BaselineCache) Add(clientID uuid.UUID, metricName string, point db.MetricPoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := baselineKey{clientID, metricName}
+	r, ok := c.entries.Get(key)
+	if !ok {
+		return
+	}
+
+	if newest, ok := r.newest(); ok && point.Timestamp.Before(newest.Timestamp) {
+		c.entries.Delete(key)
+		return
+	}
+
+	r.push(point)
+}
+
+// ring is a fixed-size circular buffer of points in arrival order
+type ring struct {
+	points []db.MetricPoint
+	head   int // index of the next write
+	size   int
+}
+
+func newRing(capacity int) *ring {
+	return &ring{points: make([]db.MetricPoint, capacity)}
+}
+
+func (r *ring) push(p db.MetricPoint) {
+	r.points[r.head] = p
+	r.head = (r.head + 1) % len(r.points)
+	if r.size < len(r.points) {
+		r.size++
+	}
+}
+
+func (r *ring) newest() (db.MetricPoint, bool) {
+	if r.size == 0 {
+		return db.MetricPoint{}, false
+	}
+	return r.points[(r.head-1+len(r.points))%len(r.points)], true
+}
+
+func (r *ring) newestFirst() []db.MetricPoint {
+	out := make([]db.MetricPoint, r.size)
+	for i := 0; i < r.size; i++ {
+		out[i] = r.points[(r.head-1-i+2*len(r.points))%len(r.points)]
+	}
+	return out
+}
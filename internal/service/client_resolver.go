@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/cache"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"go.uber.org/zap"
+)
+
+// ClientStore is the client storage behind the resolver
+type ClientStore interface {
+	UpsertClient(ctx context.Context, fingerprint string, ipAddress string, userAgent *string) (*db.MeterClient, error)
+	TouchClients(ctx context.Context, sightings []db.ClientSighting) error
+}
+
+// ClientResolver maps client fingerprints to client IDs. Known fingerprints
+// are served from a process-local cache and their last_seen_at updates are
+// coalesced and flushed periodically; new fingerprints and changed network
+// identities go straight to the database.
+type ClientResolver struct {
+	repo   ClientStore
+	cfg    config.ClientConfig
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	clients *cache.LRU[string, cachedClient]
+	pending map[clientIdentity]time.Time // latest sighting per identity
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type cachedClient struct {
+	id        uuid.UUID
+	ipAddress string
+	userAgent string
+}
+
+type clientIdentity struct {
+	clientID  uuid.UUID
+	ipAddress string
+	userAgent string
+}
+
+// NewClientResolver creates a new client resolver
+func NewClientResolver(repo ClientStore, cfg config.ClientConfig, logger *zap.Logger) *ClientResolver {
+	return &ClientResolver{
+		repo:    repo,
+		cfg:     cfg,
+		logger:  logger,
+		clients: cache.NewLRU[string, cachedClient](cfg.CacheMaxEntries, cfg.CacheTTL),
+		pending: make(map[clientIdentity]time.Time),
+	}
+}
+
+// Resolve returns the ID of the client with fingerprint, creating the
+// client if needed and recording the IP address and user agent it was seen
+// with
+func (r *ClientResolver) Resolve(ctx context.Context, fingerprint string, ipAddress string, userAgent *string) (uuid.UUID, error) {
+	ua := ""
+	if userAgent != nil {
+		ua = *userAgent
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	cached, ok := r.clients.Get(fingerprint)
+	if ok && cached.ipAddress == ipAddress && cached.userAgent == ua {
+		key := clientIdentity{cached.id, ipAddress, ua}
+		if now.After(r.pending[key]) {
+			r.pending[key] = now
+		}
+		r.mu.Unlock()
+		return cached.id, nil
+	}
+	r.mu.Unlock()
+
+	// Unknown client or a new network identity
+	client, err := r.repo.UpsertClient(ctx, fingerprint, ipAddress, userAgent)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if ok {
+		r.logger.Info("client network identity changed",
+			zap.String("client_id", client.ID.String()),
+			zap.String("previous_ip_address", cached.ipAddress),
+			zap.String("ip_address", ipAddress),
+			zap.String("previous_user_agent", cached.userAgent),
+			zap.String("user_agent", ua),
+		)
+	}
+
+	r.mu.Lock()
+	r.clients.Set(fingerprint, cachedClient{id: client.ID, ipAddress: ipAddress, userAgent: ua})
+	r.mu.Unlock()
+
+	return client.ID, nil
+}
+
+// Start starts flushing coalesced last_seen_at updates in the background
+func (r *ClientResolver) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.cfg.LastSeenFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.flush(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops the background flusher and writes the remaining updates
+func (r *ClientResolver) Stop(ctx context.Context) error {
+	if r.cancel != nil {
+		r.cancel()
+		r.wg.Wait()
+	}
+	return r.flush(ctx)
+}
+
+// flush writes the pending sightings. On failure they are merged back so
+// the next flush retries them.
+func (r *ClientResolver) flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[clientIdentity]time.Time)
+	r.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sightings := make([]db.ClientSighting, 0, len(pending))
+	for key, seenAt := range pending {
+		sightings = append(sightings, db.ClientSighting{
+			ClientID:  key.clientID,
+			IPAddress: key.ipAddress,
+			UserAgent: key.userAgent,
+			SeenAt:    seenAt,
+		})
+	}
+
+	if err := r.repo.TouchClients(ctx, sightings); err != nil {
+		r.logger.Warn("failed to flush client last_seen_at", zap.Error(err), zap.Int("clients", len(sightings)))
+
+		r.mu.Lock()
+		for key, seenAt := range pending {
+			if seenAt.After(r.pending[key]) {
+				r.pending[key] = seenAt
+			}
+		}
+		r.mu.Unlock()
+		return err
+	}
+
+	r.logger.Debug("flushed client last_seen_at", zap.Int("clients", len(sightings)))
+	return nil
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"go.uber.org/zap"
+)
+
+// checkCounters validates the valid readings of counter metrics against the
+// previous value of their register and records the consumption delta.
+// Readings are checked in timestamp order so that several readings of one
+// counter in a message chain onto each other; the first one is compared
+// with the newest earlier point of history.
+func (s *ProcessorService) checkCounters(readings []*db.MeterReading, history map[string][]db.MetricPoint, logger *zap.Logger) {
+	chainReadings(readings, history,
+		func(reading *db.MeterReading) bool { return s.validator.IsCounter(reading.MetricName) },
+		func(reading *db.MeterReading, previous *db.MetricPoint) {
+			var prev *float64
+			if previous != nil {
+				prev = &previous.Value
+			}
+
+			result := s.validator.ValidateCounter(reading.MetricValue, prev)
+			if !result.IsValid {
+				reading.ValidationStatus = "invalid"
+				reading.AnomalyReason = &result.AnomalyReason
+				return
+			}
+
+			reading.DeltaValue = result.Delta
+			if result.Event != "" {
+				event := result.Event
+				reading.CounterEvent = &event
+				logger.Info("counter "+event,
+					zap.String("metric_name", reading.MetricName),
+					zap.Float64("value", reading.MetricValue),
+					zap.Float64p("previous", prev),
+				)
+			}
+		},
+	)
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+)
+
+// classifyError marks failures that cannot succeed on redelivery as
+// permanent. Connection problems, timeouts, serialization failures and the
+// like are left as-is so the consumer schedules a retry.
+func classifyError(err error) error {
+	if err == nil || mq.IsPermanent(err) {
+		return err
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && len(pgErr.Code) >= 2 {
+		switch pgErr.Code[:2] {
+		case "22", // data exception
+			"23", // integrity constraint violation
+			"42": // syntax error or access rule violation
+			return mq.Permanent(err)
+		}
+	}
+
+	return err
+}
+
+// isReadingError reports whether err is a failure of one reading's data
+// (data exception or constraint violation). Other errors, such as a
+// missing table or permission, would fail every reading alike.
+func isReadingError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || len(pgErr.Code) < 2 {
+		return false
+	}
+	switch pgErr.Code[:2] {
+	case "22", "23":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/tracing"
+)
+
+// insertIsolated inserts each reading under its own savepoint, so that a
+// reading with bad data or violating a constraint is rolled back alone. It
+// returns which readings were inserted and those failures by index; any
+// other failure aborts the whole message.
+func (s *ProcessorService) insertIsolated(ctx context.Context, tx repository.Tx, readings []*db.MeterReading) ([]bool, map[int]error, error) {
+	inserted := make([]bool, len(readings))
+	failures := make(map[int]error)
+
+	for i, reading := range readings {
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+
+		ok, err := s.repo.InsertMeterReadingTx(ctx, sp, reading)
+		if err != nil {
+			if rbErr := sp.Rollback(ctx); rbErr != nil {
+				return nil, nil, fmt.Errorf("failed to roll back savepoint: %w", rbErr)
+			}
+			if !isReadingError(err) {
+				return nil, nil, err
+			}
+			failures[i] = err
+			continue
+		}
+
+		if err := sp.Commit(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+		inserted[i] = ok
+	}
+
+	return inserted, failures, nil
+}
+
+// recordRejections stores the readings that failed to insert, with their
+// original PM entry, and returns the partial-success event of the message
+func (s *ProcessorService) recordRejections(
+	ctx context.Context,
+	tx repository.Tx,
+	msg IngestMessage,
+	clientID uuid.UUID,
+	readings []*db.MeterReading,
+	inserted []bool,
+	failures map[int]error,
+) (db.OutboxEvent, error) {
+	rejected := make([]db.RejectedReading, 0, len(failures))
+	event := mq.PartialSuccessEvent{
+		RequestID:        msg.RequestID,
+		ClientID:         clientID.String(),
+		ReadingsTotal:    len(readings),
+		ReadingsRejected: len(failures),
+	}
+	for i, ok := range inserted {
+		if ok {
+			event.ReadingsStored++
+		} else if _, failed := failures[i]; !failed {
+			event.ReadingsDuplicate++
+		}
+	}
+
+	for i := range readings {
+		err, failed := failures[i]
+		if !failed {
+			continue
+		}
+
+		entry, mErr := json.Marshal(msg.Payload.PM[i])
+		if mErr != nil {
+			return db.OutboxEvent{}, fmt.Errorf("failed to marshal rejected entry: %w", mErr)
+		}
+		rejected = append(rejected, db.RejectedReading{
+			RequestID:  msg.RequestID,
+			ClientID:   clientID,
+			MetricName: readings[i].MetricName,
+			Entry:      entry,
+			Error:      err.Error(),
+		})
+		event.Rejections = append(event.Rejections, mq.Rejection{
+			MetricName: readings[i].MetricName,
+			Error:      err.Error(),
+		})
+	}
+
+	if err := s.repo.InsertRejectedReadingsTx(ctx, tx, rejected); err != nil {
+		return db.OutboxEvent{}, err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return db.OutboxEvent{}, fmt.Errorf("failed to marshal partial success event: %w", err)
+	}
+	return db.OutboxEvent{
+		RoutingKey:   s.cfg.RabbitMQ.PartialRoutingKey,
+		Payload:      payload,
+		TraceContext: tracing.InjectMap(ctx),
+	}, nil
+}
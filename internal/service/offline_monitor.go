@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"go.uber.org/zap"
+)
+
+// offlineLockName names the advisory lock that keeps the offline check to
+// one replica at a time
+const offlineLockName = "energy-metering-worker.offline-monitor"
+
+// OfflineMonitor periodically marks client metrics that stopped reporting
+// as offline, and offline metrics that report again as back online. Each
+// transition records a reading gap and queues a meter.offline or
+// meter.back_online event in the outbox within the same transaction.
+type OfflineMonitor struct {
+	*periodicJob
+
+	repo        *repository.Repository
+	cfg         config.OfflineConfig
+	routingKeys offlineRoutingKeys
+}
+
+type offlineRoutingKeys struct {
+	offline    string
+	backOnline string
+}
+
+// NewOfflineMonitor creates a new offline monitor
+func NewOfflineMonitor(repo *repository.Repository, cfg *config.Config, logger *zap.Logger) *OfflineMonitor {
+	m := &OfflineMonitor{
+		repo: repo,
+		cfg:  cfg.Offline,
+		routingKeys: offlineRoutingKeys{
+			offline:    cfg.RabbitMQ.OfflineRoutingKey,
+			backOnline: cfg.RabbitMQ.BackOnlineRoutingKey,
+		},
+	}
+	m.periodicJob = &periodicJob{
+		name:     "offline monitor",
+		interval: cfg.Offline.CheckInterval,
+		pass:     m.check,
+		fields: []zap.Field{
+			zap.Duration("offline_after", cfg.Offline.After),
+			zap.Int("missed_intervals", cfg.Offline.MissedIntervals),
+			zap.Duration("min_offline_after", cfg.Offline.MinAfter),
+		},
+		logger:   logger,
+		locker:   repo,
+		lockName: offlineLockName,
+	}
+	return m
+}
+
+// check runs one pass if no other replica is running one
+func (m *OfflineMonitor) check(ctx context.Context) error {
+	tx, locked, err := m.begin(ctx)
+	if err != nil || !locked {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	offline, err := m.repo.MarkMetricsOfflineTx(ctx, tx, repository.OfflineThresholds{
+		After:           m.cfg.After,
+		MissedIntervals: m.cfg.MissedIntervals,
+		MinAfter:        m.cfg.MinAfter,
+	}, m.cfg.BatchSize)
+	if err != nil {
+		return err
+	}
+	online, err := m.repo.MarkMetricsOnlineTx(ctx, tx, m.cfg.BatchSize)
+	if err != nil {
+		return err
+	}
+	if len(offline) == 0 && len(online) == 0 {
+		return nil
+	}
+
+	events := make([]db.OutboxEvent, 0, len(offline)+len(online))
+	for _, gap := range offline {
+		event, err := gapEvent(m.routingKeys.offline, mq.MeterOfflineEvent{
+			ClientID:      gap.ClientID.String(),
+			MetricName:    gap.MetricName,
+			LastReadingAt: gap.GapStart.Format(time.RFC3339),
+			DetectedAt:    gap.DetectedAt.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+
+		m.logger.Warn("meter offline",
+			zap.String("client_id", gap.ClientID.String()),
+			zap.String("metric_name", gap.MetricName),
+			zap.Time("last_reading_at", gap.GapStart),
+		)
+	}
+	for _, gap := range online {
+		end := gap.GapStart
+		if gap.GapEnd != nil {
+			end = *gap.GapEnd
+		}
+		event, err := gapEvent(m.routingKeys.backOnline, mq.MeterBackOnlineEvent{
+			ClientID:   gap.ClientID.String(),
+			MetricName: gap.MetricName,
+			GapStart:   gap.GapStart.Format(time.RFC3339),
+			GapEnd:     end.Format(time.RFC3339),
+			GapSeconds: int64(end.Sub(gap.GapStart).Seconds()),
+		})
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+
+		m.logger.Info("meter back online",
+			zap.String("client_id", gap.ClientID.String()),
+			zap.String("metric_name", gap.MetricName),
+			zap.Duration("gap", end.Sub(gap.GapStart)),
+		)
+	}
+
+	if err := m.repo.InsertOutboxEventsTx(ctx, tx, events); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	metrics.MeterTransitions.WithLabelValues("offline").Add(float64(len(offline)))
+	metrics.MeterTransitions.WithLabelValues("back_online").Add(float64(len(online)))
+
+	return nil
+}
+
+// gapEvent builds the outbox event of an offline transition
+func gapEvent(routingKey string, event any) (db.OutboxEvent, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return db.OutboxEvent{}, fmt.Errorf("failed to marshal gap event: %w", err)
+	}
+	return db.OutboxEvent{RoutingKey: routingKey, Payload: payload}, nil
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"go.uber.org/zap"
+)
+
+// OutboxStore is the outbox storage the relay claims events from and
+// records publish results in
+type OutboxStore interface {
+	ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]db.OutboxEvent, error)
+	MarkOutboxEventsSent(ctx context.Context, ids []int64) error
+	MarkOutboxEventFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) error
+	ParkOutboxEvent(ctx context.Context, id int64, lastError string) error
+}
+
+// BatchPublisher publishes a batch of messages and returns one error per
+// message, nil once the broker confirmed it
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, msgs []mq.Message) []error
+}
+
+// OutboxRelay publishes events from the transactional outbox to RabbitMQ.
+// Events are only marked sent after the broker confirmed them, so every
+// stored event is delivered at least once; consumers deduplicate on the
+// AMQP message ID, which carries the outbox event ID.
+//
+// Events are claimed with a lease in a short statement and published
+// outside any transaction, so no row lock or connection is held while the
+// broker confirms. Events of a relay that dies mid-batch are claimed again
+// once their lease expires. An event that still fails after MaxAttempts is
+// parked and no longer published.
+type OutboxRelay struct {
+	*periodicJob
+
+	store     OutboxStore
+	publisher BatchPublisher
+	cfg       config.OutboxConfig
+	backoff   mq.Backoff
+}
+
+// NewOutboxRelay creates a new outbox relay
+func NewOutboxRelay(
+	store OutboxStore,
+	publisher BatchPublisher,
+	cfg config.OutboxConfig,
+	logger *zap.Logger,
+) *OutboxRelay {
+	r := &OutboxRelay{
+		store:     store,
+		publisher: publisher,
+		cfg:       cfg,
+		backoff: mq.Backoff{
+			Initial: cfg.RetryInitialBackoff,
+			Max:     cfg.RetryMaxBackoff,
+		},
+	}
+	r.periodicJob = &periodicJob{
+		name:     "outbox relay",
+		interval: cfg.PollInterval,
+		pass:     r.drain,
+		fields: []zap.Field{
+			zap.Int("batch_size", cfg.BatchSize),
+			zap.Int("max_attempts", cfg.MaxAttempts),
+		},
+		logger: logger,
+	}
+	return r
+}
+
+// drain relays batches while they come back full
+func (r *OutboxRelay) drain(ctx context.Context) error {
+	for ctx.Err() == nil {
+		n, err := r.RelayBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if n < r.cfg.BatchSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+// RelayBatch publishes one batch of due events and returns how many were
+// claimed
+func (r *OutboxRelay) RelayBatch(ctx context.Context) (int, error) {
+	events, err := r.store.ClaimOutboxEvents(ctx, r.cfg.BatchSize, r.cfg.ClaimLease)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	msgs := make([]mq.Message, len(events))
+	for i, event := range events {
+		msgs[i] = mq.Message{
+			RoutingKey:   event.RoutingKey,
+			Body:         event.Payload,
+			MessageID:    event.EventID.String(),
+			TraceContext: event.TraceContext,
+		}
+	}
+	results := r.publisher.PublishBatch(ctx, msgs)
+
+	// Record the results even when shutdown started mid-batch, so confirmed
+	// events are not published again after the lease
+	ctx = context.WithoutCancel(ctx)
+
+	var sent []int64
+	for i, event := range events {
+		if err := results[i]; err != nil {
+			if event.Attempts+1 >= r.cfg.MaxAttempts {
+				r.logger.Error("giving up on outbox event",
+					zap.Error(err),
+					zap.Int64("outbox_id", event.ID),
+					zap.String("routing_key", event.RoutingKey),
+					zap.Int("attempts", event.Attempts+1),
+				)
+				if err := r.store.ParkOutboxEvent(ctx, event.ID, err.Error()); err != nil {
+					return 0, err
+				}
+				metrics.OutboxEventsParked.WithLabelValues(event.RoutingKey).Inc()
+				continue
+			}
+
+			nextAttempt := time.Now().Add(r.retryDelay(event.Attempts, err))
+			r.logger.Warn("failed to publish outbox event",
+				zap.Error(err),
+				zap.Int64("outbox_id", event.ID),
+				zap.String("routing_key", event.RoutingKey),
+				zap.Int("attempts", event.Attempts+1),
+				zap.Time("next_attempt_at", nextAttempt),
+			)
+			if err := r.store.MarkOutboxEventFailed(ctx, event.ID, err.Error(), nextAttempt); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		sent = append(sent, event.ID)
+	}
+
+	if err := r.store.MarkOutboxEventsSent(ctx, sent); err != nil {
+		return 0, err
+	}
+
+	r.logger.Debug("relayed outbox events",
+		zap.Int("sent", len(sent)),
+		zap.Int("failed", len(events)-len(sent)),
+	)
+
+	return len(events), nil
+}
+
+// retryDelay returns how long to wait before publishing a failed event
+// again. Unroutable events wait the maximum backoff straight away: they
+// only succeed once a downstream queue is bound, which is not a transient
+// broker hiccup. Either way the event is parked after MaxAttempts.
+func (r *OutboxRelay) retryDelay(attempts int, err error) time.Duration {
+	if errors.Is(err, mq.ErrUnroutable) {
+		return r.cfg.RetryMaxBackoff
+	}
+	return r.backoff.Duration(attempts)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"go.uber.org/zap"
+)
+
+// partitionLockName names the advisory lock that keeps partition
+// maintenance to one replica at a time
+const partitionLockName = "energy-metering-worker.partition-maintainer"
+
+// partitionLockTimeout bounds how long partition DDL waits behind inserts
+const partitionLockTimeout = 5 * time.Second
+
+// PartitionMaintainer keeps the daily partitions of meter_readings_raw on
+// databases without TimescaleDB: it creates partitions from as far back as
+// the timestamp tolerance accepts readings to some days ahead, so inserts
+// find one, and drops those past retention. Readings outside that range go
+// to the default partition. On TimescaleDB the hypertable creates its own
+// chunks and the maintainer only keeps the retention policy in line with
+// the configured retention.
+type PartitionMaintainer struct {
+	*periodicJob
+
+	repo     *repository.Repository
+	cfg      config.PartitionConfig
+	lateness time.Duration // how late a reading is still valid
+}
+
+// NewPartitionMaintainer creates a new partition maintainer
+func NewPartitionMaintainer(repo *repository.Repository, cfg *config.Config, logger *zap.Logger) *PartitionMaintainer {
+	m := &PartitionMaintainer{
+		repo:     repo,
+		cfg:      cfg.Partition,
+		lateness: time.Duration(cfg.Validation.TimestampToleranceMinutes) * time.Minute,
+	}
+	m.periodicJob = &periodicJob{
+		name:     "partition maintainer",
+		interval: cfg.Partition.CheckInterval,
+		pass:     m.maintain,
+		fields: []zap.Field{
+			zap.Int("premake_days", cfg.Partition.PremakeDays),
+			zap.Int("retention_days", cfg.Partition.RetentionDays),
+			zap.Duration("lateness", m.lateness),
+		},
+		logger:   logger,
+		locker:   repo,
+		lockName: partitionLockName,
+	}
+	return m
+}
+
+// maintain runs one pass if no other replica is running one
+func (m *PartitionMaintainer) maintain(ctx context.Context) error {
+	tx, locked, err := m.begin(ctx)
+	if err != nil || !locked {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	partitioned, err := m.repo.IsReadingsPartitionedTx(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if !partitioned {
+		return m.maintainRetentionPolicy(ctx, tx)
+	}
+
+	if err := m.repo.SetLockTimeoutTx(ctx, tx, partitionLockTimeout); err != nil {
+		return err
+	}
+
+	// Partitions before the retention cut would be dropped right away
+	now := time.Now()
+	from := now.Add(-m.lateness)
+	if m.cfg.RetentionDays > 0 {
+		if cut := now.AddDate(0, 0, -m.cfg.RetentionDays); from.Before(cut) {
+			from = cut
+		}
+	}
+	created, err := m.repo.CreateReadingPartitionsTx(ctx, tx, from, now.AddDate(0, 0, m.cfg.PremakeDays))
+	if err != nil {
+		return err
+	}
+
+	dropped := 0
+	if m.cfg.RetentionDays > 0 {
+		dropped, err = m.repo.DropReadingPartitionsTx(ctx, tx, now.AddDate(0, 0, -m.cfg.RetentionDays))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	metrics.ReadingPartitions.WithLabelValues("created").Add(float64(created))
+	metrics.ReadingPartitions.WithLabelValues("dropped").Add(float64(dropped))
+
+	if created > 0 || dropped > 0 {
+		m.logger.Info("reading partitions maintained",
+			zap.Int("created", created),
+			zap.Int("dropped", dropped),
+		)
+	}
+
+	return nil
+}
+
+// maintainRetentionPolicy applies the configured retention to the
+// TimescaleDB retention policy of the readings hypertable
+func (m *PartitionMaintainer) maintainRetentionPolicy(ctx context.Context, tx pgx.Tx) error {
+	hypertable, err := m.repo.IsReadingsHypertableTx(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if !hypertable {
+		m.logger.Debug("readings table neither partitioned nor a hypertable, maintenance skipped")
+		return nil
+	}
+
+	changed, err := m.repo.SetReadingsRetentionPolicyTx(ctx, tx, m.cfg.RetentionDays)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if changed {
+		m.logger.Info("readings retention policy updated", zap.Int("retention_days", m.cfg.RetentionDays))
+	}
+
+	return nil
+}
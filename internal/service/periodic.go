@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+// jobLocker begins the transactions of locked jobs and takes their advisory
+// lock
+type jobLocker interface {
+	BeginTx(ctx context.Context) (pgx.Tx, error)
+	TryAdvisoryLockTx(ctx context.Context, tx pgx.Tx, name string) (bool, error)
+}
+
+// periodicJob runs a pass of a background job right away and then every
+// interval until stopped. Jobs embed it for their Start and Stop methods;
+// those that must run on one replica at a time set locker and lockName and
+// open their pass with begin.
+type periodicJob struct {
+	name     string // used in log messages
+	interval time.Duration
+	pass     func(ctx context.Context) error
+	fields   []zap.Field // settings logged on start
+	logger   *zap.Logger
+
+	locker   jobLocker
+	lockName string
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start starts the job in the background, with a first pass right away
+func (j *periodicJob) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		j.run(ctx)
+	}()
+
+	j.logger.Info(j.name+" started", append([]zap.Field{zap.Duration("interval", j.interval)}, j.fields...)...)
+}
+
+// Stop stops the job and waits for the current pass to finish
+func (j *periodicJob) Stop(ctx context.Context) error {
+	if j.cancel == nil {
+		return nil
+	}
+	j.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		j.logger.Info(j.name + " stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RunOnce runs a single pass in the foreground
+func (j *periodicJob) RunOnce(ctx context.Context) error {
+	return j.pass(ctx)
+}
+
+func (j *periodicJob) run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := j.pass(ctx); err != nil && ctx.Err() == nil {
+			j.logger.Error(j.name+" pass failed", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// begin starts the transaction of a pass holding the job's advisory lock.
+// It reports false, with no transaction, when another replica holds it.
+func (j *periodicJob) begin(ctx context.Context) (pgx.Tx, bool, error) {
+	tx, err := j.locker.BeginTx(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	locked, err := j.locker.TryAdvisoryLockTx(ctx, tx, j.lockName)
+	if err != nil || !locked {
+		tx.Rollback(ctx)
+		if err == nil {
+			j.logger.Debug(j.name + " running on another replica, skipped")
+		}
+		return nil, false, err
+	}
+
+	return tx, true, nil
+}
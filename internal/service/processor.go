@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,9 +12,13 @@ import (
 	"github.com/septivank/energy-metering-worker/internal/config"
 	"github.com/septivank/energy-metering-worker/internal/db"
 	"github.com/septivank/energy-metering-worker/internal/logging"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
 	"github.com/septivank/energy-metering-worker/internal/mq"
 	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/tracing"
 	"github.com/septivank/energy-metering-worker/internal/validator"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -37,13 +42,28 @@ type PMData struct {
 	Date string `json:"date"`
 	Data string `json:"data"`
 	Name string `json:"name"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// ShardKey returns the client fingerprint of a raw ingest message so that
+// messages from the same client are processed in order. Malformed bodies
+// yield an empty key; they fail permanently during processing anyway.
+func ShardKey(body []byte) string {
+	var msg struct {
+		ClientFingerprint string `json:"client_fingerprint"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return ""
+	}
+	return msg.ClientFingerprint
 }
 
 // ProcessorService handles message processing logic
 type ProcessorService struct {
 	repo      *repository.Repository
-	publisher *mq.Publisher
-	detector  *anomaly.Detector
+	clients   *ClientResolver
+	baselines *BaselineCache
+	detector  anomaly.Strategy
 	validator *validator.Validator
 	cfg       *config.Config
 	logger    *zap.Logger
@@ -52,15 +72,17 @@ type ProcessorService struct {
 // NewProcessorService creates a new processor service
 func NewProcessorService(
 	repo *repository.Repository,
-	publisher *mq.Publisher,
-	detector *anomaly.Detector,
+	clients *ClientResolver,
+	baselines *BaselineCache,
+	detector anomaly.Strategy,
 	validator *validator.Validator,
 	cfg *config.Config,
 	logger *zap.Logger,
 ) *ProcessorService {
 	return &ProcessorService{
 		repo:      repo,
-		publisher: publisher,
+		clients:   clients,
+		baselines: baselines,
 		detector:  detector,
 		validator: validator,
 		cfg:       cfg,
@@ -68,14 +90,32 @@ func NewProcessorService(
 	}
 }
 
-// ProcessMessage processes an incoming meter reading message
-func (s *ProcessorService) ProcessMessage(ctx context.Context, body []byte) error {
+// ProcessMessage processes an incoming meter reading message. Failures that
+// cannot succeed on redelivery are marked with mq.Permanent.
+func (s *ProcessorService) ProcessMessage(ctx context.Context, delivery mq.Delivery) error {
+	start := time.Now()
+	err := classifyError(s.processMessage(ctx, delivery))
+	metrics.ProcessDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (s *ProcessorService) processMessage(ctx context.Context, delivery mq.Delivery) error {
 	// Parse incoming message
 	var msg IngestMessage
-	if err := json.Unmarshal(body, &msg); err != nil {
-		return fmt.Errorf("failed to unmarshal message: %w", err)
+	_, span := tracing.Tracer().Start(ctx, "unmarshal")
+	err := json.Unmarshal(delivery.Body, &msg)
+	tracing.RecordError(span, err)
+	span.End()
+	if err != nil {
+		return mq.Permanent(fmt.Errorf("failed to unmarshal message: %w", err))
 	}
 
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("request_id", msg.RequestID),
+		attribute.String("client_fingerprint", msg.ClientFingerprint),
+		attribute.Int("pm_count", len(msg.Payload.PM)),
+	)
+
 	// Add request_id to logger context
 	reqLogger := logging.WithRequestID(s.logger, msg.RequestID)
 	reqLogger.Info("processing message",
@@ -83,16 +123,19 @@ func (s *ProcessorService) ProcessMessage(ctx context.Context, body []byte) erro
 		zap.Int("pm_count", len(msg.Payload.PM)),
 	)
 
-	// Get or create client with IP address and user agent
+	// Resolve client (cached) with IP address and user agent
 	var userAgent *string
 	if msg.UserAgent != "" {
 		userAgent = &msg.UserAgent
 	}
 
-	client, err := s.repo.GetOrCreateClient(ctx, msg.ClientFingerprint, msg.IPAddress, userAgent)
+	resolveCtx, span := tracing.Tracer().Start(ctx, "resolve_client")
+	clientID, err := s.clients.Resolve(resolveCtx, msg.ClientFingerprint, msg.IPAddress, userAgent)
+	tracing.RecordError(span, err)
+	span.End()
 	if err != nil {
-		reqLogger.Error("failed to get or create client", zap.Error(err))
-		return fmt.Errorf("failed to get or create client: %w", err)
+		reqLogger.Error("failed to resolve client", zap.Error(err))
+		return fmt.Errorf("failed to resolve client: %w", err)
 	}
 
 	// Process each PM reading in a transaction
@@ -103,63 +146,292 @@ func (s *ProcessorService) ProcessMessage(ctx context.Context, body []byte) erro
 	}
 	defer tx.Rollback(ctx)
 
-	reqLogger.Debug("client resolved", zap.String("client_id", client.ID.String()))
+	reqLogger.Debug("client resolved", zap.String("client_id", clientID.String()))
+
+	// Skip requests already stored by an earlier delivery of this message
+	if msg.RequestID != "" {
+		claimed, err := s.repo.ClaimRequestTx(ctx, tx, msg.RequestID, clientID)
+		if err != nil {
+			reqLogger.Error("failed to check processed requests", zap.Error(err))
+			return fmt.Errorf("failed to check processed requests: %w", err)
+		}
+		if !claimed {
+			reqLogger.Info("duplicate request skipped, already processed")
+			return nil
+		}
+	}
+
+	// Store the raw message once; its readings reference it by ID
+	messageID, err := s.repo.InsertIngestMessageTx(ctx, tx, ingestRecord(msg, clientID, delivery))
+	if err != nil {
+		reqLogger.Error("failed to store ingest message", zap.Error(err))
+		return fmt.Errorf("failed to store ingest message: %w", err)
+	}
+
+	// Validate every reading first so that anomaly detection can fetch the
+	// history of all metrics in one query
+	readings := make([]*db.MeterReading, len(msg.Payload.PM))
+	for i, pm := range msg.Payload.PM {
+		readings[i] = s.validateReading(ctx, clientID, pm, msg.ReceivedAt, messageID)
+	}
+	s.checkConsistency(readings, reqLogger)
+	history, err := s.loadBaselines(ctx, clientID, readings, reqLogger)
+	if err != nil {
+		// Retry rather than store the readings unchecked: counters would
+		// lose their delta and gauges would skip anomaly detection for good
+		return fmt.Errorf("failed to load anomaly baselines: %w", err)
+	}
+	s.checkCounters(readings, history, reqLogger)
+	s.checkRates(readings, history)
+	checked := s.detectAnomalies(ctx, clientID, readings, history, reqLogger)
+
+	insertCtx, span := tracing.Tracer().Start(ctx, "insert_readings",
+		trace.WithAttributes(attribute.Int("readings_count", len(readings))),
+	)
+	var inserted []bool
+	var failures map[int]error
+	if s.cfg.Validation.IsolateReadings {
+		inserted, failures, err = s.insertIsolated(insertCtx, tx, readings)
+	} else {
+		inserted, err = s.repo.InsertMeterReadingsTx(insertCtx, tx, readings)
+	}
+	tracing.RecordError(span, err)
+	span.End()
+	if err != nil {
+		reqLogger.Error("failed to insert readings", zap.Error(err))
+		return fmt.Errorf("failed to insert readings: %w", err)
+	}
+
+	// Fold the new valid readings into the seasonal baselines in the same
+	// transaction, so redeliveries never count a reading twice
+	var seasonal []*db.MeterReading
+	for i, reading := range readings {
+		if inserted[i] && reading.ValidationStatus == "valid" {
+			seasonal = append(seasonal, reading)
+		}
+	}
+	if err := s.repo.MergeSeasonalStatsTx(ctx, tx, SeasonalDeltas(seasonal, s.cfg.Anomaly.SeasonalLocation)); err != nil {
+		reqLogger.Error("failed to update seasonal stats", zap.Error(err))
+		return fmt.Errorf("failed to update seasonal stats: %w", err)
+	}
+
+	// Record that the metrics reported, for the offline monitor
+	if err := s.repo.TouchMetricStatusTx(ctx, tx, clientID, metricSightings(readings, inserted)); err != nil {
+		reqLogger.Error("failed to update metric status", zap.Error(err))
+		return fmt.Errorf("failed to update metric status: %w", err)
+	}
 
-	var processedEvents []mq.ProcessedEvent
+	// Open and close stuck meter episodes; a new episode emits meter.stuck
+	stuckEvents, err := trackStuckMeters(ctx, s.repo, tx, clientID,
+		stuckTransitions(readings, inserted, checked), s.cfg.RabbitMQ.StuckRoutingKey, reqLogger)
+	if err != nil {
+		reqLogger.Error("failed to track stuck meters", zap.Error(err))
+		return fmt.Errorf("failed to track stuck meters: %w", err)
+	}
 
-	for _, pm := range msg.Payload.PM {
-		event, err := s.processSingleReading(ctx, tx, client.ID, pm, msg.ReceivedAt, body, reqLogger)
+	// Queue events in the outbox so they are published if and only if the
+	// readings are committed
+	var events []db.OutboxEvent
+	duplicates := 0
+	for i, reading := range readings {
+		if _, failed := failures[i]; failed {
+			continue
+		}
+		if !inserted[i] {
+			duplicates++
+			reqLogger.Debug("duplicate reading skipped",
+				zap.String("metric_name", reading.MetricName),
+				zap.Time("reading_timestamp", reading.ReadingTimestamp),
+			)
+			continue
+		}
+
+		payload, err := json.Marshal(mq.ProcessedEvent{
+			ClientID:         reading.ClientID.String(),
+			MetricName:       reading.MetricName,
+			MetricValue:      reading.MetricValue,
+			ReadingTimestamp: reading.ReadingTimestamp.Format(time.RFC3339),
+			ValidationStatus: reading.ValidationStatus,
+			DeltaValue:       reading.DeltaValue,
+			CounterEvent:     counterEvent(reading),
+		})
 		if err != nil {
-			reqLogger.Error("failed to process reading",
+			return fmt.Errorf("failed to marshal event: %w", err)
+		}
+		events = append(events, db.OutboxEvent{
+			RoutingKey:   s.cfg.RabbitMQ.WorkerRoutingKey,
+			Payload:      payload,
+			TraceContext: tracing.InjectMap(ctx),
+		})
+	}
+
+	stored := len(events)
+	events = append(events, stuckEvents...)
+
+	// Keep the readings that failed to insert for inspection and announce
+	// the partial success
+	if len(failures) > 0 {
+		for i, err := range failures {
+			reqLogger.Warn("reading rejected",
+				zap.String("metric_name", readings[i].MetricName),
 				zap.Error(err),
-				zap.String("metric_name", pm.Name),
 			)
-			return fmt.Errorf("failed to process reading: %w", err)
 		}
-		if event != nil {
-			processedEvents = append(processedEvents, *event)
+		partial, err := s.recordRejections(ctx, tx, msg, clientID, readings, inserted, failures)
+		if err != nil {
+			reqLogger.Error("failed to record rejected readings", zap.Error(err))
+			return fmt.Errorf("failed to record rejected readings: %w", err)
 		}
+		events = append(events, partial)
+	}
+
+	queueCtx, span := tracing.Tracer().Start(ctx, "queue_events",
+		trace.WithAttributes(attribute.Int("events_count", len(events))),
+	)
+	err = s.repo.InsertOutboxEventsTx(queueCtx, tx, events)
+	tracing.RecordError(span, err)
+	span.End()
+	if err != nil {
+		reqLogger.Error("failed to queue events", zap.Error(err))
+		return fmt.Errorf("failed to queue events: %w", err)
 	}
 
 	// Commit transaction
-	if err := tx.Commit(ctx); err != nil {
+	commitCtx, span := tracing.Tracer().Start(ctx, "commit")
+	err = tx.Commit(commitCtx)
+	tracing.RecordError(span, err)
+	span.End()
+	if err != nil {
 		reqLogger.Error("failed to commit transaction", zap.Error(err))
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	// Publish events after successful commit
-	for _, event := range processedEvents {
-		if err := s.publisher.PublishProcessedEvent(ctx, event, s.cfg.RabbitMQ.WorkerRoutingKey); err != nil {
-			// Log error but don't fail the entire message processing
-			reqLogger.Error("failed to publish event",
-				zap.Error(err),
-				zap.String("client_id", event.ClientID),
-				zap.String("metric_name", event.MetricName),
-			)
+	// Extend the cached baselines only once the readings are durable
+	for i, reading := range readings {
+		if inserted[i] {
+			recordStored(reading)
+			if reading.CounterEvent != nil {
+				metrics.CounterEvents.WithLabelValues(*reading.CounterEvent).Inc()
+			}
+		}
+		if inserted[i] && reading.ValidationStatus == "valid" {
+			s.baselines.Add(clientID, reading.MetricName, db.MetricPoint{
+				Value:     reading.MetricValue,
+				Timestamp: reading.ReadingTimestamp,
+			})
 		}
 	}
 
+	if len(failures) > 0 {
+		metrics.ReadingsRejected.Add(float64(len(failures)))
+	}
+
+	if duplicates > 0 {
+		metrics.ReadingsDuplicate.Add(float64(duplicates))
+		reqLogger.Warn("duplicate readings skipped",
+			zap.Int("duplicates_count", duplicates),
+		)
+	}
+
 	reqLogger.Info("message processed successfully",
-		zap.Int("readings_count", len(processedEvents)),
+		zap.Int("readings_count", stored),
+		zap.Int("duplicates_count", duplicates),
+		zap.Int("rejected_count", len(failures)),
 	)
 
 	return nil
 }
 
-func (s *ProcessorService) processSingleReading(
+// recordStored counts a committed reading by validation status and, when
+// invalid, by reason category
+func recordStored(reading *db.MeterReading) {
+	metrics.ReadingsStored.WithLabelValues(reading.ValidationStatus).Inc()
+	if reading.ValidationStatus == "invalid" && reading.AnomalyReason != nil {
+		metrics.ReadingsInvalid.WithLabelValues(metrics.ReasonCategory(*reading.AnomalyReason)).Inc()
+	}
+}
+
+// metricSightings returns, per metric, the newest reading and received
+// timestamps among the stored readings
+func metricSightings(readings []*db.MeterReading, inserted []bool) []db.MetricSighting {
+	index := make(map[string]int)
+	var sightings []db.MetricSighting
+	for i, reading := range readings {
+		if !inserted[i] {
+			continue
+		}
+		j, ok := index[reading.MetricName]
+		if !ok {
+			index[reading.MetricName] = len(sightings)
+			sightings = append(sightings, db.MetricSighting{
+				MetricName: reading.MetricName,
+				ReadingAt:  reading.ReadingTimestamp,
+				ReceivedAt: reading.ReceivedAt,
+			})
+			continue
+		}
+		if reading.ReadingTimestamp.After(sightings[j].ReadingAt) {
+			sightings[j].ReadingAt = reading.ReadingTimestamp
+		}
+		if reading.ReceivedAt.After(sightings[j].ReceivedAt) {
+			sightings[j].ReceivedAt = reading.ReceivedAt
+		}
+	}
+	return sightings
+}
+
+// counterEvent returns the counter event of a reading, or empty
+func counterEvent(reading *db.MeterReading) string {
+	if reading.CounterEvent == nil {
+		return ""
+	}
+	return *reading.CounterEvent
+}
+
+// ingestRecord builds the stored form of a consumed message. Headers that
+// cannot be encoded as JSON are left out rather than failing the message.
+func ingestRecord(msg IngestMessage, clientID uuid.UUID, delivery mq.Delivery) *db.IngestMessage {
+	record := &db.IngestMessage{
+		RequestID:   msg.RequestID,
+		ClientID:    clientID,
+		ReceivedAt:  msg.ReceivedAt,
+		Payload:     delivery.Body,
+		MessageID:   delivery.MessageID,
+		Exchange:    delivery.Exchange,
+		RoutingKey:  delivery.RoutingKey,
+		Redelivered: delivery.Redelivered,
+		RetryCount:  delivery.RetryCount,
+	}
+	if len(delivery.Headers) > 0 {
+		if headers, err := json.Marshal(delivery.Headers); err == nil {
+			record.Headers = headers
+		}
+	}
+	if !delivery.Timestamp.IsZero() {
+		record.PublishedAt = &delivery.Timestamp
+	}
+	return record
+}
+
+// validateReading validates one PM entry and builds the reading to store
+func (s *ProcessorService) validateReading(
 	ctx context.Context,
-	tx repository.Tx,
 	clientID uuid.UUID,
 	pm PMData,
 	receivedAt time.Time,
-	rawPayload []byte,
-	logger *zap.Logger,
-) (*mq.ProcessedEvent, error) {
+	messageID int64,
+) *db.MeterReading {
+	_, span := tracing.Tracer().Start(ctx, "validate_reading",
+		trace.WithAttributes(attribute.String("metric_name", pm.Name)),
+	)
+	defer span.End()
+
 	// Convert to validator format
 	metricData := validator.MetricData{
 		Date: pm.Date,
 		Data: pm.Data,
 		Name: pm.Name,
+		Unit: pm.Unit,
 	}
 
 	// Validate metric data
@@ -170,59 +442,159 @@ func (s *ProcessorService) processSingleReading(
 		readingTime = receivedAt
 	}
 
-	validationStatus := "valid"
-	var anomalyReason *string
-
-	if !validationResult.IsValid {
-		validationStatus = "invalid"
-		anomalyReason = &validationResult.AnomalyReason
-	} else {
-		// Only do anomaly detection for valid readings
-		// Get recent readings for this client and metric
-		historicalValues, err := s.repo.GetRecentReadingsForClient(ctx, clientID, pm.Name, 10)
-		if err != nil {
-			logger.Warn("failed to get historical readings for anomaly detection",
-				zap.Error(err),
-				zap.String("metric_name", pm.Name),
-			)
-		} else {
-			isAnomaly, reason := s.detector.DetectAnomaly(value, historicalValues)
-			if isAnomaly {
-				validationStatus = "invalid"
-				anomalyReason = &reason
-				logger.Debug("anomaly detected",
-					zap.String("metric_name", pm.Name),
-					zap.Float64("value", value),
-					zap.String("reason", reason),
-				)
-			}
-		}
-	}
-
-	// Insert reading into database
 	reading := &db.MeterReading{
 		ClientID:         clientID,
 		MetricName:       pm.Name,
 		MetricValue:      value,
 		ReadingTimestamp: readingTime,
 		ReceivedAt:       receivedAt,
-		ValidationStatus: validationStatus,
-		AnomalyReason:    anomalyReason,
-		RawPayload:       rawPayload,
+		ValidationStatus: "valid",
+		IngestMessageID:  &messageID,
 	}
 
-	if err := s.repo.InsertMeterReadingTx(ctx, tx, reading); err != nil {
-		return nil, fmt.Errorf("failed to insert reading: %w", err)
+	if !validationResult.IsValid {
+		reading.ValidationStatus = "invalid"
+		reading.AnomalyReason = &validationResult.AnomalyReason
 	}
+	span.SetAttributes(attribute.String("validation_status", reading.ValidationStatus))
 
-	// Create processed event
-	event := &mq.ProcessedEvent{
-		ClientID:         clientID.String(),
-		MetricName:       pm.Name,
-		MetricValue:      value,
-		ReadingTimestamp: readingTime.Format(time.RFC3339),
-		ValidationStatus: validationStatus,
+	return reading
+}
+
+// loadBaselines fetches the cached history of the metrics of the valid
+// readings
+func (s *ProcessorService) loadBaselines(ctx context.Context, clientID uuid.UUID, readings []*db.MeterReading, logger *zap.Logger) (map[string][]db.MetricPoint, error) {
+	var metricNames []string
+	seen := make(map[string]bool)
+	for _, reading := range readings {
+		if reading.ValidationStatus == "valid" && !seen[reading.MetricName] {
+			seen[reading.MetricName] = true
+			metricNames = append(metricNames, reading.MetricName)
+		}
+	}
+	if len(metricNames) == 0 {
+		return nil, nil
+	}
+
+	baselineCtx, span := tracing.Tracer().Start(ctx, "load_baselines",
+		trace.WithAttributes(attribute.StringSlice("metric_names", metricNames)),
+	)
+	history, err := s.baselines.Recent(baselineCtx, clientID, metricNames)
+	tracing.RecordError(span, err)
+	span.End()
+	if err != nil {
+		logger.Warn("failed to get historical readings for anomaly detection",
+			zap.Error(err),
+			zap.Strings("metric_names", metricNames),
+		)
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// checkConsistency groups the valid readings by timestamp and marks those
+// taking part in a failed cross-metric consistency rule invalid. Rules only
+// apply to metrics reported at the same instant.
+func (s *ProcessorService) checkConsistency(readings []*db.MeterReading, logger *zap.Logger) {
+	if !s.validator.HasConsistencyRules() {
+		return
+	}
+
+	groups := make(map[int64][]*db.MeterReading)
+	for _, reading := range readings {
+		if reading.ValidationStatus == "valid" {
+			key := reading.ReadingTimestamp.UnixNano()
+			groups[key] = append(groups[key], reading)
+		}
+	}
+
+	for _, group := range groups {
+		values := make(map[string]float64, len(group))
+		for _, reading := range group {
+			if _, dup := values[reading.MetricName]; !dup {
+				values[reading.MetricName] = reading.MetricValue
+			}
+		}
+
+		violations := s.validator.CheckConsistency(values)
+		for _, reading := range group {
+			reasons, ok := violations[reading.MetricName]
+			if !ok {
+				continue
+			}
+			reason := strings.Join(reasons, "; ")
+			reading.ValidationStatus = "invalid"
+			reading.AnomalyReason = &reason
+			logger.Debug("inconsistent reading",
+				zap.String("metric_name", reading.MetricName),
+				zap.Float64("value", reading.MetricValue),
+				zap.Time("reading_timestamp", reading.ReadingTimestamp),
+				zap.String("reason", reason),
+			)
+		}
+	}
+}
+
+// detectAnomalies runs anomaly detection on the valid readings against the
+// baselines of their metrics. Counter readings across a rollover or reset
+// are skipped, as the jump is explained. It returns the findings of every
+// reading that was checked, keyed by index.
+func (s *ProcessorService) detectAnomalies(
+	ctx context.Context,
+	clientID uuid.UUID,
+	readings []*db.MeterReading,
+	history map[string][]db.MetricPoint,
+	logger *zap.Logger,
+) map[int][]anomaly.Finding {
+	checked := make(map[int][]anomaly.Finding)
+	for i, reading := range readings {
+		if reading.ValidationStatus != "valid" || reading.CounterEvent != nil {
+			continue
+		}
+
+		points := history[reading.MetricName]
+		series := make(anomaly.Series, len(points))
+		for j, p := range points {
+			series[j] = anomaly.Point{Value: p.Value, Timestamp: p.Timestamp}
+		}
+
+		detectCtx, span := tracing.Tracer().Start(ctx, "detect_anomaly",
+			trace.WithAttributes(
+				attribute.String("metric_name", reading.MetricName),
+				attribute.Int("baseline_points", len(series)),
+			),
+		)
+		findings := s.detector.Check(detectCtx, series, anomaly.Candidate{
+			ClientID:   clientID,
+			MetricName: reading.MetricName,
+			Value:      reading.MetricValue,
+			Timestamp:  reading.ReadingTimestamp,
+
+			AllowNegative: s.validator.AllowsNegative(reading.MetricName),
+		})
+		span.SetAttributes(attribute.Bool("anomaly", len(findings) > 0))
+		span.End()
+		checked[i] = findings
+
+		if len(findings) > 0 {
+			reason := anomaly.Reason(findings)
+			reading.ValidationStatus = "invalid"
+			reading.AnomalyReason = &reason
+			for _, f := range findings {
+				metrics.AnomalyFindings.WithLabelValues(f.Detector, f.Code, string(f.Severity)).Inc()
+				logger.Debug("anomaly detected",
+					zap.String("metric_name", reading.MetricName),
+					zap.Float64("value", reading.MetricValue),
+					zap.String("detector", f.Detector),
+					zap.String("code", f.Code),
+					zap.String("severity", string(f.Severity)),
+					zap.Float64("score", f.Score),
+					zap.String("reason", f.Message),
+				)
+			}
+		}
 	}
 
-	return event, nil
+	return checked
 }
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"go.uber.org/zap"
+)
+
+// retentionLockName names the advisory lock that keeps purges to one
+// replica at a time
+const retentionLockName = "energy-metering-worker.retention-purger"
+
+// RetentionPurger periodically deletes bookkeeping rows past retention:
+// sent and parked outbox events, the processed-requests ledger used to skip
+// redelivered requests and raw ingest messages.
+type RetentionPurger struct {
+	*periodicJob
+
+	repo   *repository.Repository
+	cfg    config.RetentionConfig
+	outbox time.Duration // retention of sent and parked outbox events
+}
+
+// NewRetentionPurger creates a new retention purger
+func NewRetentionPurger(repo *repository.Repository, cfg *config.Config, logger *zap.Logger) *RetentionPurger {
+	p := &RetentionPurger{
+		repo:   repo,
+		cfg:    cfg.Retention,
+		outbox: cfg.Outbox.Retention,
+	}
+	p.periodicJob = &periodicJob{
+		name:     "retention purger",
+		interval: cfg.Retention.PurgeInterval,
+		pass:     p.purge,
+		fields: []zap.Field{
+			zap.Duration("outbox_retention", cfg.Outbox.Retention),
+			zap.Duration("processed_requests_retention", cfg.Retention.ProcessedRequests),
+			zap.Duration("ingest_messages_retention", cfg.Retention.IngestMessages),
+		},
+		logger:   logger,
+		locker:   repo,
+		lockName: retentionLockName,
+	}
+	return p
+}
+
+// purge runs one pass if no other replica is running one
+func (p *RetentionPurger) purge(ctx context.Context) error {
+	tx, locked, err := p.begin(ctx)
+	if err != nil || !locked {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	events, err := p.repo.DeleteFinishedOutboxEventsTx(ctx, tx, now.Add(-p.outbox))
+	if err != nil {
+		return err
+	}
+	requests, err := p.repo.DeleteProcessedRequestsTx(ctx, tx, now.Add(-p.cfg.ProcessedRequests))
+	if err != nil {
+		return err
+	}
+
+	var messages int64
+	if p.cfg.IngestMessages > 0 {
+		messages, err = p.repo.DeleteIngestMessagesTx(ctx, tx, now.Add(-p.cfg.IngestMessages))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	metrics.RowsPurged.WithLabelValues("event_outbox").Add(float64(events))
+	metrics.RowsPurged.WithLabelValues("processed_requests").Add(float64(requests))
+	metrics.RowsPurged.WithLabelValues("ingest_messages").Add(float64(messages))
+
+	if events > 0 || requests > 0 || messages > 0 {
+		p.logger.Info("expired rows purged",
+			zap.Int64("outbox_events", events),
+			zap.Int64("processed_requests", requests),
+			zap.Int64("ingest_messages", messages),
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"go.uber.org/zap"
+)
+
+// rollupLockName names the advisory lock that keeps rollup refreshes to one
+// replica at a time
+const rollupLockName = "energy-metering-worker.rollup-refresher"
+
+// RollupRefresher keeps the 15-minute, hourly and daily rollup tables up to
+// date on databases without TimescaleDB by recomputing, from the raw
+// readings, the buckets whose readings changed since its last pass. A
+// trigger on meter_readings_raw logs those buckets. On TimescaleDB the
+// rollups are continuous aggregates with their own refresh policies and the
+// refresher stays idle.
+type RollupRefresher struct {
+	*periodicJob
+
+	repo *repository.Repository
+	cfg  config.RollupConfig
+}
+
+// NewRollupRefresher creates a new rollup refresher
+func NewRollupRefresher(repo *repository.Repository, cfg config.RollupConfig, logger *zap.Logger) *RollupRefresher {
+	r := &RollupRefresher{
+		repo: repo,
+		cfg:  cfg,
+	}
+	r.periodicJob = &periodicJob{
+		name:     "rollup refresher",
+		interval: cfg.RefreshInterval,
+		pass:     r.refresh,
+		fields: []zap.Field{
+			zap.Duration("lookback", cfg.Lookback),
+			zap.Int("batch_size", cfg.BatchSize),
+		},
+		logger:   logger,
+		locker:   repo,
+		lockName: rollupLockName,
+	}
+	return r
+}
+
+// refresh runs one pass, a batch at a time until the logged changes are
+// drained
+func (r *RollupRefresher) refresh(ctx context.Context) error {
+	for {
+		taken, err := r.refreshBatch(ctx)
+		if err != nil || taken == 0 || taken < r.cfg.BatchSize {
+			return err
+		}
+	}
+}
+
+// refreshBatch recomputes the buckets of one batch of logged changes, if no
+// other replica is running a pass and the rollups are worker-maintained
+// tables. It returns how many changes it took.
+func (r *RollupRefresher) refreshBatch(ctx context.Context) (int, error) {
+	tx, locked, err := r.begin(ctx)
+	if err != nil || !locked {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	maintained, err := r.repo.RollupsMaintainedTx(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	if !maintained {
+		r.logger.Debug("rollups not maintained by the worker, refresh skipped")
+		return 0, nil
+	}
+
+	invalidations, err := r.repo.TakeRollupInvalidationsTx(ctx, tx, r.cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Changes older than the lookback are refreshed too, but reported:
+	// TimescaleDB would leave them out of its rollups
+	since := time.Now().Add(-r.cfg.Lookback)
+	late := 0
+	var oldest time.Time
+	for _, inv := range invalidations {
+		if !inv.Bucket.Add(repository.Rollup15Min.Bucket).After(since) {
+			late++
+			if oldest.IsZero() || inv.Bucket.Before(oldest) {
+				oldest = inv.Bucket
+			}
+		}
+	}
+
+	fields := []zap.Field{
+		zap.Int("buckets", len(invalidations)),
+		zap.Int("late_buckets", late),
+	}
+	for _, rollup := range repository.Rollups {
+		refreshed, err := r.repo.RefreshRollupBucketsTx(ctx, tx, rollup, invalidations)
+		if err != nil {
+			return 0, err
+		}
+		fields = append(fields, zap.Int64(rollup.Name, refreshed))
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	if late > 0 {
+		metrics.RollupLateBuckets.Add(float64(late))
+		r.logger.Warn("refreshed rollup buckets changed past the lookback",
+			zap.Int("late_buckets", late),
+			zap.Time("oldest_bucket", oldest),
+			zap.Duration("lookback", r.cfg.Lookback),
+		)
+	}
+	if len(invalidations) > 0 {
+		r.logger.Debug("reading rollups refreshed", fields...)
+	}
+
+	return len(invalidations), nil
+}
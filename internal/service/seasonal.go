@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/anomaly"
+	"github.com/septivank/energy-metering-worker/internal/cache"
+	"github.com/septivank/energy-metering-worker/internal/db"
+)
+
+// SeasonalStatSource loads the stored statistics of a seasonal bucket
+type SeasonalStatSource interface {
+	GetSeasonalStat(ctx context.Context, clientID uuid.UUID, metricName string, bucket int) (db.SeasonalStat, bool, error)
+}
+
+// SeasonalCache serves seasonal bucket statistics to the seasonal detector.
+// A bucket only changes by a few readings per hour, so lookups, including
+// misses, are cached for a TTL instead of being kept in sync.
+type SeasonalCache struct {
+	source SeasonalStatSource
+
+	mu      sync.Mutex
+	entries *cache.LRU[seasonalKey, seasonalEntry]
+}
+
+type seasonalKey struct {
+	clientID   uuid.UUID
+	metricName string
+	bucket     int
+}
+
+type seasonalEntry struct {
+	stats anomaly.SeasonalStats
+	ok    bool
+}
+
+// NewSeasonalCache creates a seasonal statistics cache
+func NewSeasonalCache(source SeasonalStatSource, maxEntries int, ttl time.Duration) *SeasonalCache {
+	return &SeasonalCache{
+		source:  source,
+		entries: cache.NewLRU[seasonalKey, seasonalEntry](maxEntries, ttl),
+	}
+}
+
+// SeasonalStats implements anomaly.SeasonalSource
+func (c *SeasonalCache) SeasonalStats(ctx context.Context, clientID uuid.UUID, metricName string, bucket int) (anomaly.SeasonalStats, bool, error) {
+	key := seasonalKey{clientID, metricName, bucket}
+
+	c.mu.Lock()
+	entry, hit := c.entries.Get(key)
+	c.mu.Unlock()
+	if hit {
+		return entry.stats, entry.ok, nil
+	}
+
+	stat, ok, err := c.source.GetSeasonalStat(ctx, clientID, metricName, bucket)
+	if err != nil {
+		return anomaly.SeasonalStats{}, false, err
+	}
+
+	entry = seasonalEntry{
+		stats: anomaly.SeasonalStats{Count: stat.Count, Mean: stat.Mean, M2: stat.M2},
+		ok:    ok,
+	}
+	c.mu.Lock()
+	c.entries.Set(key, entry)
+	c.mu.Unlock()
+
+	return entry.stats, entry.ok, nil
+}
+
+// SeasonalDeltas summarizes readings into per-bucket batch statistics with
+// Welford's algorithm, ready to be merged into the stored statistics
+func SeasonalDeltas(readings []*db.MeterReading, loc *time.Location) []db.SeasonalStat {
+	type key struct {
+		clientID   uuid.UUID
+		metricName string
+		bucket     int
+	}
+
+	index := make(map[key]int)
+	var deltas []db.SeasonalStat
+	for _, reading := range readings {
+		k := key{reading.ClientID, reading.MetricName, anomaly.HourOfWeek(reading.ReadingTimestamp, loc)}
+		i, ok := index[k]
+		if !ok {
+			i = len(deltas)
+			index[k] = i
+			deltas = append(deltas, db.SeasonalStat{ClientID: k.clientID, MetricName: k.metricName, Bucket: k.bucket})
+		}
+
+		d := &deltas[i]
+		d.Count++
+		diff := reading.MetricValue - d.Mean
+		d.Mean += diff / float64(d.Count)
+		d.M2 += diff * (reading.MetricValue - d.Mean)
+	}
+	return deltas
+}
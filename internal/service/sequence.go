@@ -0,0 +1,89 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/db"
+)
+
+// chainReadings visits the valid readings selected by include in timestamp
+// order, passing each the previous point of its metric: the newest earlier
+// point of history, or the last earlier reading of the message that stayed
+// valid after its visit. previous is nil when there is none.
+func chainReadings(
+	readings []*db.MeterReading,
+	history map[string][]db.MetricPoint,
+	include func(reading *db.MeterReading) bool,
+	visit func(reading *db.MeterReading, previous *db.MetricPoint),
+) {
+	var order []int
+	for i, reading := range readings {
+		if reading.ValidationStatus == "valid" && include(reading) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return readings[order[a]].ReadingTimestamp.Before(readings[order[b]].ReadingTimestamp)
+	})
+
+	last := make(map[string]db.MetricPoint)
+	for _, i := range order {
+		reading := readings[i]
+
+		var previous *db.MetricPoint
+		if p, ok := previousPoint(history[reading.MetricName], reading.ReadingTimestamp); ok {
+			previous = &p
+		}
+		if p, ok := last[reading.MetricName]; ok && p.Timestamp.Before(reading.ReadingTimestamp) {
+			previous = &p
+		}
+
+		visit(reading, previous)
+
+		if reading.ValidationStatus == "valid" {
+			last[reading.MetricName] = db.MetricPoint{Value: reading.MetricValue, Timestamp: reading.ReadingTimestamp}
+		}
+	}
+}
+
+// previousPoint returns the newest point of a newest-first series taken
+// before t
+func previousPoint(points []db.MetricPoint, t time.Time) (db.MetricPoint, bool) {
+	for _, p := range points {
+		if p.Timestamp.Before(t) {
+			return p, true
+		}
+	}
+	return db.MetricPoint{}, false
+}
+
+// checkRates marks valid readings that changed faster than the
+// max_rate_per_hour of their validation rule invalid. Counters are judged
+// on their consumption delta, so a rollover or reset is not a jump.
+func (s *ProcessorService) checkRates(readings []*db.MeterReading, history map[string][]db.MetricPoint) {
+	if !s.validator.HasRateRules() {
+		return
+	}
+
+	chainReadings(readings, history,
+		func(reading *db.MeterReading) bool { return true },
+		func(reading *db.MeterReading, previous *db.MetricPoint) {
+			if previous == nil {
+				return
+			}
+			change := reading.MetricValue - previous.Value
+			if reading.DeltaValue != nil {
+				change = *reading.DeltaValue
+			}
+
+			result := s.validator.ValidateRate(reading.MetricName, change, reading.ReadingTimestamp.Sub(previous.Timestamp))
+			if !result.IsValid {
+				reading.ValidationStatus = "invalid"
+				reading.AnomalyReason = &result.AnomalyReason
+				reading.DeltaValue = nil
+				reading.CounterEvent = nil
+			}
+		},
+	)
+}
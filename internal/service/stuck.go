@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/anomaly"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// stuckTransition is the latest stuck-meter verdict of a client metric
+// within one message
+type stuckTransition struct {
+	reading *db.MeterReading
+	finding *anomaly.Finding // nil when the metric is no longer stuck
+}
+
+// stuckTransitions picks, per metric, the newest stored reading that went
+// through anomaly detection and the stuck meter finding it raised, if any.
+// checked holds the findings of every detected reading by index.
+func stuckTransitions(readings []*db.MeterReading, inserted []bool, checked map[int][]anomaly.Finding) map[string]stuckTransition {
+	transitions := make(map[string]stuckTransition)
+	for i, reading := range readings {
+		findings, ok := checked[i]
+		if !ok || !inserted[i] {
+			continue
+		}
+		if prev, seen := transitions[reading.MetricName]; seen && prev.reading.ReadingTimestamp.After(reading.ReadingTimestamp) {
+			continue
+		}
+
+		t := stuckTransition{reading: reading}
+		for j := range findings {
+			if findings[j].Code == anomaly.CodeStuckMeter {
+				t.finding = &findings[j]
+				break
+			}
+		}
+		transitions[reading.MetricName] = t
+	}
+	return transitions
+}
+
+// trackStuckMeters opens and closes stuck episodes within the reading
+// transaction and returns a meter.stuck event for every episode that
+// started with this message
+func trackStuckMeters(
+	ctx context.Context,
+	repo *repository.Repository,
+	tx repository.Tx,
+	clientID uuid.UUID,
+	transitions map[string]stuckTransition,
+	routingKey string,
+	logger *zap.Logger,
+) ([]db.OutboxEvent, error) {
+	var cleared []string
+	var events []db.OutboxEvent
+
+	for metricName, t := range transitions {
+		if t.finding == nil {
+			cleared = append(cleared, metricName)
+			continue
+		}
+
+		since, _ := t.finding.Details[anomaly.DetailStuckSince].(time.Time)
+		runLength, _ := t.finding.Details[anomaly.DetailRunLength].(int)
+
+		started, err := repo.MarkMetricStuckTx(ctx, tx, clientID, metricName, t.reading.MetricValue, since)
+		if err != nil {
+			return nil, err
+		}
+		if !started {
+			continue
+		}
+
+		logger.Warn("meter stuck",
+			zap.String("metric_name", metricName),
+			zap.Float64("value", t.reading.MetricValue),
+			zap.Time("stuck_since", since),
+			zap.Int("run_length", runLength),
+		)
+
+		payload, err := json.Marshal(mq.MeterStuckEvent{
+			ClientID:         clientID.String(),
+			MetricName:       metricName,
+			MetricValue:      t.reading.MetricValue,
+			StuckSince:       since.Format(time.RFC3339),
+			ReadingTimestamp: t.reading.ReadingTimestamp.Format(time.RFC3339),
+			RunLength:        runLength,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal stuck event: %w", err)
+		}
+		events = append(events, db.OutboxEvent{
+			RoutingKey:   routingKey,
+			Payload:      payload,
+			TraceContext: tracing.InjectMap(ctx),
+		})
+	}
+
+	if err := repo.ClearStuckMetricsTx(ctx, tx, clientID, cleared); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// AMQPCarrier adapts AMQP message headers to a propagation.TextMapCarrier
+type AMQPCarrier amqp.Table
+
+// Get returns the header value for key, or "" if it is missing or not a string
+func (c AMQPCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+// Set stores a header value
+func (c AMQPCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys lists the header names
+func (c AMQPCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ExtractAMQP returns ctx with the trace context carried by headers
+func ExtractAMQP(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, AMQPCarrier(headers))
+}
+
+// InjectAMQP writes the trace context of ctx into headers, allocating them
+// if needed, and returns the headers
+func InjectAMQP(ctx context.Context, headers amqp.Table) amqp.Table {
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, AMQPCarrier(headers))
+	return headers
+}
+
+// InjectMap returns the trace context of ctx as a string map, suitable for
+// storing alongside an outbox event. It returns nil when ctx carries none.
+func InjectMap(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// ExtractMap returns ctx with the trace context stored in m
+func ExtractMap(ctx context.Context, m map[string]string) context.Context {
+	if len(m) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(m))
+}
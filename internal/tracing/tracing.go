@@ -0,0 +1,117 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// Exporter names accepted by TRACING_EXPORTER
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// instrumentationName identifies the spans created by this module
+const instrumentationName = "github.com/septivank/energy-metering-worker"
+
+// Tracer returns the tracer used by the worker packages. It resolves through
+// the global provider, so spans started before Setup ran are no-ops.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator, and flushes pending spans on shutdown. With the "none"
+// exporter only propagation is enabled, so trace context still flows
+// through AMQP headers and the outbox.
+func Setup(lc fx.Lifecycle, cfg *config.Config, logger *zap.Logger) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if cfg.Tracing.Exporter == ExporterNone {
+		logger.Info("tracing export disabled")
+		return nil
+	}
+
+	exporter, err := NewExporter(context.Background(), cfg.Tracing.Exporter, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to build tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	logger.Info("tracing enabled",
+		zap.String("exporter", cfg.Tracing.Exporter),
+		zap.Float64("sample_ratio", cfg.Tracing.SampleRatio),
+	)
+
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			return provider.Shutdown(ctx)
+		},
+	})
+
+	return nil
+}
+
+// NewExporter creates a span exporter by name. The OTLP exporter is
+// configured through the standard OTEL_EXPORTER_OTLP_* environment
+// variables; the stdout exporter writes to w.
+func NewExporter(ctx context.Context, name string, w io.Writer) (sdktrace.SpanExporter, error) {
+	switch name {
+	case ExporterOTLP:
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		return exporter, nil
+	case ExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+		}
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", name)
+	}
+}
+
+// RecordError marks span as failed with err
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,136 @@
+package validator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultConsistencyTolerance applies to rules that do not state one
+const defaultConsistencyTolerance = 0.05
+
+// ConsistencyRule states that two expressions over metrics reported at the
+// same instant must agree, e.g. "active_power = voltage * current *
+// power_factor ~ 5%". The tolerance after "~" is relative when it ends in
+// "%" and absolute otherwise; it defaults to 5%.
+type ConsistencyRule struct {
+	Source  string   // rule as configured
+	Metrics []string // metrics referenced on either side
+
+	lhs, rhs  expr
+	lhsSource string
+	rhsSource string
+	tolerance float64
+	relative  bool
+}
+
+// ParseConsistencyRule parses a rule of the form "lhs = rhs [~ tolerance]"
+func ParseConsistencyRule(src string) (*ConsistencyRule, error) {
+	rule := &ConsistencyRule{Source: strings.TrimSpace(src), tolerance: defaultConsistencyTolerance, relative: true}
+
+	formula := rule.Source
+	if i := strings.LastIndex(formula, "~"); i >= 0 {
+		tol := strings.TrimSpace(formula[i+1:])
+		formula = formula[:i]
+
+		rule.relative = strings.HasSuffix(tol, "%")
+		value, err := strconv.ParseFloat(strings.TrimSuffix(tol, "%"), 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid tolerance %q in consistency rule %q", tol, src)
+		}
+		if rule.relative {
+			value /= 100
+		}
+		rule.tolerance = value
+	}
+
+	sides := strings.Split(formula, "=")
+	if len(sides) != 2 {
+		return nil, fmt.Errorf("consistency rule %q must have exactly one =", src)
+	}
+	rule.lhsSource = strings.TrimSpace(sides[0])
+	rule.rhsSource = strings.TrimSpace(sides[1])
+
+	lhs, lhsVars, err := parseExpr(rule.lhsSource)
+	if err != nil {
+		return nil, fmt.Errorf("invalid left side of consistency rule %q: %w", src, err)
+	}
+	rhs, rhsVars, err := parseExpr(rule.rhsSource)
+	if err != nil {
+		return nil, fmt.Errorf("invalid right side of consistency rule %q: %w", src, err)
+	}
+	rule.lhs, rule.rhs = lhs, rhs
+
+	seen := make(map[string]bool)
+	for _, name := range append(lhsVars, rhsVars...) {
+		if !seen[name] {
+			seen[name] = true
+			rule.Metrics = append(rule.Metrics, name)
+		}
+	}
+	if len(rule.Metrics) == 0 {
+		return nil, fmt.Errorf("consistency rule %q does not reference any metric", src)
+	}
+
+	return rule, nil
+}
+
+// Check evaluates the rule against the metric values of one instant. ok is
+// false when the values disagree; rules whose metrics are not all present,
+// or that do not evaluate to finite numbers, pass.
+func (r *ConsistencyRule) Check(values map[string]float64) (reason string, ok bool) {
+	for _, name := range r.Metrics {
+		if _, present := values[name]; !present {
+			return "", true
+		}
+	}
+
+	l, rv := r.lhs.eval(values), r.rhs.eval(values)
+	if math.IsNaN(l) || math.IsInf(l, 0) || math.IsNaN(rv) || math.IsInf(rv, 0) {
+		return "", true
+	}
+
+	allowed := r.tolerance
+	if r.relative {
+		allowed *= math.Max(math.Abs(l), math.Abs(rv))
+	}
+	if math.Abs(l-rv) <= allowed {
+		return "", true
+	}
+
+	return fmt.Sprintf("inconsistent metrics: %s = %.2f vs %s = %.2f (tolerance %s)",
+		r.lhsSource, l, r.rhsSource, rv, r.toleranceString()), false
+}
+
+func (r *ConsistencyRule) toleranceString() string {
+	if r.relative {
+		return strconv.FormatFloat(r.tolerance*100, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(r.tolerance, 'f', -1, 64)
+}
+
+// CheckConsistency evaluates every consistency rule against the metric
+// values reported at one instant. It returns, per metric, the reasons of
+// the rules it took part in and that failed.
+func (v *Validator) CheckConsistency(values map[string]float64) map[string][]string {
+	var violations map[string][]string
+	for _, rule := range v.consistency {
+		reason, ok := rule.Check(values)
+		if ok {
+			continue
+		}
+		if violations == nil {
+			violations = make(map[string][]string)
+		}
+		for _, name := range rule.Metrics {
+			violations[name] = append(violations[name], reason)
+		}
+	}
+	return violations
+}
+
+// HasConsistencyRules reports whether any consistency rule is configured
+func (v *Validator) HasConsistencyRules() bool {
+	return len(v.consistency) > 0
+}
@@ -0,0 +1,102 @@
+package validator
+
+import (
+	"fmt"
+	"path"
+)
+
+// Counter events recorded with a counter reading whose register wrapped or
+// restarted
+const (
+	CounterRollover = "rollover"
+	CounterReset    = "reset"
+)
+
+// rolloverWindow is the fraction at the top and bottom of the register
+// within which a backwards move is read as a rollover
+const rolloverWindow = 0.1
+
+// CounterConfig describes which metrics are cumulative counters (e.g. kWh
+// totalizers) and how their registers behave
+type CounterConfig struct {
+	Metrics     []string // glob patterns of counter metric names
+	RolloverMax float64  // register maximum; 0 disables rollover detection
+	ResetMax    float64  // a backwards move to at most this value is a meter reset
+}
+
+// CounterResult holds the outcome of checking a counter reading against the
+// previous value of its register
+type CounterResult struct {
+	ValidationResult
+	Delta *float64 // consumption since the previous reading, nil when unknown
+	Event string   // CounterRollover, CounterReset or empty
+}
+
+// validate checks the counter patterns and register bounds
+func (c CounterConfig) validate() error {
+	for _, pattern := range c.Metrics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid counter metric pattern %q: %w", pattern, err)
+		}
+	}
+	if c.RolloverMax < 0 || c.ResetMax < 0 {
+		return fmt.Errorf("counter rollover and reset maximums must not be negative")
+	}
+	if c.RolloverMax > 0 && c.ResetMax >= c.RolloverMax {
+		return fmt.Errorf("counter reset maximum %.2f must be below rollover maximum %.2f", c.ResetMax, c.RolloverMax)
+	}
+	return nil
+}
+
+// IsCounter reports whether name is a cumulative counter metric
+func (v *Validator) IsCounter(name string) bool {
+	for _, pattern := range v.counters.Metrics {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateCounter checks a counter value against the previous value of the
+// same register, nil when there is none. A backwards move is accepted as a
+// rollover when the register wrapped around RolloverMax, as a reset when it
+// restarted near zero, and rejected otherwise.
+func (v *Validator) ValidateCounter(value float64, previous *float64) CounterResult {
+	result := CounterResult{ValidationResult: ValidationResult{IsValid: true}}
+
+	if v.counters.RolloverMax > 0 && value > v.counters.RolloverMax {
+		result.IsValid = false
+		result.AnomalyReason = fmt.Sprintf("counter value above register maximum: value %.2f exceeds %.2f",
+			value, v.counters.RolloverMax)
+		return result
+	}
+
+	if previous == nil {
+		return result
+	}
+
+	prev := *previous
+	if value >= prev {
+		delta := value - prev
+		result.Delta = &delta
+		return result
+	}
+
+	window := v.counters.RolloverMax * rolloverWindow
+	switch {
+	case v.counters.RolloverMax > 0 && prev >= v.counters.RolloverMax-window && value <= window:
+		delta := v.counters.RolloverMax - prev + value
+		result.Delta = &delta
+		result.Event = CounterRollover
+	case value <= v.counters.ResetMax:
+		delta := value
+		result.Delta = &delta
+		result.Event = CounterReset
+	default:
+		result.IsValid = false
+		result.AnomalyReason = fmt.Sprintf("counter went backwards: value %.2f below previous %.2f", value, prev)
+	}
+
+	return result
+}
@@ -0,0 +1,210 @@
+package validator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is a parsed arithmetic expression over metric values
+type expr interface {
+	eval(values map[string]float64) float64
+}
+
+type (
+	number   float64
+	variable string
+	negate   struct{ x expr }
+	binary   struct {
+		op   byte
+		l, r expr
+	}
+	call struct {
+		fn func(float64) float64
+		x  expr
+	}
+)
+
+func (n number) eval(map[string]float64) float64 { return float64(n) }
+
+func (v variable) eval(values map[string]float64) float64 { return values[string(v)] }
+
+func (n negate) eval(values map[string]float64) float64 { return -n.x.eval(values) }
+
+func (c call) eval(values map[string]float64) float64 { return c.fn(c.x.eval(values)) }
+
+func (b binary) eval(values map[string]float64) float64 {
+	l, r := b.l.eval(values), b.r.eval(values)
+	switch b.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	default:
+		return l / r
+	}
+}
+
+// functions are the unary functions formulas may call
+var functions = map[string]func(float64) float64{
+	"abs":  math.Abs,
+	"sqrt": math.Sqrt,
+}
+
+// parseExpr parses an expression of numbers, metric names, + - * /,
+// parentheses and the functions above. It also returns the metric names the
+// expression refers to.
+func parseExpr(src string) (expr, []string, error) {
+	p := &exprParser{src: src, vars: make(map[string]bool)}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, nil, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos], p.pos)
+	}
+
+	return e, p.order, nil
+}
+
+// exprParser is a recursive descent parser:
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | name | name "(" sum ")" | "(" sum ")"
+type exprParser struct {
+	src   string
+	pos   int
+	vars  map[string]bool
+	order []string
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (expr, error) {
+	l, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseProduct() (expr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negate{x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+	case c == '.' || isDigit(c):
+		start := p.pos
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return number(v), nil
+	case isNameStart(c):
+		start := p.pos
+		for p.pos < len(p.src) && isNamePart(p.src[p.pos]) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+
+		if p.peek() == '(' {
+			fn, ok := functions[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown function %q", name)
+			}
+			p.pos++
+			x, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			if p.peek() != ')' {
+				return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+			}
+			p.pos++
+			return call{fn: fn, x: x}, nil
+		}
+
+		if !p.vars[name] {
+			p.vars[name] = true
+			p.order = append(p.order, name)
+		}
+		return variable(name), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, p.pos)
+	}
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isNameStart(c byte) bool { return c == '_' || unicode.IsLetter(rune(c)) }
+
+func isNamePart(c byte) bool { return isNameStart(c) || isDigit(c) || c == '.' }
@@ -0,0 +1,186 @@
+package validator
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule declares the validation limits of the metrics whose names match one
+// of its patterns. Unset limits are not checked.
+type Rule struct {
+	ID             string   `yaml:"id" json:"id"`
+	Metrics        []string `yaml:"metrics" json:"metrics"` // glob patterns of metric names
+	Min            *float64 `yaml:"min" json:"min"`
+	Max            *float64 `yaml:"max" json:"max"`
+	Units          []string `yaml:"units" json:"units"`                   // allowed units, case-insensitive
+	AllowNegative  bool     `yaml:"allow_negative" json:"allow_negative"` // e.g. export power, power factor
+	MaxRatePerHour *float64 `yaml:"max_rate_per_hour" json:"max_rate_per_hour"`
+	Precision      *int     `yaml:"precision" json:"precision"` // maximum decimal places reported
+}
+
+// rulesFile is the layout of a validation rules file
+type rulesFile struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+// LoadRules reads validation rules from a YAML or JSON file
+func LoadRules(filename string) ([]Rule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validation rules: %w", err)
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses validation rules from YAML or JSON (a subset of YAML)
+// and checks them
+func ParseRules(data []byte) ([]Rule, error) {
+	var file rulesFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse validation rules: %w", err)
+	}
+
+	ids := make(map[string]bool)
+	for i, rule := range file.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid validation rule #%d: %w", i+1, err)
+		}
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("validation rule %q defined twice", rule.ID)
+		}
+		ids[rule.ID] = true
+	}
+
+	return file.Rules, nil
+}
+
+func (r Rule) validate() error {
+	if r.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	if len(r.Metrics) == 0 {
+		return fmt.Errorf("rule %q: metrics is required", r.ID)
+	}
+	for _, pattern := range r.Metrics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("rule %q: invalid metric pattern %q: %w", r.ID, pattern, err)
+		}
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return fmt.Errorf("rule %q: min %.2f above max %.2f", r.ID, *r.Min, *r.Max)
+	}
+	if r.MaxRatePerHour != nil && *r.MaxRatePerHour <= 0 {
+		return fmt.Errorf("rule %q: max_rate_per_hour must be positive", r.ID)
+	}
+	if r.Precision != nil && *r.Precision < 0 {
+		return fmt.Errorf("rule %q: precision must not be negative", r.ID)
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to metric name
+func (r *Rule) matches(name string) bool {
+	for _, pattern := range r.Metrics {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleFor returns the first rule, in file order, matching metric name, or
+// nil when none does
+func (v *Validator) RuleFor(name string) *Rule {
+	for i := range v.rules {
+		if v.rules[i].matches(name) {
+			return &v.rules[i]
+		}
+	}
+	return nil
+}
+
+// check applies the static limits of rule to a parsed value. raw is the
+// reported value, used to count decimal places.
+func (r *Rule) check(value float64, raw, unit string) (string, bool) {
+	if len(r.Units) > 0 && unit != "" && !slices.ContainsFunc(r.Units, func(u string) bool {
+		return strings.EqualFold(u, unit)
+	}) {
+		return r.reason("unit %q not allowed (%s)", unit, strings.Join(r.Units, ", ")), false
+	}
+	if value < 0 && !r.AllowNegative {
+		return r.reason("negative value detected"), false
+	}
+	if r.Min != nil && value < *r.Min {
+		return r.reason("value %.2f below minimum %.2f", value, *r.Min), false
+	}
+	if r.Max != nil && value > *r.Max {
+		return r.reason("value %.2f above maximum %.2f", value, *r.Max), false
+	}
+	if r.Precision != nil {
+		if decimals := decimalPlaces(raw); decimals > *r.Precision {
+			return r.reason("value %s has %d decimal places, at most %d allowed", raw, decimals, *r.Precision), false
+		}
+	}
+	return "", true
+}
+
+// ValidateRate checks the change of a metric since its previous reading
+// against the max_rate_per_hour of its rule. change is the difference to
+// the previous value, or the consumption delta of a counter.
+func (v *Validator) ValidateRate(name string, change float64, elapsed time.Duration) ValidationResult {
+	result := ValidationResult{IsValid: true}
+
+	rule := v.RuleFor(name)
+	if rule == nil || rule.MaxRatePerHour == nil || elapsed <= 0 {
+		return result
+	}
+
+	rate := math.Abs(change) / elapsed.Hours()
+	if rate > *rule.MaxRatePerHour {
+		result.IsValid = false
+		result.AnomalyReason = rule.reason("rate of change %.2f/h exceeds %.2f/h", rate, *rule.MaxRatePerHour)
+	}
+	return result
+}
+
+// AllowsNegative reports whether the rule of metric name accepts negative
+// values
+func (v *Validator) AllowsNegative(name string) bool {
+	rule := v.RuleFor(name)
+	return rule != nil && rule.AllowNegative
+}
+
+// HasRateRules reports whether any rule limits the rate of change
+func (v *Validator) HasRateRules() bool {
+	for _, rule := range v.rules {
+		if rule.MaxRatePerHour != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// reason formats a violation of the rule, prefixed with its ID
+func (r *Rule) reason(format string, args ...any) string {
+	return fmt.Sprintf("rule %s: ", r.ID) + fmt.Sprintf(format, args...)
+}
+
+// decimalPlaces counts the digits after the decimal point of a reported value
+func decimalPlaces(raw string) int {
+	i := strings.IndexByte(raw, '.')
+	if i < 0 {
+		return 0
+	}
+	digits := raw[i+1:]
+	if j := strings.IndexAny(digits, "eE"); j >= 0 {
+		digits = digits[:j]
+	}
+	return len(digits)
+}
@@ -20,11 +20,23 @@ type MetricData struct {
 	Date string
 	Data string
 	Name string
+	Unit string // optional unit reported by the meter
 }
 
 // Validator handles metric validation with configurable parameters
 type Validator struct {
 	timestampToleranceMinutes int
+	counters                  CounterConfig
+	consistency               []*ConsistencyRule
+	rules                     []Rule
+}
+
+// Config holds the optional checks of a validator beyond the per-reading
+// basics
+type Config struct {
+	Counters         CounterConfig
+	ConsistencyRules []string // cross-metric rules, see ParseConsistencyRule
+	Rules            []Rule   // per-metric rules, first match applies
 }
 
 // NewValidator creates a new validator with the specified tolerance
@@ -34,6 +46,26 @@ func NewValidator(timestampToleranceMinutes int) *Validator {
 	}
 }
 
+// NewValidatorWithConfig creates a validator that also runs the checks
+// configured in cfg
+func NewValidatorWithConfig(timestampToleranceMinutes int, cfg Config) (*Validator, error) {
+	if err := cfg.Counters.validate(); err != nil {
+		return nil, err
+	}
+
+	v := NewValidator(timestampToleranceMinutes)
+	v.counters = cfg.Counters
+	v.rules = cfg.Rules
+	for _, src := range cfg.ConsistencyRules {
+		rule, err := ParseConsistencyRule(src)
+		if err != nil {
+			return nil, err
+		}
+		v.consistency = append(v.consistency, rule)
+	}
+	return v, nil
+}
+
 // ValidateMetricData validates a single metric reading
 func (v *Validator) ValidateMetricData(metric MetricData, receivedAt time.Time) (float64, time.Time, ValidationResult) {
 	result := ValidationResult{IsValid: true}
@@ -55,7 +87,15 @@ func (v *Validator) ValidateMetricData(metric MetricData, receivedAt time.Time)
 		return 0, time.Time{}, result
 	}
 
-	if value < 0 {
+	// Apply the metric's declared rule, if any; without one negative values
+	// are rejected
+	if rule := v.RuleFor(metric.Name); rule != nil {
+		if reason, ok := rule.check(value, dataValue, metric.Unit); !ok {
+			result.IsValid = false
+			result.AnomalyReason = reason
+			return value, time.Time{}, result
+		}
+	} else if value < 0 {
 		result.IsValid = false
 		result.AnomalyReason = "negative value detected"
 		return value, time.Time{}, result
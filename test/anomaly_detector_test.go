@@ -1,6 +1,7 @@
 package anomaly_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/septivank/energy-metering-worker/internal/anomaly"
@@ -95,3 +96,17 @@ func TestDetectAnomaly_ZeroAverage(t *testing.T) {
 		t.Error("Should not detect spike when historical average is 0")
 	}
 }
+
+func TestCheck_AllowNegative(t *testing.T) {
+	detector := anomaly.NewDetector(testSpikeThreshold, testMinDataPointsForDetection)
+
+	candidate := anomaly.Candidate{MetricName: "export_power", Value: -250}
+	if findings := detector.Check(context.Background(), nil, candidate); len(findings) != 1 {
+		t.Errorf("Expected negative value finding, got %+v", findings)
+	}
+
+	candidate.AllowNegative = true
+	if findings := detector.Check(context.Background(), nil, candidate); len(findings) != 0 {
+		t.Errorf("Expected negative value to be allowed, got %+v", findings)
+	}
+}
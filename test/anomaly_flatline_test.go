@@ -0,0 +1,113 @@
+package anomaly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/anomaly"
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+var flatlineStart = time.Date(2025, 12, 29, 10, 0, 0, 0, time.UTC)
+
+// timedSeries builds a newest-first series of readings taken every step,
+// the newest one step before the candidate at flatlineStart
+func timedSeries(step time.Duration, values ...float64) anomaly.Series {
+	series := make(anomaly.Series, len(values))
+	for i, v := range values {
+		series[i] = anomaly.Point{Value: v, Timestamp: flatlineStart.Add(-time.Duration(i+1) * step)}
+	}
+	return series
+}
+
+func checkFlatline(d *anomaly.FlatlineDetector, metric string, series anomaly.Series, value float64) []anomaly.Finding {
+	return d.Check(context.Background(), series, anomaly.Candidate{
+		MetricName: metric,
+		Value:      value,
+		Timestamp:  flatlineStart,
+	})
+}
+
+func TestFlatline_FlagsRunOfIdenticalValues(t *testing.T) {
+	d, err := anomaly.NewFlatlineDetector(4, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	findings := checkFlatline(d, "voltage", timedSeries(time.Minute, 220, 220, 220, 219, 221), 220)
+	expectCode(t, findings, anomaly.CodeStuckMeter)
+
+	f := findings[0]
+	if f.Details[anomaly.DetailRunLength] != 4 {
+		t.Errorf("Expected run length 4, got %v", f.Details[anomaly.DetailRunLength])
+	}
+	if since := f.Details[anomaly.DetailStuckSince]; since != flatlineStart.Add(-3*time.Minute) {
+		t.Errorf("Expected stuck since the oldest repeated reading, got %v", since)
+	}
+}
+
+func TestFlatline_IgnoresShortRun(t *testing.T) {
+	d, _ := anomaly.NewFlatlineDetector(4, 0, 0, nil)
+
+	if findings := checkFlatline(d, "voltage", timedSeries(time.Minute, 220, 220, 219, 221), 220); len(findings) != 0 {
+		t.Errorf("Expected run of 3 to pass, got %+v", findings)
+	}
+	if findings := checkFlatline(d, "voltage", timedSeries(time.Minute, 220, 220, 220), 221); len(findings) != 0 {
+		t.Errorf("Expected changed value to pass, got %+v", findings)
+	}
+}
+
+func TestFlatline_Epsilon(t *testing.T) {
+	d, _ := anomaly.NewFlatlineDetector(4, 0, 0.05, nil)
+
+	series := timedSeries(time.Minute, 220.01, 219.98, 220.03, 215)
+	expectCode(t, checkFlatline(d, "voltage", series, 220), anomaly.CodeStuckMeter)
+}
+
+func TestFlatline_Duration(t *testing.T) {
+	d, _ := anomaly.NewFlatlineDetector(10, 2*time.Hour, 0, nil)
+
+	// Two repeats an hour apart span two hours
+	expectCode(t, checkFlatline(d, "energy", timedSeries(time.Hour, 1500, 1500, 1490), 1500), anomaly.CodeStuckMeter)
+
+	if findings := checkFlatline(d, "energy", timedSeries(time.Minute, 1500, 1500, 1490), 1500); len(findings) != 0 {
+		t.Errorf("Expected a short run to pass, got %+v", findings)
+	}
+}
+
+func TestFlatline_ExemptMetrics(t *testing.T) {
+	d, err := anomaly.NewFlatlineDetector(3, 0, 0, []string{"status*", "*_flag"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	series := timedSeries(time.Minute, 1, 1, 1, 1)
+	for _, metric := range []string{"status", "status_breaker", "door_flag"} {
+		if findings := checkFlatline(d, metric, series, 1); len(findings) != 0 {
+			t.Errorf("Expected %s to be exempt, got %+v", metric, findings)
+		}
+	}
+	expectCode(t, checkFlatline(d, "voltage", series, 1), anomaly.CodeStuckMeter)
+}
+
+func TestFlatline_InvalidConfig(t *testing.T) {
+	if _, err := anomaly.NewFlatlineDetector(1, 0, 0, nil); err == nil {
+		t.Error("Expected error for minimum points below 2")
+	}
+	if _, err := anomaly.NewFlatlineDetector(3, 0, -1, nil); err == nil {
+		t.Error("Expected error for negative epsilon")
+	}
+	if _, err := anomaly.NewFlatlineDetector(3, 0, 0, []string{"[status"}); err == nil {
+		t.Error("Expected error for malformed exemption pattern")
+	}
+
+	_, err := anomaly.NewChainFromConfig(config.AnomalyConfig{
+		Detectors:         []string{"flatline"},
+		HistoryWindow:     5,
+		FlatlineMinPoints: 10,
+	}, anomaly.Deps{})
+	if err == nil {
+		t.Error("Expected error when the history window cannot hold the run")
+	}
+}
@@ -0,0 +1,165 @@
+package anomaly_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/anomaly"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/service"
+)
+
+type fakeSeasonalSource map[int]anomaly.SeasonalStats
+
+func (f fakeSeasonalSource) SeasonalStats(ctx context.Context, clientID uuid.UUID, metricName string, bucket int) (anomaly.SeasonalStats, bool, error) {
+	stats, ok := f[bucket]
+	return stats, ok, nil
+}
+
+// statsOf builds seasonal statistics from raw samples
+func statsOf(values ...float64) anomaly.SeasonalStats {
+	var s anomaly.SeasonalStats
+	for _, v := range values {
+		s.Count++
+		diff := v - s.Mean
+		s.Mean += diff / float64(s.Count)
+		s.M2 += diff * (v - s.Mean)
+	}
+	return s
+}
+
+func TestHourOfWeek(t *testing.T) {
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		t        time.Time
+		loc      *time.Location
+		expected int
+	}{
+		{"sunday midnight", time.Date(2025, 12, 28, 0, 30, 0, 0, time.UTC), time.UTC, 0},
+		{"monday 14:00", time.Date(2025, 12, 29, 14, 0, 0, 0, time.UTC), time.UTC, 38},
+		{"saturday last hour", time.Date(2026, 1, 3, 23, 59, 0, 0, time.UTC), time.UTC, 167},
+		{"converted to site time", time.Date(2025, 12, 28, 20, 0, 0, 0, time.UTC), jakarta, 27},
+		{"nil location is UTC", time.Date(2025, 12, 29, 14, 0, 0, 0, time.UTC), nil, 38},
+	}
+
+	for _, tt := range tests {
+		if got := anomaly.HourOfWeek(tt.t, tt.loc); got != tt.expected {
+			t.Errorf("%s: expected bucket %d, got %d", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestSeasonalDetector_ComparesSameHourOfWeek(t *testing.T) {
+	afternoon := time.Date(2025, 12, 29, 14, 15, 0, 0, time.UTC) // Monday 14:00
+	night := time.Date(2025, 12, 29, 3, 15, 0, 0, time.UTC)      // Monday 03:00
+
+	source := fakeSeasonalSource{
+		anomaly.HourOfWeek(afternoon, time.UTC): statsOf(500, 520, 480, 510, 495, 505, 490, 515),
+		anomaly.HourOfWeek(night, time.UTC):     statsOf(100, 102, 98, 101, 99, 103, 97, 100),
+	}
+	d, err := anomaly.NewSeasonalDetector(source, time.UTC, anomaly.Bounds{Upper: 3, Lower: 3}, 5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	check := func(ts time.Time, value float64) []anomaly.Finding {
+		return d.Check(context.Background(), nil, anomaly.Candidate{MetricName: "power", Value: value, Timestamp: ts})
+	}
+
+	if findings := check(afternoon, 505); len(findings) != 0 {
+		t.Errorf("Expected normal afternoon load to pass, got %+v", findings)
+	}
+	expectCode(t, check(night, 505), "seasonal_high")
+	expectCode(t, check(afternoon, 100), "seasonal_low")
+}
+
+func TestSeasonalDetector_SkipsSparseBuckets(t *testing.T) {
+	ts := time.Date(2025, 12, 29, 14, 15, 0, 0, time.UTC)
+	source := fakeSeasonalSource{
+		anomaly.HourOfWeek(ts, time.UTC): statsOf(500, 520, 480),
+	}
+	d, _ := anomaly.NewSeasonalDetector(source, time.UTC, anomaly.Bounds{Upper: 3, Lower: 3}, 5)
+
+	findings := d.Check(context.Background(), nil, anomaly.Candidate{Value: 5000, Timestamp: ts})
+	if len(findings) != 0 {
+		t.Errorf("Expected bucket below minimum samples to be skipped, got %+v", findings)
+	}
+
+	findings = d.Check(context.Background(), nil, anomaly.Candidate{Value: 5000, Timestamp: ts.Add(time.Hour)})
+	if len(findings) != 0 {
+		t.Errorf("Expected empty bucket to be skipped, got %+v", findings)
+	}
+}
+
+func TestSeasonalDeltas_MatchesDirectStatistics(t *testing.T) {
+	clientID := uuid.New()
+	base := time.Date(2025, 12, 29, 14, 0, 0, 0, time.UTC)
+	values := []float64{500, 520, 480, 510}
+
+	var readings []*db.MeterReading
+	for i, v := range values {
+		readings = append(readings, &db.MeterReading{
+			ClientID:         clientID,
+			MetricName:       "power",
+			MetricValue:      v,
+			ReadingTimestamp: base.Add(time.Duration(i) * 10 * time.Minute),
+		})
+	}
+	// Different hour, separate bucket
+	readings = append(readings, &db.MeterReading{
+		ClientID:         clientID,
+		MetricName:       "power",
+		MetricValue:      100,
+		ReadingTimestamp: base.Add(-10 * time.Hour),
+	})
+
+	deltas := service.SeasonalDeltas(readings, time.UTC)
+	if len(deltas) != 2 {
+		t.Fatalf("Expected 2 buckets, got %d", len(deltas))
+	}
+
+	d := deltas[0]
+	if d.Bucket != 38 || d.Count != 4 {
+		t.Errorf("Expected 4 samples in bucket 38, got %d in %d", d.Count, d.Bucket)
+	}
+	if math.Abs(d.Mean-502.5) > 1e-9 {
+		t.Errorf("Expected mean 502.5, got %v", d.Mean)
+	}
+	// Sum of squared deviations: 2.5² + 17.5² + 22.5² + 7.5²
+	if math.Abs(d.M2-875) > 1e-9 {
+		t.Errorf("Expected M2 875, got %v", d.M2)
+	}
+}
+
+type countingSeasonalSource struct {
+	calls int
+}
+
+func (c *countingSeasonalSource) GetSeasonalStat(ctx context.Context, clientID uuid.UUID, metricName string, bucket int) (db.SeasonalStat, bool, error) {
+	c.calls++
+	return db.SeasonalStat{}, false, nil
+}
+
+func TestSeasonalCache_CachesMisses(t *testing.T) {
+	source := &countingSeasonalSource{}
+	c := service.NewSeasonalCache(source, 100, time.Hour)
+	clientID := uuid.New()
+
+	for i := 0; i < 3; i++ {
+		if _, ok, err := c.SeasonalStats(context.Background(), clientID, "power", 38); err != nil || ok {
+			t.Fatalf("Expected empty bucket, got ok=%v err=%v", ok, err)
+		}
+	}
+
+	if source.calls != 1 {
+		t.Errorf("Expected 1 database lookup, got %d", source.calls)
+	}
+}
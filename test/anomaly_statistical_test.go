@@ -0,0 +1,169 @@
+package anomaly_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/anomaly"
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+// noisySeries is a stable baseline around 100, newest first
+var noisySeries = seriesOf(100, 102, 98, 101, 99, 103, 97, 100, 101, 99)
+
+func checkOne(t *testing.T, s anomaly.Strategy, series anomaly.Series, value float64) []anomaly.Finding {
+	t.Helper()
+	return s.Check(context.Background(), series, anomaly.Candidate{MetricName: "power", Value: value})
+}
+
+func expectCode(t *testing.T, findings []anomaly.Finding, code string) {
+	t.Helper()
+	if len(findings) != 1 {
+		t.Fatalf("Expected 1 finding with code %s, got %d", code, len(findings))
+	}
+	if findings[0].Code != code {
+		t.Errorf("Expected code %s, got %s", code, findings[0].Code)
+	}
+}
+
+func TestZScore_TwoSided(t *testing.T) {
+	d, err := anomaly.NewZScoreDetector(anomaly.Bounds{Upper: 3, Lower: 3}, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expectCode(t, checkOne(t, d, noisySeries, 130), "zscore_high")
+	expectCode(t, checkOne(t, d, noisySeries, 70), "zscore_low")
+
+	if findings := checkOne(t, d, noisySeries, 102); len(findings) != 0 {
+		t.Errorf("Expected no finding within band, got %+v", findings)
+	}
+}
+
+func TestZScore_DisabledLowerSide(t *testing.T) {
+	d, _ := anomaly.NewZScoreDetector(anomaly.Bounds{Upper: 3}, 3)
+
+	if findings := checkOne(t, d, noisySeries, 0); len(findings) != 0 {
+		t.Errorf("Expected drops to be ignored with lower threshold 0, got %+v", findings)
+	}
+}
+
+func TestZScore_SkipsFlatAndShortHistory(t *testing.T) {
+	d, _ := anomaly.NewZScoreDetector(anomaly.Bounds{Upper: 3, Lower: 3}, 3)
+
+	if findings := checkOne(t, d, seriesOf(100, 100, 100, 100), 150); len(findings) != 0 {
+		t.Errorf("Expected flat history to be skipped, got %+v", findings)
+	}
+	if findings := checkOne(t, d, seriesOf(100, 101), 150); len(findings) != 0 {
+		t.Errorf("Expected short history to be skipped, got %+v", findings)
+	}
+}
+
+func TestMAD_RobustToPreviousOutlier(t *testing.T) {
+	// A single earlier outlier inflates the mean and stddev enough to hide
+	// the new one from the mean-based rules
+	series := seriesOf(100, 101, 99, 900, 100, 102, 98, 101, 99, 100)
+
+	mad, _ := anomaly.NewMADDetector(anomaly.Bounds{Upper: 3.5, Lower: 3.5}, 3)
+	expectCode(t, checkOne(t, mad, series, 300), "mad_high")
+
+	zscore, _ := anomaly.NewZScoreDetector(anomaly.Bounds{Upper: 3, Lower: 3}, 3)
+	if findings := checkOne(t, zscore, series, 300); len(findings) != 0 {
+		t.Errorf("Expected z-score to be masked by the outlier, got %+v", findings)
+	}
+
+	spike := anomaly.NewDetector(testSpikeThreshold, testMinDataPointsForDetection)
+	if findings := checkOne(t, spike, series, 300); len(findings) != 0 {
+		t.Errorf("Expected spike rule to be masked by the outlier, got %+v", findings)
+	}
+}
+
+func TestMAD_DetectsDrop(t *testing.T) {
+	d, _ := anomaly.NewMADDetector(anomaly.Bounds{Upper: 3.5, Lower: 3.5}, 3)
+
+	findings := checkOne(t, d, noisySeries, 20)
+	expectCode(t, findings, "mad_low")
+	if findings[0].Severity != anomaly.SeverityCritical {
+		t.Errorf("Expected critical severity for a large drop, got %s", findings[0].Severity)
+	}
+	if findings[0].Score >= 0 {
+		t.Errorf("Expected negative score for a drop, got %.2f", findings[0].Score)
+	}
+}
+
+func TestMAD_SkipsZeroDeviation(t *testing.T) {
+	d, _ := anomaly.NewMADDetector(anomaly.Bounds{Upper: 3.5, Lower: 3.5}, 3)
+
+	if findings := checkOne(t, d, seriesOf(100, 100, 100, 100, 101), 150); len(findings) != 0 {
+		t.Errorf("Expected zero MAD to be skipped, got %+v", findings)
+	}
+}
+
+func TestEWMA_FollowsGradualDrift(t *testing.T) {
+	// Consumption ramps up steadily from 100 to 145; newest first
+	var values []float64
+	for v := 145.0; v >= 100; v -= 5 {
+		values = append(values, v+float64(int(v)%3)-1)
+	}
+	series := seriesOf(values...)
+
+	d, err := anomaly.NewEWMADetector(0.3, anomaly.Bounds{Upper: 3, Lower: 3}, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if findings := checkOne(t, d, series, 148); len(findings) != 0 {
+		t.Errorf("Expected value continuing the trend to pass, got %+v", findings)
+	}
+	expectCode(t, checkOne(t, d, series, 250), "ewma_high")
+	expectCode(t, checkOne(t, d, series, 60), "ewma_low")
+}
+
+func TestEWMA_RejectsInvalidAlpha(t *testing.T) {
+	for _, alpha := range []float64{0, -0.5, 1.5} {
+		if _, err := anomaly.NewEWMADetector(alpha, anomaly.Bounds{Upper: 3, Lower: 3}, 3); err == nil {
+			t.Errorf("Expected error for alpha %v", alpha)
+		}
+	}
+}
+
+func TestBounds_RejectNegativeThresholds(t *testing.T) {
+	if _, err := anomaly.NewZScoreDetector(anomaly.Bounds{Upper: -1}, 3); err == nil {
+		t.Error("Expected error for negative z-score threshold")
+	}
+	if _, err := anomaly.NewMADDetector(anomaly.Bounds{Lower: -1}, 3); err == nil {
+		t.Error("Expected error for negative MAD threshold")
+	}
+}
+
+func TestChainFromConfig_StatisticalDetectors(t *testing.T) {
+	chain, err := anomaly.NewChainFromConfig(config.AnomalyConfig{
+		Detectors:                 []string{"spike", "zscore", "mad", "ewma"},
+		SpikeThreshold:            testSpikeThreshold,
+		MinDataPointsForDetection: testMinDataPointsForDetection,
+		ZScoreUpper:               3,
+		ZScoreLower:               3,
+		MADUpper:                  3.5,
+		MADLower:                  3.5,
+		EWMAAlpha:                 0.3,
+		EWMAUpper:                 3,
+		EWMALower:                 3,
+	}, anomaly.Deps{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	findings := chain.Check(context.Background(), noisySeries, anomaly.Candidate{Value: 20})
+	detectors := make(map[string]bool)
+	for _, f := range findings {
+		detectors[f.Detector] = true
+	}
+	for _, name := range []string{"zscore", "mad", "ewma"} {
+		if !detectors[name] {
+			t.Errorf("Expected a finding from %s for a large drop", name)
+		}
+	}
+	if detectors["spike"] {
+		t.Error("Expected the spike rule to ignore drops")
+	}
+}
@@ -0,0 +1,97 @@
+package anomaly_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/anomaly"
+	"github.com/septivank/energy-metering-worker/internal/config"
+)
+
+type fixedStrategy struct {
+	name     string
+	findings []anomaly.Finding
+}
+
+func (f fixedStrategy) Name() string { return f.name }
+
+func (f fixedStrategy) Check(ctx context.Context, series anomaly.Series, candidate anomaly.Candidate) []anomaly.Finding {
+	return f.findings
+}
+
+func seriesOf(values ...float64) anomaly.Series {
+	series := make(anomaly.Series, len(values))
+	for i, v := range values {
+		series[i] = anomaly.Point{Value: v}
+	}
+	return series
+}
+
+func TestChain_CollectsFindingsInOrder(t *testing.T) {
+	chain := anomaly.NewChain(
+		fixedStrategy{name: "a", findings: []anomaly.Finding{{Detector: "a", Code: "first", Message: "first"}}},
+		fixedStrategy{name: "b"},
+		fixedStrategy{name: "c", findings: []anomaly.Finding{{Detector: "c", Code: "second", Message: "second"}}},
+	)
+
+	findings := chain.Check(context.Background(), nil, anomaly.Candidate{Value: 1})
+
+	if len(findings) != 2 {
+		t.Fatalf("Expected 2 findings, got %d", len(findings))
+	}
+	if findings[0].Code != "first" || findings[1].Code != "second" {
+		t.Errorf("Expected findings in chain order, got %s, %s", findings[0].Code, findings[1].Code)
+	}
+	if reason := anomaly.Reason(findings); reason != "first; second" {
+		t.Errorf("Expected joined reason, got '%s'", reason)
+	}
+	if chain.Name() != "a,b,c" {
+		t.Errorf("Expected chain name 'a,b,c', got '%s'", chain.Name())
+	}
+}
+
+func TestChainFromConfig_Spike(t *testing.T) {
+	chain, err := anomaly.NewChainFromConfig(config.AnomalyConfig{
+		Detectors:                 []string{"spike"},
+		SpikeThreshold:            testSpikeThreshold,
+		MinDataPointsForDetection: testMinDataPointsForDetection,
+	}, anomaly.Deps{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	findings := chain.Check(context.Background(), seriesOf(100, 105, 98, 102), anomaly.Candidate{Value: 350})
+	if len(findings) != 1 {
+		t.Fatalf("Expected 1 finding, got %d", len(findings))
+	}
+
+	f := findings[0]
+	if f.Detector != "spike" || f.Code != "spike" || f.Severity != anomaly.SeverityWarning {
+		t.Errorf("Unexpected finding: %+v", f)
+	}
+	if f.Score < 3.0 {
+		t.Errorf("Expected score above threshold, got %.2f", f.Score)
+	}
+}
+
+func TestChainFromConfig_UnknownDetector(t *testing.T) {
+	_, err := anomaly.NewChainFromConfig(config.AnomalyConfig{Detectors: []string{"nope"}}, anomaly.Deps{})
+	if err == nil {
+		t.Fatal("Expected error for unknown detector")
+	}
+	if !strings.Contains(err.Error(), "spike") {
+		t.Errorf("Expected available detectors in error, got '%v'", err)
+	}
+}
+
+func TestRegister_DuplicatePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic on duplicate registration")
+		}
+	}()
+	anomaly.Register("spike", func(cfg config.AnomalyConfig, deps anomaly.Deps) (anomaly.Strategy, error) {
+		return nil, nil
+	})
+}
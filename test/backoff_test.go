@@ -0,0 +1,37 @@
+package anomaly_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/mq"
+)
+
+func TestBackoff_GrowsExponentially(t *testing.T) {
+	b := mq.Backoff{Initial: time.Second, Max: time.Minute}
+
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		got := b.Duration(attempt)
+		if got < want/2 || got > want {
+			t.Errorf("attempt %d: expected delay in [%v, %v], got %v", attempt, want/2, want, got)
+		}
+	}
+}
+
+func TestBackoff_CappedAtMax(t *testing.T) {
+	b := mq.Backoff{Initial: time.Second, Max: 5 * time.Second}
+
+	for i := 0; i < 100; i++ {
+		if got := b.Duration(20); got > 5*time.Second {
+			t.Fatalf("Expected delay capped at 5s, got %v", got)
+		}
+	}
+}
+
+func TestBackoff_ZeroValueUsesDefaults(t *testing.T) {
+	var b mq.Backoff
+
+	if got := b.Duration(0); got <= 0 || got > time.Second {
+		t.Errorf("Expected delay in (0, 1s], got %v", got)
+	}
+}
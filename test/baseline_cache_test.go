@@ -0,0 +1,156 @@
+package anomaly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/cache"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/service"
+)
+
+type fakeBaselineSource struct {
+	calls  int
+	points map[string][]db.MetricPoint
+}
+
+func (f *fakeBaselineSource) GetRecentReadingsForMetrics(ctx context.Context, clientID uuid.UUID, metricNames []string, limit int) (map[string][]db.MetricPoint, error) {
+	f.calls++
+	result := make(map[string][]db.MetricPoint)
+	for _, name := range metricNames {
+		points := f.points[name]
+		if len(points) > limit {
+			points = points[:limit]
+		}
+		result[name] = points
+	}
+	return result, nil
+}
+
+func point(value float64, minute int) db.MetricPoint {
+	return db.MetricPoint{
+		Value:     value,
+		Timestamp: time.Date(2025, 12, 29, 10, minute, 0, 0, time.UTC),
+	}
+}
+
+func TestBaselineCache_WarmsOnMissOnly(t *testing.T) {
+	source := &fakeBaselineSource{points: map[string][]db.MetricPoint{
+		"voltage": {point(221, 2), point(220, 1)},
+	}}
+	c := service.NewBaselineCache(source, 10, 100, time.Hour)
+	clientID := uuid.New()
+
+	for i := 0; i < 3; i++ {
+		recent, err := c.Recent(context.Background(), clientID, []string{"voltage"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(recent["voltage"]) != 2 {
+			t.Fatalf("Expected 2 points, got %d", len(recent["voltage"]))
+		}
+	}
+
+	if source.calls != 1 {
+		t.Errorf("Expected 1 database load, got %d", source.calls)
+	}
+}
+
+func TestBaselineCache_AddKeepsNewestWindow(t *testing.T) {
+	source := &fakeBaselineSource{points: map[string][]db.MetricPoint{
+		"voltage": {point(222, 3), point(221, 2), point(220, 1)},
+	}}
+	c := service.NewBaselineCache(source, 3, 100, time.Hour)
+	clientID := uuid.New()
+
+	if _, err := c.Recent(context.Background(), clientID, []string{"voltage"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	c.Add(clientID, "voltage", point(223, 4))
+
+	recent, _ := c.Recent(context.Background(), clientID, []string{"voltage"})
+	got := recent["voltage"]
+	expected := []float64{223, 222, 221}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d points, got %d", len(expected), len(got))
+	}
+	for i, v := range expected {
+		if got[i].Value != v {
+			t.Errorf("Point %d: expected %.0f, got %.0f", i, v, got[i].Value)
+		}
+	}
+
+	if source.calls != 1 {
+		t.Errorf("Expected 1 database load, got %d", source.calls)
+	}
+}
+
+func TestBaselineCache_AddIgnoresUncachedMetric(t *testing.T) {
+	source := &fakeBaselineSource{points: map[string][]db.MetricPoint{
+		"voltage": {point(221, 2), point(220, 1)},
+	}}
+	c := service.NewBaselineCache(source, 10, 100, time.Hour)
+	clientID := uuid.New()
+
+	c.Add(clientID, "voltage", point(222, 3))
+
+	recent, _ := c.Recent(context.Background(), clientID, []string{"voltage"})
+	if len(recent["voltage"]) != 2 {
+		t.Errorf("Expected full history from source, got %d points", len(recent["voltage"]))
+	}
+}
+
+func TestBaselineCache_OutOfOrderReadingReloads(t *testing.T) {
+	source := &fakeBaselineSource{points: map[string][]db.MetricPoint{
+		"voltage": {point(221, 5)},
+	}}
+	c := service.NewBaselineCache(source, 10, 100, time.Hour)
+	clientID := uuid.New()
+
+	c.Recent(context.Background(), clientID, []string{"voltage"})
+	c.Add(clientID, "voltage", point(219, 1))
+	c.Recent(context.Background(), clientID, []string{"voltage"})
+
+	if source.calls != 2 {
+		t.Errorf("Expected reload after out-of-order reading, got %d loads", source.calls)
+	}
+}
+
+func TestLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := cache.NewLRU[string, int](2, 0)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected 'b' to be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Expected 'a' to be kept")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.Len())
+	}
+}
+
+func TestLRU_ExpiresAfterTTL(t *testing.T) {
+	now := time.Date(2025, 12, 29, 10, 0, 0, 0, time.UTC)
+	c := cache.NewLRU[string, int](10, time.Minute).WithClock(func() time.Time { return now })
+
+	c.Set("a", 1)
+
+	now = now.Add(59 * time.Second)
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Expected entry before TTL")
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected entry to expire after TTL")
+	}
+}
@@ -0,0 +1,288 @@
+package anomaly_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/service"
+	"go.uber.org/zap"
+)
+
+type fakeClientStore struct {
+	ids       map[string]uuid.UUID
+	upserts   []string // ip addresses, one per upsert
+	touches   [][]db.ClientSighting
+	touchErrs []error // returned by successive TouchClients calls
+}
+
+func (f *fakeClientStore) UpsertClient(ctx context.Context, fingerprint string, ipAddress string, userAgent *string) (*db.MeterClient, error) {
+	f.upserts = append(f.upserts, ipAddress)
+	id, ok := f.ids[fingerprint]
+	if !ok {
+		id = uuid.New()
+		f.ids[fingerprint] = id
+	}
+	return &db.MeterClient{ID: id, ClientFingerprint: fingerprint, IPAddress: ipAddress, UserAgent: userAgent}, nil
+}
+
+func (f *fakeClientStore) TouchClients(ctx context.Context, sightings []db.ClientSighting) error {
+	f.touches = append(f.touches, sightings)
+	if len(f.touchErrs) > 0 {
+		err := f.touchErrs[0]
+		f.touchErrs = f.touchErrs[1:]
+		return err
+	}
+	return nil
+}
+
+func newFakeClientStore() *fakeClientStore {
+	return &fakeClientStore{ids: make(map[string]uuid.UUID)}
+}
+
+func resolverConfig() config.ClientConfig {
+	return config.ClientConfig{
+		CacheMaxEntries:       100,
+		CacheTTL:              time.Hour,
+		LastSeenFlushInterval: time.Hour,
+	}
+}
+
+func TestClientResolver_CachesKnownClients(t *testing.T) {
+	store := newFakeClientStore()
+	resolver := service.NewClientResolver(store, resolverConfig(), zap.NewNop())
+	ctx := context.Background()
+
+	first, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		id, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if id != first {
+			t.Errorf("Expected cached ID %s, got %s", first, id)
+		}
+	}
+
+	if len(store.upserts) != 1 {
+		t.Errorf("Expected 1 upsert on the cache miss, got %d", len(store.upserts))
+	}
+
+	if _, err := resolver.Resolve(ctx, "meter-b", "10.0.0.2", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(store.upserts) != 2 {
+		t.Errorf("Expected an upsert for the new fingerprint, got %d upserts", len(store.upserts))
+	}
+}
+
+func TestClientResolver_UpsertsChangedIdentity(t *testing.T) {
+	store := newFakeClientStore()
+	resolver := service.NewClientResolver(store, resolverConfig(), zap.NewNop())
+	ctx := context.Background()
+	agent := "meter-fw/2.0"
+
+	first, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	moved, err := resolver.Resolve(ctx, "meter-a", "10.0.0.9", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := resolver.Resolve(ctx, "meter-a", "10.0.0.9", &agent); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := resolver.Resolve(ctx, "meter-a", "10.0.0.9", &agent); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if moved != first {
+		t.Errorf("Expected the client ID to survive an IP change, got %s and %s", first, moved)
+	}
+	expected := []string{"10.0.0.1", "10.0.0.9", "10.0.0.9"}
+	if len(store.upserts) != len(expected) {
+		t.Fatalf("Expected upserts %v, got %v", expected, store.upserts)
+	}
+}
+
+func TestClientResolver_CoalescesSightings(t *testing.T) {
+	store := newFakeClientStore()
+	resolver := service.NewClientResolver(store, resolverConfig(), zap.NewNop())
+	ctx := context.Background()
+
+	id, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(store.touches) != 0 {
+		t.Fatalf("Expected no writes before the flush, got %d", len(store.touches))
+	}
+
+	if err := resolver.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(store.touches) != 1 {
+		t.Fatalf("Expected 1 flush, got %d", len(store.touches))
+	}
+	if len(store.touches[0]) != 1 {
+		t.Fatalf("Expected the sightings coalesced into 1, got %d", len(store.touches[0]))
+	}
+	if store.touches[0][0].ClientID != id || store.touches[0][0].IPAddress != "10.0.0.1" {
+		t.Errorf("Expected a sighting of %s at 10.0.0.1, got %+v", id, store.touches[0][0])
+	}
+}
+
+func TestClientResolver_RetriesFailedFlush(t *testing.T) {
+	store := newFakeClientStore()
+	store.touchErrs = []error{errors.New("connection reset")}
+	resolver := service.NewClientResolver(store, resolverConfig(), zap.NewNop())
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if err := resolver.Stop(ctx); err == nil {
+		t.Fatal("Expected the flush error")
+	}
+	if err := resolver.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(store.touches) != 2 {
+		t.Fatalf("Expected the sighting flushed again, got %d flushes", len(store.touches))
+	}
+	if len(store.touches[1]) != 1 {
+		t.Errorf("Expected 1 retried sighting, got %d", len(store.touches[1]))
+	}
+}
+
+func TestClientResolver_RecordsIdentityChanges(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	resolver := service.NewClientResolver(repo, testConfig().Client, zap.NewNop())
+	ctx := context.Background()
+
+	agent := "meter-fw/2.0"
+	var ids []uuid.UUID
+	for _, sighting := range []struct {
+		ip        string
+		userAgent *string
+	}{
+		{"10.0.0.1", nil},
+		{"10.0.0.1", nil},
+		{"10.0.0.2", nil},
+		{"10.0.0.2", &agent},
+	} {
+		id, err := resolver.Resolve(ctx, "meter-a", sighting.ip, sighting.userAgent)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("Expected one client across identities, got %v", ids)
+		}
+	}
+	if n := countRows(t, pool, "meter_clients", ""); n != 1 {
+		t.Errorf("Expected 1 client, got %d", n)
+	}
+	if n := countRows(t, pool, "meter_clients", "ip_address = '10.0.0.2' AND user_agent = $1", agent); n != 1 {
+		t.Errorf("Expected the client to carry its latest identity, got %d", n)
+	}
+	if n := countRows(t, pool, "meter_client_identities", "client_id = $1", ids[0]); n != 3 {
+		t.Errorf("Expected 3 identities in the history, got %d", n)
+	}
+}
+
+func TestClientResolver_FlushesLastSeenOnStop(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	resolver := service.NewClientResolver(repo, testConfig().Client, zap.NewNop())
+	ctx := context.Background()
+
+	id, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if _, err := pool.Exec(ctx, `UPDATE meter_clients SET last_seen_at = $1`, past); err != nil {
+		t.Fatalf("Failed to age client: %v", err)
+	}
+	if _, err := pool.Exec(ctx, `UPDATE meter_client_identities SET last_seen_at = $1`, past); err != nil {
+		t.Fatalf("Failed to age identity: %v", err)
+	}
+
+	// Served from the cache, so last_seen_at only moves on flush
+	if _, err := resolver.Resolve(ctx, "meter-a", "10.0.0.1", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := countRows(t, pool, "meter_clients", "last_seen_at = $1", past); n != 1 {
+		t.Errorf("Expected last_seen_at untouched before the flush, got %d", n)
+	}
+
+	if err := resolver.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := countRows(t, pool, "meter_clients", "id = $1 AND last_seen_at > $2", id, past); n != 1 {
+		t.Errorf("Expected client last_seen_at flushed, got %d", n)
+	}
+	if n := countRows(t, pool, "meter_client_identities", "client_id = $1 AND last_seen_at > $2", id, past); n != 1 {
+		t.Errorf("Expected identity last_seen_at flushed, got %d", n)
+	}
+}
+
+func TestUpsertClient_ConcurrentWorkersShareClient(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	ctx := context.Background()
+
+	const workers = 8
+	ids := make([]uuid.UUID, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := repo.UpsertClient(ctx, "meter-a", "10.0.0.1", nil)
+			if err == nil {
+				ids[i] = client.ID
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("worker %d: unexpected error: %v", i, err)
+		}
+		if ids[i] != ids[0] {
+			t.Errorf("Expected every worker to get client %s, got %s", ids[0], ids[i])
+		}
+	}
+	if n := countRows(t, pool, "meter_clients", ""); n != 1 {
+		t.Errorf("Expected 1 client, got %d", n)
+	}
+}
@@ -0,0 +1,49 @@
+package anomaly_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/db"
+)
+
+type failingBaselineSource struct{}
+
+func (failingBaselineSource) GetRecentReadingsForMetrics(ctx context.Context, clientID uuid.UUID, metricNames []string, limit int) (map[string][]db.MetricPoint, error) {
+	return nil, errors.New("connection reset")
+}
+
+func TestProcessMessage_RetriesCountersWithoutHistory(t *testing.T) {
+	pool := testDB(t)
+	cfg := testConfig()
+	cfg.Validation.CounterMetrics = []string{"energy_*"}
+	processor, _ := newTestProcessorWithBaselines(t, pool, cfg, failingBaselineSource{})
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	delivery := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"energy_total": "1200", "voltage": "220"})
+	if err := processor.ProcessMessage(context.Background(), delivery); err == nil {
+		t.Fatal("Expected an error when the counter history cannot be loaded")
+	}
+
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 0 {
+		t.Errorf("Expected no readings stored, got %d", n)
+	}
+}
+
+func TestProcessMessage_RetriesGaugesWithoutHistory(t *testing.T) {
+	pool := testDB(t)
+	processor, _ := newTestProcessorWithBaselines(t, pool, testConfig(), failingBaselineSource{})
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	delivery := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})
+	if err := processor.ProcessMessage(context.Background(), delivery); err == nil {
+		t.Fatal("Expected an error when the anomaly baselines cannot be loaded")
+	}
+
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 0 {
+		t.Errorf("Expected no readings stored unchecked, got %d", n)
+	}
+}
@@ -0,0 +1,184 @@
+package anomaly_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/septivank/energy-metering-worker/internal/anomaly"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/migrate"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/service"
+	"github.com/septivank/energy-metering-worker/internal/validator"
+	"go.uber.org/zap"
+)
+
+// testDB returns a pool on a fresh schema of the database at
+// TEST_DATABASE_URL, migrated to the latest version and dropped when the
+// test ends. TEST_DB_STORAGE picks the storage variant (default postgres).
+// Tests needing a database are skipped when TEST_DATABASE_URL is unset.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	storage := os.Getenv("TEST_DB_STORAGE")
+	if storage == "" {
+		storage = migrate.VariantPostgres
+	}
+
+	ctx := context.Background()
+	admin, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("Failed to create test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+		admin.Close(context.Background())
+	})
+
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatalf("Invalid TEST_DATABASE_URL: %v", err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	migrator, err := migrate.New(pool, storage, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Failed to migrate test schema: %v", err)
+	}
+
+	return pool
+}
+
+// testConfig returns the default configuration without reading the
+// environment
+func testConfig() *config.Config {
+	return &config.Config{
+		RabbitMQ: config.RabbitMQConfig{
+			WorkerRoutingKey:  "meter.reading.accepted",
+			StuckRoutingKey:   "meter.stuck",
+			PartialRoutingKey: "meter.message.partial",
+		},
+		Validation: config.ValidationConfig{
+			TimestampToleranceMinutes: 7 * 24 * 60,
+		},
+		Anomaly: config.AnomalyConfig{
+			SpikeThreshold:            3.0,
+			MinDataPointsForDetection: 3,
+			HistoryWindow:             10,
+			Detectors:                 []string{"spike"},
+			SeasonalLocation:          time.UTC,
+			BaselineCacheMaxEntries:   1000,
+			BaselineCacheTTL:          time.Minute,
+		},
+		Client: config.ClientConfig{
+			CacheMaxEntries:       1000,
+			CacheTTL:              time.Minute,
+			LastSeenFlushInterval: time.Minute,
+		},
+	}
+}
+
+// newTestProcessor creates a processor on pool with cfg
+func newTestProcessor(t *testing.T, pool *pgxpool.Pool, cfg *config.Config) (*service.ProcessorService, *repository.Repository) {
+	t.Helper()
+
+	return newTestProcessorWithBaselines(t, pool, cfg, nil)
+}
+
+// newTestProcessorWithBaselines creates a processor on pool with cfg that
+// loads anomaly baselines from source, or from the database when nil
+func newTestProcessorWithBaselines(t *testing.T, pool *pgxpool.Pool, cfg *config.Config, source service.BaselineSource) (*service.ProcessorService, *repository.Repository) {
+	t.Helper()
+
+	repo := repository.NewRepository(pool)
+	if source == nil {
+		source = repo
+	}
+	detector, err := anomaly.NewChainFromConfig(cfg.Anomaly, anomaly.Deps{})
+	if err != nil {
+		t.Fatalf("Failed to create detector: %v", err)
+	}
+	v, err := validator.NewValidatorWithConfig(cfg.Validation.TimestampToleranceMinutes, validator.Config{
+		Counters: validator.CounterConfig{
+			Metrics:     cfg.Validation.CounterMetrics,
+			RolloverMax: cfg.Validation.CounterRolloverMax,
+			ResetMax:    cfg.Validation.CounterResetMax,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create validator: %v", err)
+	}
+
+	clients := service.NewClientResolver(repo, cfg.Client, zap.NewNop())
+	baselines := service.NewBaselineCache(source, cfg.Anomaly.HistoryWindow, cfg.Anomaly.BaselineCacheMaxEntries, cfg.Anomaly.BaselineCacheTTL)
+	return service.NewProcessorService(repo, clients, baselines, detector, v, cfg, zap.NewNop()), repo
+}
+
+// ingestDelivery builds a delivery of an ingest message received now with
+// one PM entry per metric, all at readingAt
+func ingestDelivery(t *testing.T, requestID, fingerprint string, readingAt time.Time, metrics map[string]string) mq.Delivery {
+	t.Helper()
+
+	return ingestDeliveryAt(t, requestID, fingerprint, time.Now(), readingAt, metrics)
+}
+
+// ingestDeliveryAt builds a delivery of an ingest message received upstream
+// at receivedAt with one PM entry per metric, all at readingAt
+func ingestDeliveryAt(t *testing.T, requestID, fingerprint string, receivedAt, readingAt time.Time, metrics map[string]string) mq.Delivery {
+	t.Helper()
+
+	var pm []service.PMData
+	for name, value := range metrics {
+		pm = append(pm, service.PMData{Date: readingAt.UTC().Format(time.RFC3339), Data: value, Name: name})
+	}
+	body, err := json.Marshal(service.IngestMessage{
+		RequestID:         requestID,
+		ClientFingerprint: fingerprint,
+		IPAddress:         "10.0.0.1",
+		ReceivedAt:        receivedAt.UTC(),
+		Payload:           service.Payload{PM: pm},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+	return mq.Delivery{Body: body, Exchange: "energy-metering.ingest.exchange", RoutingKey: "meter.reading.raw"}
+}
+
+// countRows counts the rows of a table matching where
+func countRows(t *testing.T, pool *pgxpool.Pool, table, where string, args ...any) int {
+	t.Helper()
+
+	var n int
+	query := "SELECT count(*) FROM " + table
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if err := pool.QueryRow(context.Background(), query, args...).Scan(&n); err != nil {
+		t.Fatalf("Failed to count %s: %v", table, err)
+	}
+	return n
+}
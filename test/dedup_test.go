@@ -0,0 +1,239 @@
+package anomaly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/migrate"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"go.uber.org/zap"
+)
+
+func TestClaimRequestTx_ClaimsOnce(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	ctx := context.Background()
+
+	client, err := repo.UpsertClient(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i, want := range []bool{true, false} {
+		tx, err := repo.BeginTx(ctx)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		claimed, err := repo.ClaimRequestTx(ctx, tx, "req-1", client.ID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if claimed != want {
+			t.Errorf("delivery %d: expected claimed=%v, got %v", i+1, want, claimed)
+		}
+	}
+
+	if n := countRows(t, pool, "processed_requests", ""); n != 1 {
+		t.Errorf("Expected the request to be recorded once, got %d", n)
+	}
+}
+
+func TestInsertMeterReadingTx_SkipsDuplicateReading(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	ctx := context.Background()
+
+	client, err := repo.UpsertClient(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	reading := func(metric string) *db.MeterReading {
+		return &db.MeterReading{
+			ClientID:         client.ID,
+			MetricName:       metric,
+			MetricValue:      220,
+			ReadingTimestamp: readingAt,
+			ReceivedAt:       time.Now(),
+			ValidationStatus: "valid",
+		}
+	}
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	for i, tc := range []struct {
+		metric string
+		want   bool
+	}{
+		{"voltage", true},
+		{"voltage", false},
+		{"current", true},
+	} {
+		inserted, err := repo.InsertMeterReadingTx(ctx, tx, reading(tc.metric))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if inserted != tc.want {
+			t.Errorf("reading %d (%s): expected inserted=%v, got %v", i+1, tc.metric, tc.want, inserted)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 2 {
+		t.Errorf("Expected 2 readings, got %d", n)
+	}
+}
+
+func TestProcessMessage_SkipsRedeliveredRequest(t *testing.T) {
+	pool := testDB(t)
+	processor, _ := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	delivery := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220", "current": "5"})
+
+	for i := 0; i < 2; i++ {
+		if err := processor.ProcessMessage(ctx, delivery); err != nil {
+			t.Fatalf("delivery %d: unexpected error: %v", i+1, err)
+		}
+	}
+
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 2 {
+		t.Errorf("Expected 2 readings, got %d", n)
+	}
+	if n := countRows(t, pool, "ingest_messages", ""); n != 1 {
+		t.Errorf("Expected the message to be stored once, got %d", n)
+	}
+	if n := countRows(t, pool, "event_outbox", ""); n != 2 {
+		t.Errorf("Expected 2 outbox events, got %d", n)
+	}
+}
+
+func TestProcessMessage_SkipsDuplicateReadings(t *testing.T) {
+	pool := testDB(t)
+	processor, _ := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	first := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})
+	// Republished upstream under a new request ID, with one new metric
+	second := ingestDelivery(t, "req-2", "meter-a", readingAt, map[string]string{"voltage": "220", "current": "5"})
+
+	for i, delivery := range []mq.Delivery{first, second} {
+		if err := processor.ProcessMessage(ctx, delivery); err != nil {
+			t.Fatalf("delivery %d: unexpected error: %v", i+1, err)
+		}
+	}
+
+	if n := countRows(t, pool, "meter_readings_raw", "metric_name = 'voltage'"); n != 1 {
+		t.Errorf("Expected the duplicate reading to be skipped, got %d voltage readings", n)
+	}
+	if n := countRows(t, pool, "meter_readings_raw", "metric_name = 'current'"); n != 1 {
+		t.Errorf("Expected the new reading to be stored, got %d current readings", n)
+	}
+	if n := countRows(t, pool, "event_outbox", ""); n != 2 {
+		t.Errorf("Expected one event per stored reading, got %d", n)
+	}
+}
+
+func TestRetentionPurge_ProcessedRequests(t *testing.T) {
+	pool := testDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	delivery := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})
+	if err := processor.ProcessMessage(ctx, delivery); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	deleted, err := repo.DeleteProcessedRequestsTx(ctx, tx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 purged request, got %d", deleted)
+	}
+
+	// Past the ledger's retention the natural key still skips the readings
+	if err := processor.ProcessMessage(ctx, delivery); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 1 {
+		t.Errorf("Expected 1 reading, got %d", n)
+	}
+}
+
+func TestMigrate_DeduplicatesLegacyReadings(t *testing.T) {
+	pool := testDB(t)
+	ctx := context.Background()
+
+	migrator, err := migrate.New(pool, migrate.VariantPostgres, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := migrator.Down(ctx, 100); err != nil {
+		t.Fatalf("Failed to revert migrations: %v", err)
+	}
+
+	// A database created from the schema before the natural key, holding
+	// a redelivered reading twice
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE meter_clients (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			client_fingerprint TEXT UNIQUE NOT NULL,
+			ip_address INET NOT NULL,
+			user_agent TEXT,
+			first_seen_at TIMESTAMPTZ NOT NULL,
+			last_seen_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT now()
+		);
+		CREATE TABLE meter_readings_raw (
+			id UUID DEFAULT gen_random_uuid(),
+			client_id UUID REFERENCES meter_clients(id),
+			metric_name TEXT NOT NULL,
+			metric_value DOUBLE PRECISION NOT NULL,
+			reading_timestamp TIMESTAMPTZ NOT NULL,
+			received_at TIMESTAMPTZ NOT NULL,
+			validation_status TEXT NOT NULL,
+			anomaly_reason TEXT,
+			raw_payload JSONB NOT NULL,
+			PRIMARY KEY (id, reading_timestamp)
+		);
+		INSERT INTO meter_clients (id, client_fingerprint, ip_address, first_seen_at, last_seen_at)
+		VALUES ('00000000-0000-0000-0000-000000000001', 'meter-a', '10.0.0.1', now(), now());
+		INSERT INTO meter_readings_raw (client_id, metric_name, metric_value, reading_timestamp, received_at, validation_status, raw_payload)
+		SELECT '00000000-0000-0000-0000-000000000001', 'voltage', 220, date_trunc('minute', now()), now() + n * INTERVAL '1 second', 'valid', '{}'
+		FROM generate_series(1, 3) AS n;
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Failed to migrate legacy database: %v", err)
+	}
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 1 {
+		t.Errorf("Expected duplicates to be removed, got %d readings", n)
+	}
+}
@@ -0,0 +1,69 @@
+package anomaly_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/health"
+)
+
+func TestChecker_ReadinessFailsOnAnyDependency(t *testing.T) {
+	checker := health.NewChecker()
+	checker.Register("database", health.Readiness, func(ctx context.Context) error {
+		return errors.New("connection refused")
+	})
+	checker.Register("consumer", health.Liveness, func(ctx context.Context) error {
+		return nil
+	})
+
+	ready := checker.Check(context.Background(), health.Readiness)
+	if ready.Healthy() {
+		t.Error("Expected readiness to fail when the database is down")
+	}
+	if ready.Checks["database"].Error != "connection refused" {
+		t.Errorf("Expected database error in report, got '%s'", ready.Checks["database"].Error)
+	}
+
+	live := checker.Check(context.Background(), health.Liveness)
+	if !live.Healthy() {
+		t.Error("Expected liveness to ignore readiness-only checks")
+	}
+	if live.Checks["database"].Status != health.StatusDown {
+		t.Error("Expected liveness report to still include the database status")
+	}
+}
+
+func TestChecker_LivenessFailsOnLivenessCheck(t *testing.T) {
+	checker := health.NewChecker()
+	checker.Register("consumer", health.Liveness, func(ctx context.Context) error {
+		return errors.New("consumer loop is not running")
+	})
+
+	if checker.Check(context.Background(), health.Liveness).Healthy() {
+		t.Error("Expected liveness to fail")
+	}
+}
+
+func TestChecker_RemembersLastError(t *testing.T) {
+	failing := true
+	checker := health.NewChecker()
+	checker.Register("rabbitmq_connection", health.Readiness, func(ctx context.Context) error {
+		if failing {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+
+	checker.Check(context.Background(), health.Readiness)
+	failing = false
+	report := checker.Check(context.Background(), health.Readiness)
+
+	result := report.Checks["rabbitmq_connection"]
+	if result.Status != health.StatusUp {
+		t.Errorf("Expected status up after recovery, got %s", result.Status)
+	}
+	if result.LastError != "connection reset" || result.LastErrorAt == nil {
+		t.Error("Expected last error to be kept after recovery")
+	}
+}
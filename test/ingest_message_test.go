@@ -0,0 +1,266 @@
+package anomaly_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/septivank/energy-metering-worker/internal/migrate"
+	"go.uber.org/zap"
+)
+
+// clientID looks up the ID of the client with fingerprint
+func clientID(t *testing.T, pool *pgxpool.Pool, fingerprint string) uuid.UUID {
+	t.Helper()
+
+	var id uuid.UUID
+	err := pool.QueryRow(context.Background(), `SELECT id FROM meter_clients WHERE client_fingerprint = $1`, fingerprint).Scan(&id)
+	if err != nil {
+		t.Fatalf("Failed to find client %s: %v", fingerprint, err)
+	}
+	return id
+}
+
+func TestProcessMessage_StoresIngestMessage(t *testing.T) {
+	pool := testDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	receivedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	readingAt := receivedAt.Add(-time.Second)
+	publishedAt := receivedAt.Add(time.Second)
+	delivery := ingestDeliveryAt(t, "req-1", "meter-a", receivedAt, readingAt, map[string]string{"voltage": "220", "current": "5"})
+	delivery.MessageID = "msg-1"
+	delivery.Redelivered = true
+	delivery.RetryCount = 2
+	delivery.Timestamp = publishedAt
+	delivery.Headers = amqp.Table{"x-retry-count": int32(2)}
+	if err := processor.ProcessMessage(ctx, delivery); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if n := countRows(t, pool, "ingest_messages", ""); n != 1 {
+		t.Fatalf("Expected 1 ingest message for the whole message, got %d", n)
+	}
+
+	client := clientID(t, pool, "meter-a")
+	msg, found, err := repo.GetMessageForReading(ctx, client, "current", readingAt)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !found {
+		t.Fatal("Expected the message of the reading")
+	}
+	if msg.ID == 0 || msg.RequestID != "req-1" || msg.ClientID != client || !msg.ReceivedAt.Equal(receivedAt) {
+		t.Errorf("Expected the stored message of req-1, got %+v", msg)
+	}
+	if msg.MessageID != "msg-1" || msg.Exchange != delivery.Exchange || msg.RoutingKey != delivery.RoutingKey ||
+		!msg.Redelivered || msg.RetryCount != 2 {
+		t.Errorf("Expected the delivery metadata, got %+v", msg)
+	}
+	if msg.PublishedAt == nil || !msg.PublishedAt.Equal(publishedAt) {
+		t.Errorf("Expected published at %v, got %v", publishedAt, msg.PublishedAt)
+	}
+
+	var headers map[string]any
+	if err := json.Unmarshal(msg.Headers, &headers); err != nil {
+		t.Fatalf("Failed to decode headers: %v", err)
+	}
+	if headers["x-retry-count"] != float64(2) {
+		t.Errorf("Expected the AMQP headers, got %v", headers)
+	}
+	if !sameJSON(t, msg.Payload, delivery.Body) {
+		t.Errorf("Expected the message body stored, got %s", msg.Payload)
+	}
+
+	byID, found, err := repo.GetIngestMessage(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !found || byID.ID != msg.ID || byID.RequestID != "req-1" || byID.StoredAt.IsZero() {
+		t.Errorf("Expected the same message by ID, got %+v", byID)
+	}
+}
+
+// sameJSON reports whether two JSON documents hold the same value, as JSONB
+// does not keep the original formatting
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("Failed to decode %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("Failed to decode %s: %v", b, err)
+	}
+	ea, _ := json.Marshal(va)
+	eb, _ := json.Marshal(vb)
+	return string(ea) == string(eb)
+}
+
+func TestGetIngestMessage_NotFound(t *testing.T) {
+	pool := testDB(t)
+	_, repo := newTestProcessor(t, pool, testConfig())
+
+	_, found, err := repo.GetIngestMessage(context.Background(), 42)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found {
+		t.Error("Expected no message")
+	}
+}
+
+func TestGetMessageForReading_RebuildsLegacyReadings(t *testing.T) {
+	pool := testDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := processor.ProcessMessage(ctx, ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client := clientID(t, pool, "meter-a")
+
+	// A reading stored before ingest_messages existed
+	legacyAt := readingAt.Add(-time.Hour)
+	receivedAt := legacyAt.Add(time.Second)
+	_, err := pool.Exec(ctx, `
+		INSERT INTO meter_readings_raw (client_id, metric_name, metric_value, reading_timestamp, received_at, validation_status, raw_payload)
+		VALUES ($1, 'voltage', 219, $2, $3, 'valid', '{"request_id": "req-0"}')
+	`, client, legacyAt, receivedAt)
+	if err != nil {
+		t.Fatalf("Failed to insert legacy reading: %v", err)
+	}
+
+	msg, found, err := repo.GetMessageForReading(ctx, client, "voltage", legacyAt)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !found {
+		t.Fatal("Expected a message rebuilt from raw_payload")
+	}
+	if msg.ID != 0 || msg.RequestID != "" || msg.Exchange != "" || !msg.ReceivedAt.Equal(receivedAt) {
+		t.Errorf("Expected a message without delivery metadata received at %v, got %+v", receivedAt, msg)
+	}
+	if !sameJSON(t, msg.Payload, []byte(`{"request_id": "req-0"}`)) {
+		t.Errorf("Expected the raw payload, got %s", msg.Payload)
+	}
+
+	if _, found, err := repo.GetMessageForReading(ctx, client, "current", readingAt); err != nil || found {
+		t.Errorf("Expected no message for an unknown reading, got found=%v err=%v", found, err)
+	}
+
+	// Purged past retention: the reading stays, its message is gone
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	purged, err := repo.DeleteIngestMessagesTx(ctx, tx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected 1 purged message, got %d", purged)
+	}
+	if _, found, err := repo.GetMessageForReading(ctx, client, "voltage", readingAt); err != nil || found {
+		t.Errorf("Expected no message once purged, got found=%v err=%v", found, err)
+	}
+}
+
+func TestMigrate_MovesRawPayloadIntoIngestMessages(t *testing.T) {
+	pool := testDB(t)
+	_, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	migrator, err := migrate.New(pool, migrate.VariantAuto, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The ingest message backfill and the rollup backfill after it
+	if _, err := migrator.Down(ctx, 2); err != nil {
+		t.Fatalf("Failed to revert the backfill: %v", err)
+	}
+
+	// Two legacy messages: one with two readings, one with a single reading
+	client := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	readingAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	receivedAt := readingAt.Add(time.Second)
+	_, err = pool.Exec(ctx, `
+		INSERT INTO meter_clients (id, client_fingerprint, ip_address, first_seen_at, last_seen_at)
+		VALUES ($1, 'meter-a', '10.0.0.1', now(), now())
+	`, client)
+	if err != nil {
+		t.Fatalf("Failed to insert client: %v", err)
+	}
+	_, err = pool.Exec(ctx, `
+		INSERT INTO meter_readings_raw (client_id, metric_name, metric_value, reading_timestamp, received_at, validation_status, raw_payload)
+		VALUES
+			($1, 'voltage', 220, $2, $3, 'valid', '{"request_id": "req-1"}'),
+			($1, 'current', 5, $2, $3, 'valid', '{"request_id": "req-1"}'),
+			($1, 'voltage', 221, $2::timestamptz + INTERVAL '1 minute', $3::timestamptz + INTERVAL '1 minute', 'valid', '{"request_id": "req-2"}')
+	`, client, readingAt, receivedAt)
+	if err != nil {
+		t.Fatalf("Failed to insert legacy readings: %v", err)
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	if n := countRows(t, pool, "ingest_messages", ""); n != 2 {
+		t.Errorf("Expected 1 ingest message per legacy message, got %d", n)
+	}
+	if n := countRows(t, pool, "ingest_messages", `headers @> '{"x-backfilled": true}'`); n != 2 {
+		t.Errorf("Expected the backfilled messages marked, got %d", n)
+	}
+	if n := countRows(t, pool, "meter_readings_raw", "raw_payload IS NOT NULL OR ingest_message_id IS NULL"); n != 0 {
+		t.Errorf("Expected every reading moved to its ingest message, got %d left", n)
+	}
+
+	voltage, found, err := repo.GetMessageForReading(ctx, client, "voltage", readingAt)
+	if err != nil || !found {
+		t.Fatalf("Expected the backfilled message, got found=%v err=%v", found, err)
+	}
+	current, _, err := repo.GetMessageForReading(ctx, client, "current", readingAt)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if voltage.ID == 0 || voltage.ID != current.ID {
+		t.Errorf("Expected both readings of req-1 to share a message, got %d and %d", voltage.ID, current.ID)
+	}
+	if voltage.RequestID != "req-1" || !voltage.ReceivedAt.Equal(receivedAt) || !voltage.StoredAt.Equal(receivedAt) {
+		t.Errorf("Expected req-1 received and stored at %v, got %+v", receivedAt, voltage)
+	}
+
+	// A message stored after the backfill, without delivery metadata either
+	_, err = pool.Exec(ctx, `
+		INSERT INTO ingest_messages (request_id, client_id, received_at, payload)
+		VALUES ('req-3', $1, now(), '{"request_id": "req-3"}')
+	`, client)
+	if err != nil {
+		t.Fatalf("Failed to insert ingest message: %v", err)
+	}
+
+	if _, err := migrator.Down(ctx, 2); err != nil {
+		t.Fatalf("Failed to revert the backfill: %v", err)
+	}
+	if n := countRows(t, pool, "meter_readings_raw", "raw_payload IS NULL OR ingest_message_id IS NOT NULL"); n != 0 {
+		t.Errorf("Expected the payloads moved back, got %d readings without", n)
+	}
+	if n := countRows(t, pool, "ingest_messages", "request_id = 'req-3'"); n != 1 {
+		t.Errorf("Expected the message stored after the backfill kept, got %d", n)
+	}
+	if n := countRows(t, pool, "ingest_messages", ""); n != 1 {
+		t.Errorf("Expected the backfilled messages removed, got %d left", n)
+	}
+}
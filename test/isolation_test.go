@@ -0,0 +1,106 @@
+package anomaly_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+)
+
+// isolatedConfig returns the test configuration with per-reading isolation
+func isolatedConfig() *config.Config {
+	cfg := testConfig()
+	cfg.Validation.IsolateReadings = true
+	return cfg
+}
+
+// rejectMetric makes inserts of metric fail with a check violation
+func rejectMetric(t *testing.T, pool *pgxpool.Pool, metric string) {
+	t.Helper()
+
+	_, err := pool.Exec(context.Background(),
+		`ALTER TABLE meter_readings_raw ADD CONSTRAINT test_rejected_metric CHECK (metric_name <> '`+metric+`')`)
+	if err != nil {
+		t.Fatalf("Failed to add check constraint: %v", err)
+	}
+}
+
+func TestInsertIsolated_RejectsFailingReadingAlone(t *testing.T) {
+	pool := testDB(t)
+	processor, _ := newTestProcessor(t, pool, isolatedConfig())
+	rejectMetric(t, pool, "broken")
+	ctx := context.Background()
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	first := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})
+	if err := processor.ProcessMessage(ctx, first); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// A duplicate, a new reading and one violating the constraint
+	second := ingestDelivery(t, "req-2", "meter-a", readingAt, map[string]string{"voltage": "220", "current": "5", "broken": "1"})
+	if err := processor.ProcessMessage(ctx, second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 2 {
+		t.Errorf("Expected 2 stored readings, got %d", n)
+	}
+	if n := countRows(t, pool, "rejected_readings", "metric_name = 'broken' AND request_id = 'req-2'"); n != 1 {
+		t.Fatalf("Expected the broken reading recorded as rejected, got %d", n)
+	}
+
+	var entry []byte
+	if err := pool.QueryRow(ctx, `SELECT pm_entry FROM rejected_readings`).Scan(&entry); err != nil {
+		t.Fatalf("Failed to read rejected reading: %v", err)
+	}
+	var pm struct {
+		Name string `json:"name"`
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(entry, &pm); err != nil {
+		t.Fatalf("Failed to decode PM entry: %v", err)
+	}
+	if pm.Name != "broken" || pm.Data != "1" {
+		t.Errorf("Expected the original PM entry, got %+v", pm)
+	}
+
+	var payload []byte
+	err := pool.QueryRow(ctx, `SELECT payload FROM event_outbox WHERE routing_key = 'meter.message.partial'`).Scan(&payload)
+	if err != nil {
+		t.Fatalf("Expected a partial success event: %v", err)
+	}
+	var event mq.PartialSuccessEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if event.ReadingsTotal != 3 || event.ReadingsStored != 1 || event.ReadingsDuplicate != 1 || event.ReadingsRejected != 1 {
+		t.Errorf("Expected 3 total, 1 stored, 1 duplicate, 1 rejected, got %+v", event)
+	}
+	if len(event.Rejections) != 1 || event.Rejections[0].MetricName != "broken" {
+		t.Errorf("Expected the broken reading listed, got %+v", event.Rejections)
+	}
+}
+
+func TestInsertIsolated_FailsMessageOnSchemaError(t *testing.T) {
+	pool := testDB(t)
+	processor, _ := newTestProcessor(t, pool, isolatedConfig())
+	ctx := context.Background()
+
+	if _, err := pool.Exec(ctx, `ALTER TABLE meter_readings_raw RENAME COLUMN delta_value TO delta_value_renamed`); err != nil {
+		t.Fatalf("Failed to rename column: %v", err)
+	}
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	delivery := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220", "current": "5"})
+	if err := processor.ProcessMessage(ctx, delivery); err == nil {
+		t.Fatal("Expected the message to fail")
+	}
+
+	if n := countRows(t, pool, "rejected_readings", ""); n != 0 {
+		t.Errorf("Expected no reading rejected for a schema error, got %d", n)
+	}
+}
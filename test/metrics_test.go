@@ -0,0 +1,65 @@
+package anomaly_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/metrics"
+)
+
+func TestReasonCategory(t *testing.T) {
+	tests := []struct {
+		reason   string
+		expected string
+	}{
+		{"empty metric name", "empty_metric_name"},
+		{"invalid metric value: strconv.ParseFloat: parsing \"abc\": invalid syntax", "invalid_value"},
+		{"negative value detected", "negative_value"},
+		{"invalid timestamp format: unsupported format", "invalid_timestamp"},
+		{"timestamp outside tolerance window (±10080 minutes)", "timestamp_out_of_tolerance"},
+		{"sudden spike detected: value 500.00 exceeds 2.0x rolling average 220.00", "spike"},
+		{"z-score 4.20 outside ±3.0: value 130.00 vs mean 100.00 (stddev 1.90)", "zscore"},
+		{"modified z-score -5.10 outside ±3.5: value 20.00 vs median 100.00 (MAD 1.00)", "mad"},
+		{"outside EWMA band: value 250.00 vs 140.00 ± 3.0×5.00", "ewma"},
+		{"stuck meter: 6 consecutive readings at 220.00 since 2025-12-29T09:00:00Z", "stuck_meter"},
+		{"counter went backwards: value 5100.00 below previous 5230.00", "counter_backwards"},
+		{"counter value above register maximum: value 100000.00 exceeds 99999.99", "counter_overflow"},
+		{"inconsistent metrics: active_power = 3.10 vs voltage * current = 2.30 (tolerance 5%)", "consistency"},
+		{"rule voltage-range: value 270.00 above maximum 260.00", "rule"},
+		{"something new", "other"},
+	}
+
+	for _, tt := range tests {
+		if got := metrics.ReasonCategory(tt.reason); got != tt.expected {
+			t.Errorf("ReasonCategory(%q) = %s, expected %s", tt.reason, got, tt.expected)
+		}
+	}
+}
+
+func TestResult(t *testing.T) {
+	if metrics.Result(nil) != "success" {
+		t.Error("Expected success for nil error")
+	}
+	if metrics.Result(errors.New("boom")) != "error" {
+		t.Error("Expected error for non-nil error")
+	}
+}
+
+func TestRegistryGathers(t *testing.T) {
+	metrics.ReadingsStored.WithLabelValues("valid").Inc()
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	found := false
+	for _, f := range families {
+		if f.GetName() == "energy_worker_readings_stored_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected energy_worker_readings_stored_total to be exposed")
+	}
+}
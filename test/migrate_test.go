@@ -0,0 +1,183 @@
+package anomaly_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/migrate"
+)
+
+func TestLoad_OrdersByVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0010_add_index.up.sql":   {Data: []byte("CREATE INDEX i ON t (c);")},
+		"0002_create_t.up.sql":    {Data: []byte("CREATE TABLE t (c INT);")},
+		"0002_create_t.down.sql":  {Data: []byte("DROP TABLE t;")},
+		"0010_add_index.down.sql": {Data: []byte("DROP INDEX i;")},
+		"0003_backfill.up.sql":    {Data: []byte("UPDATE t SET c = 1;")},
+	}
+
+	migrations, err := migrate.Load(fsys)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	var versions []int64
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	if len(versions) != 3 || versions[0] != 2 || versions[1] != 3 || versions[2] != 10 {
+		t.Fatalf("versions = %v, want [2 3 10]", versions)
+	}
+	if migrations[0].Name != "create_t" || migrations[0].Down != "DROP TABLE t;" {
+		t.Errorf("migration 2 = %+v", migrations[0])
+	}
+	if migrations[1].Down != "" {
+		t.Errorf("migration 3 should have no down file")
+	}
+	if len(migrations[0].Checksum) != 64 {
+		t.Errorf("checksum = %q, want SHA-256 hex", migrations[0].Checksum)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{"bad name", fstest.MapFS{"create.sql": {Data: []byte("SELECT 1;")}}, "invalid migration file name"},
+		{"no up file", fstest.MapFS{"0001_init.down.sql": {Data: []byte("SELECT 1;")}}, "has no up file"},
+		{"two names", fstest.MapFS{
+			"0001_init.up.sql":  {Data: []byte("SELECT 1;")},
+			"0001_other.up.sql": {Data: []byte("SELECT 1;")},
+		}, "has two names"},
+		{"zero version", fstest.MapFS{"0000_init.up.sql": {Data: []byte("SELECT 1;")}}, "invalid migration version"},
+		{"unknown variant", fstest.MapFS{"0001_init.mysql.up.sql": {Data: []byte("SELECT 1;")}}, "invalid migration file name"},
+		{"missing variant", fstest.MapFS{"0001_init.timescale.up.sql": {Data: []byte("SELECT 1;")}}, "has no postgres variant"},
+		{"common and variant", fstest.MapFS{
+			"0001_init.up.sql":           {Data: []byte("SELECT 1;")},
+			"0001_init.timescale.up.sql": {Data: []byte("SELECT 1;")},
+			"0001_init.postgres.up.sql":  {Data: []byte("SELECT 1;")},
+		}, "both a common and a timescale file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := migrate.Load(tt.fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelect_Variants(t *testing.T) {
+	migrations, err := migrate.Load(fstest.MapFS{
+		"0001_init.up.sql":               {Data: []byte("CREATE TABLE t (c INT);")},
+		"0002_storage.timescale.up.sql":  {Data: []byte("SELECT create_hypertable('t', 'c');")},
+		"0002_storage.postgres.up.sql":   {Data: []byte("CREATE TABLE p (c INT) PARTITION BY RANGE (c);")},
+		"0002_storage.postgres.down.sql": {Data: []byte("DROP TABLE p;")},
+		"0003_index.up.sql":              {Data: []byte("CREATE INDEX i ON t (c);")},
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(migrations) != 4 {
+		t.Fatalf("len(migrations) = %d, want 4", len(migrations))
+	}
+
+	for _, variant := range []string{migrate.VariantTimescale, migrate.VariantPostgres} {
+		selected := migrate.Select(migrations, variant)
+		if len(selected) != 3 {
+			t.Fatalf("Select(%s) returned %d migrations, want 3", variant, len(selected))
+		}
+		if selected[1].Version != 2 || selected[1].Variant != variant {
+			t.Errorf("Select(%s)[1] = %d %q, want version 2 for the variant", variant, selected[1].Version, selected[1].Variant)
+		}
+	}
+
+	pg := migrate.Select(migrations, migrate.VariantPostgres)[1]
+	ts := migrate.Select(migrations, migrate.VariantTimescale)[1]
+	if pg.Checksum == ts.Checksum {
+		t.Errorf("variants should have their own checksums")
+	}
+	if pg.Down == "" || ts.Down != "" {
+		t.Errorf("down files should belong to their variant")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	migrations, err := migrate.Load(fstest.MapFS{
+		"0001_init.up.sql":  {Data: []byte("CREATE TABLE t (c INT);")},
+		"0002_index.up.sql": {Data: []byte("CREATE INDEX i ON t (c);")},
+		"0003_more.up.sql":  {Data: []byte("ALTER TABLE t ADD d INT;")},
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	now := time.Now()
+	applied := map[int64]migrate.AppliedMigration{
+		1: {Version: 1, Name: "init", Checksum: migrations[0].Checksum, AppliedAt: now},
+		2: {Version: 2, Name: "index", Checksum: "edited", AppliedAt: now},
+		7: {Version: 7, Name: "newer", Checksum: "x", AppliedAt: now},
+	}
+
+	statuses := migrate.Plan(migrations, applied)
+	if len(statuses) != 4 {
+		t.Fatalf("len(statuses) = %d, want 4", len(statuses))
+	}
+
+	if s := statuses[0]; s.AppliedAt == nil || s.Modified || s.Missing {
+		t.Errorf("migration 1 = %+v, want applied", s)
+	}
+	if s := statuses[1]; !s.Modified {
+		t.Errorf("migration 2 = %+v, want modified", s)
+	}
+	if s := statuses[2]; s.AppliedAt != nil {
+		t.Errorf("migration 3 = %+v, want pending", s)
+	}
+	if s := statuses[3]; s.Version != 7 || !s.Missing {
+		t.Errorf("migration 7 = %+v, want missing", s)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		t.Fatalf("Embedded() error = %v", err)
+	}
+	for _, variant := range []string{migrate.VariantTimescale, migrate.VariantPostgres} {
+		selected := migrate.Select(migrations, variant)
+		if len(selected) == 0 || selected[0].Version != 1 {
+			t.Fatalf("%s migrations should start at version 1", variant)
+		}
+		for i, m := range selected {
+			if m.Version != int64(i+1) {
+				t.Errorf("%s migration %d_%s: versions should be contiguous from 1", variant, m.Version, m.Name)
+			}
+			if m.Down == "" {
+				t.Errorf("%s migration %d_%s has no down file", variant, m.Version, m.Name)
+			}
+		}
+	}
+}
+
+func TestLoad_NoTransaction(t *testing.T) {
+	migrations, err := migrate.Load(fstest.MapFS{
+		"0001_init.up.sql":    {Data: []byte("CREATE TABLE t (c INT);")},
+		"0002_refresh.up.sql": {Data: []byte("-- migrate:no-transaction\nCALL refresh(1);\nCALL refresh(2);\n")},
+		"0003_comment.up.sql": {Data: []byte("-- refreshes, see migrate:no-transaction\nCALL refresh(3);\n")},
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	for i, want := range []bool{false, true, false} {
+		if migrations[i].NoTransaction != want {
+			t.Errorf("migration %d NoTransaction = %v, want %v", migrations[i].Version, migrations[i].NoTransaction, want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package anomaly_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/service"
+	"go.uber.org/zap"
+)
+
+// offlineConfig returns the test configuration with offline detection
+// settings
+func offlineConfig() *config.Config {
+	cfg := testConfig()
+	cfg.RabbitMQ.OfflineRoutingKey = "meter.offline"
+	cfg.RabbitMQ.BackOnlineRoutingKey = "meter.back_online"
+	cfg.Offline = config.OfflineConfig{
+		CheckInterval:   time.Minute,
+		After:           15 * time.Minute,
+		BatchSize:       100,
+		MissedIntervals: 3,
+		MinAfter:        time.Minute,
+	}
+	return cfg
+}
+
+// report processes a message of fingerprint received at receivedAt with a
+// voltage reading a second earlier
+func report(t *testing.T, processor *service.ProcessorService, fingerprint string, receivedAt time.Time) {
+	t.Helper()
+
+	receivedAt = receivedAt.Truncate(time.Second)
+	requestID := fmt.Sprintf("%s-%d", fingerprint, receivedAt.Unix())
+	delivery := ingestDeliveryAt(t, requestID, fingerprint, receivedAt, receivedAt.Add(-time.Second), map[string]string{"voltage": "220"})
+	if err := processor.ProcessMessage(context.Background(), delivery); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// offlineMetrics counts the metrics currently marked offline
+func offlineMetrics(t *testing.T, pool *pgxpool.Pool) int {
+	t.Helper()
+	return countRows(t, pool, "meter_metric_status", "offline_since IS NOT NULL")
+}
+
+func TestMetricStatus_TracksNewestSighting(t *testing.T) {
+	pool := testDB(t)
+	processor, _ := newTestProcessor(t, pool, offlineConfig())
+	ctx := context.Background()
+
+	receivedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	older := ingestDeliveryAt(t, "req-2", "meter-a", receivedAt.Add(time.Minute), receivedAt.Add(-time.Hour), map[string]string{"voltage": "220"})
+	newer := ingestDeliveryAt(t, "req-1", "meter-a", receivedAt, receivedAt.Add(-time.Minute), map[string]string{"voltage": "221"})
+	if err := processor.ProcessMessage(ctx, newer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Received later but reporting an older reading
+	if err := processor.ProcessMessage(ctx, older); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var lastReading, lastReceived time.Time
+	err := pool.QueryRow(ctx, `SELECT last_reading_at, last_received_at FROM meter_metric_status WHERE metric_name = 'voltage'`).
+		Scan(&lastReading, &lastReceived)
+	if err != nil {
+		t.Fatalf("Failed to read metric status: %v", err)
+	}
+	if !lastReading.Equal(receivedAt.Add(-time.Minute)) {
+		t.Errorf("Expected the newest reading timestamp kept, got %v", lastReading)
+	}
+	if !lastReceived.Equal(receivedAt.Add(time.Minute)) {
+		t.Errorf("Expected the newest receive time, got %v", lastReceived)
+	}
+}
+
+func TestOfflineMonitor_IgnoresSilenceWhileBacklogDrains(t *testing.T) {
+	pool := testDB(t)
+	cfg := offlineConfig()
+	processor, repo := newTestProcessor(t, pool, cfg)
+	monitor := service.NewOfflineMonitor(repo, cfg, zap.NewNop())
+	ctx := context.Background()
+
+	// A backlog from two hours ago: meter-a is quiet for only a minute of it
+	start := time.Now().Add(-2 * time.Hour)
+	report(t, processor, "meter-a", start)
+	report(t, processor, "meter-b", start.Add(time.Minute))
+
+	if err := monitor.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := offlineMetrics(t, pool); n != 0 {
+		t.Fatalf("Expected no metric offline while the backlog drains, got %d", n)
+	}
+
+	// Caught up: meter-a has been silent for two hours of processed data
+	report(t, processor, "meter-b", time.Now())
+	if err := monitor.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := offlineMetrics(t, pool); n != 1 {
+		t.Errorf("Expected meter-a offline, got %d offline metrics", n)
+	}
+	if n := countRows(t, pool, "event_outbox", "routing_key = 'meter.offline'"); n != 1 {
+		t.Errorf("Expected 1 meter.offline event, got %d", n)
+	}
+}
+
+func TestOfflineMonitor_UsesLearnedInterval(t *testing.T) {
+	pool := testDB(t)
+	cfg := offlineConfig()
+	processor, repo := newTestProcessor(t, pool, cfg)
+	monitor := service.NewOfflineMonitor(repo, cfg, zap.NewNop())
+	ctx := context.Background()
+
+	// meter-a reports every minute and stops 8 minutes ago: well within
+	// OFFLINE_AFTER, but 3 missed intervals
+	now := time.Now()
+	for i := 10; i >= 8; i-- {
+		report(t, processor, "meter-a", now.Add(-time.Duration(i)*time.Minute))
+	}
+	// meter-b reported once, so its interval is unknown
+	report(t, processor, "meter-b", now.Add(-10*time.Minute))
+	report(t, processor, "meter-c", now)
+
+	var seconds int64
+	err := pool.QueryRow(ctx, `
+		SELECT extract(epoch FROM expected_interval)::bigint
+		FROM meter_metric_status s JOIN meter_clients c ON c.id = s.client_id
+		WHERE c.client_fingerprint = 'meter-a'
+	`).Scan(&seconds)
+	if err != nil {
+		t.Fatalf("Failed to read expected interval: %v", err)
+	}
+	if seconds != 60 {
+		t.Errorf("Expected a learned interval of 60s, got %ds", seconds)
+	}
+
+	if err := monitor.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var fingerprint string
+	err = pool.QueryRow(ctx, `
+		SELECT c.client_fingerprint
+		FROM meter_metric_status s JOIN meter_clients c ON c.id = s.client_id
+		WHERE s.offline_since IS NOT NULL
+	`).Scan(&fingerprint)
+	if err != nil {
+		t.Fatalf("Expected exactly one offline metric: %v", err)
+	}
+	if fingerprint != "meter-a" {
+		t.Errorf("Expected meter-a offline, got %s", fingerprint)
+	}
+}
+
+func TestOfflineMonitor_ClosesGapAtFirstReadingAfterIt(t *testing.T) {
+	pool := testDB(t)
+	cfg := offlineConfig()
+	processor, repo := newTestProcessor(t, pool, cfg)
+	monitor := service.NewOfflineMonitor(repo, cfg, zap.NewNop())
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	report(t, processor, "meter-a", now.Add(-time.Hour))
+	report(t, processor, "meter-b", now)
+	if err := monitor.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := countRows(t, pool, "reading_gaps", "gap_end IS NULL"); n != 1 {
+		t.Fatalf("Expected 1 open gap, got %d", n)
+	}
+
+	// Two readings after the gap; it closes at the first one
+	report(t, processor, "meter-a", now.Add(-2*time.Minute))
+	report(t, processor, "meter-a", now.Add(-time.Minute))
+	if err := monitor.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var gapStart, gapEnd time.Time
+	err := pool.QueryRow(ctx, `SELECT gap_start, gap_end FROM reading_gaps`).Scan(&gapStart, &gapEnd)
+	if err != nil {
+		t.Fatalf("Failed to read gap: %v", err)
+	}
+	if !gapStart.Equal(now.Add(-time.Hour - time.Second)) {
+		t.Errorf("Expected the gap to start at the last reading, got %v", gapStart)
+	}
+	if !gapEnd.Equal(now.Add(-2*time.Minute - time.Second)) {
+		t.Errorf("Expected the gap to end at the first reading after it, got %v", gapEnd)
+	}
+	if n := offlineMetrics(t, pool); n != 0 {
+		t.Errorf("Expected meter-a back online, got %d offline metrics", n)
+	}
+	if n := countRows(t, pool, "event_outbox", "routing_key = 'meter.back_online'"); n != 1 {
+		t.Errorf("Expected 1 meter.back_online event, got %d", n)
+	}
+}
+
+func TestMarkMetricsOffline_FallsBackWithoutLearnedInterval(t *testing.T) {
+	pool := testDB(t)
+	cfg := offlineConfig()
+	processor, repo := newTestProcessor(t, pool, cfg)
+	ctx := context.Background()
+
+	now := time.Now()
+	report(t, processor, "meter-a", now.Add(-10*time.Minute))
+	report(t, processor, "meter-b", now)
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	gaps, err := repo.MarkMetricsOfflineTx(ctx, tx, repository.OfflineThresholds{
+		After:           15 * time.Minute,
+		MissedIntervals: 3,
+		MinAfter:        time.Minute,
+	}, 100)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(gaps) != 0 {
+		t.Errorf("Expected OFFLINE_AFTER to apply without a learned interval, got %d gaps", len(gaps))
+	}
+
+	gaps, err = repo.MarkMetricsOfflineTx(ctx, tx, repository.OfflineThresholds{
+		After:           5 * time.Minute,
+		MissedIntervals: 3,
+		MinAfter:        time.Minute,
+	}, 100)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(gaps) != 1 {
+		t.Errorf("Expected meter-a offline after 5m, got %d gaps", len(gaps))
+	}
+}
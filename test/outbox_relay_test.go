@@ -0,0 +1,431 @@
+package anomaly_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/service"
+	"go.uber.org/zap"
+)
+
+type failedMark struct {
+	id          int64
+	lastError   string
+	nextAttempt time.Time
+}
+
+type fakeOutboxStore struct {
+	pending []db.OutboxEvent
+	leases  []time.Duration
+	sent    []int64
+	failed  []failedMark
+	parked  []int64
+	calls   []string
+	onClaim func()
+}
+
+func (f *fakeOutboxStore) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]db.OutboxEvent, error) {
+	f.calls = append(f.calls, "claim")
+	f.leases = append(f.leases, lease)
+	if f.onClaim != nil {
+		f.onClaim()
+	}
+	n := min(limit, len(f.pending))
+	claimed := f.pending[:n]
+	f.pending = f.pending[n:]
+	return claimed, nil
+}
+
+func (f *fakeOutboxStore) MarkOutboxEventsSent(ctx context.Context, ids []int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.calls = append(f.calls, "sent")
+	f.sent = append(f.sent, ids...)
+	return nil
+}
+
+func (f *fakeOutboxStore) MarkOutboxEventFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) error {
+	f.calls = append(f.calls, "failed")
+	f.failed = append(f.failed, failedMark{id: id, lastError: lastError, nextAttempt: nextAttemptAt})
+	return nil
+}
+
+func (f *fakeOutboxStore) ParkOutboxEvent(ctx context.Context, id int64, lastError string) error {
+	f.calls = append(f.calls, "parked")
+	f.parked = append(f.parked, id)
+	return nil
+}
+
+type fakeBatchPublisher struct {
+	store   *fakeOutboxStore
+	results map[string]error // by routing key
+	msgs    []mq.Message
+	during  func() // runs while the batch is published
+}
+
+func (f *fakeBatchPublisher) PublishBatch(ctx context.Context, msgs []mq.Message) []error {
+	f.store.calls = append(f.store.calls, "publish")
+	f.msgs = append(f.msgs, msgs...)
+	if f.during != nil {
+		f.during()
+	}
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = f.results[msg.RoutingKey]
+	}
+	return errs
+}
+
+func outboxEvent(id int64, routingKey string, attempts int) db.OutboxEvent {
+	return db.OutboxEvent{
+		ID:         id,
+		EventID:    uuid.New(),
+		RoutingKey: routingKey,
+		Payload:    []byte(`{}`),
+		Attempts:   attempts,
+	}
+}
+
+func relayConfig() config.OutboxConfig {
+	return config.OutboxConfig{
+		PollInterval:        time.Second,
+		BatchSize:           10,
+		RetryInitialBackoff: time.Second,
+		RetryMaxBackoff:     time.Minute,
+		ClaimLease:          30 * time.Second,
+		MaxAttempts:         5,
+	}
+}
+
+func TestOutboxRelay_RecordsResultsAfterPublishing(t *testing.T) {
+	events := []db.OutboxEvent{
+		outboxEvent(1, "meter.reading.accepted", 0),
+		outboxEvent(2, "meter.broken", 2),
+		outboxEvent(3, "meter.reading.accepted", 0),
+	}
+	store := &fakeOutboxStore{pending: events}
+	publisher := &fakeBatchPublisher{store: store, results: map[string]error{
+		"meter.broken": errors.New("channel closed"),
+	}}
+	relay := service.NewOutboxRelay(store, publisher, relayConfig(), zap.NewNop())
+
+	before := time.Now()
+	n, err := relay.RelayBatch(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 claimed events, got %d", n)
+	}
+
+	expected := []string{"claim", "publish", "failed", "sent"}
+	if len(store.calls) != len(expected) {
+		t.Fatalf("Expected calls %v, got %v", expected, store.calls)
+	}
+	for i := range expected {
+		if store.calls[i] != expected[i] {
+			t.Fatalf("Expected calls %v, got %v", expected, store.calls)
+		}
+	}
+
+	if store.leases[0] != 30*time.Second {
+		t.Errorf("Expected a 30s claim lease, got %v", store.leases[0])
+	}
+	if len(store.sent) != 2 || store.sent[0] != 1 || store.sent[1] != 3 {
+		t.Errorf("Expected events 1 and 3 marked sent, got %v", store.sent)
+	}
+	if len(store.failed) != 1 || store.failed[0].id != 2 {
+		t.Fatalf("Expected event 2 marked failed, got %+v", store.failed)
+	}
+	if store.failed[0].lastError != "channel closed" {
+		t.Errorf("Expected the publish error recorded, got %q", store.failed[0].lastError)
+	}
+	// Third attempt: initial backoff doubled twice, with jitter
+	if delay := store.failed[0].nextAttempt.Sub(before); delay < 2*time.Second || delay > 5*time.Second {
+		t.Errorf("Expected a retry in 2-4s, got %v", delay)
+	}
+
+	for i, msg := range publisher.msgs {
+		if msg.MessageID != events[i].EventID.String() {
+			t.Errorf("Expected message %d to carry the outbox event ID, got %s", i, msg.MessageID)
+		}
+	}
+}
+
+func TestOutboxRelay_ParksUnroutableEventsAfterMaxAttempts(t *testing.T) {
+	unroutable := &mq.UnroutableError{Exchange: "energy-metering.worker.exchange", RoutingKey: "meter.unbound"}
+	store := &fakeOutboxStore{pending: []db.OutboxEvent{
+		outboxEvent(1, "meter.unbound", 0),
+		outboxEvent(2, "meter.unbound", 4),
+	}}
+	publisher := &fakeBatchPublisher{store: store, results: map[string]error{"meter.unbound": unroutable}}
+	relay := service.NewOutboxRelay(store, publisher, relayConfig(), zap.NewNop())
+
+	before := time.Now()
+	if _, err := relay.RelayBatch(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(store.failed) != 1 || store.failed[0].id != 1 {
+		t.Fatalf("Expected event 1 rescheduled, got %+v", store.failed)
+	}
+	if delay := store.failed[0].nextAttempt.Sub(before); delay < time.Minute || delay > time.Minute+time.Second {
+		t.Errorf("Expected an unroutable event to wait the max backoff, got %v", delay)
+	}
+	if len(store.parked) != 1 || store.parked[0] != 2 {
+		t.Errorf("Expected event 2 parked on its 5th attempt, got %v", store.parked)
+	}
+	if len(store.sent) != 0 {
+		t.Errorf("Expected nothing marked sent, got %v", store.sent)
+	}
+}
+
+func TestOutboxRelay_StartRelaysRightAway(t *testing.T) {
+	store := &fakeOutboxStore{pending: []db.OutboxEvent{outboxEvent(1, "meter.reading.accepted", 0)}}
+	claimed := make(chan struct{})
+	store.onClaim = func() {
+		if len(store.calls) == 1 {
+			close(claimed)
+		}
+	}
+	publisher := &fakeBatchPublisher{store: store}
+	cfg := relayConfig()
+	cfg.PollInterval = time.Hour
+	relay := service.NewOutboxRelay(store, publisher, cfg, zap.NewNop())
+
+	relay.Start()
+	select {
+	case <-claimed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a first pass without waiting for the poll interval")
+	}
+	if err := relay.Stop(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(store.sent) != 1 {
+		t.Errorf("Expected the pending event sent, got %v", store.sent)
+	}
+}
+
+func TestOutboxRelay_EmptyOutbox(t *testing.T) {
+	store := &fakeOutboxStore{}
+	publisher := &fakeBatchPublisher{store: store}
+	relay := service.NewOutboxRelay(store, publisher, relayConfig(), zap.NewNop())
+
+	n, err := relay.RelayBatch(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("Expected no claimed events, got %d", n)
+	}
+	if len(publisher.msgs) != 0 {
+		t.Errorf("Expected nothing published, got %d messages", len(publisher.msgs))
+	}
+}
+
+func TestOutboxRelay_RecordsResultsAfterShutdown(t *testing.T) {
+	store := &fakeOutboxStore{pending: []db.OutboxEvent{outboxEvent(1, "meter.reading.accepted", 0)}}
+	publisher := &fakeBatchPublisher{store: store}
+	relay := service.NewOutboxRelay(store, publisher, relayConfig(), zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	publisher.during = cancel
+	if _, err := relay.RelayBatch(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(store.sent) != 1 {
+		t.Errorf("Expected the confirmed event marked sent, got %v", store.sent)
+	}
+}
+
+func TestProcessMessage_QueuesAcceptedEvents(t *testing.T) {
+	pool := testDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	delivery := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})
+	if err := processor.ProcessMessage(ctx, delivery); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	events, err := repo.ClaimOutboxEvents(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 queued event, got %d", len(events))
+	}
+	if events[0].RoutingKey != "meter.reading.accepted" {
+		t.Errorf("Expected routing key meter.reading.accepted, got %s", events[0].RoutingKey)
+	}
+	var event mq.ProcessedEvent
+	if err := json.Unmarshal(events[0].Payload, &event); err != nil {
+		t.Fatalf("Failed to decode payload: %v", err)
+	}
+	if event.MetricName != "voltage" || event.MetricValue != 220 {
+		t.Errorf("Expected voltage 220, got %s %v", event.MetricName, event.MetricValue)
+	}
+	if event.ReadingTimestamp != readingAt.UTC().Format(time.RFC3339) {
+		t.Errorf("Expected reading timestamp %s, got %s", readingAt.UTC().Format(time.RFC3339), event.ReadingTimestamp)
+	}
+}
+
+func TestClaimOutboxEvents_LeaseHidesClaimedEvents(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	ctx := context.Background()
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	queued := []db.OutboxEvent{
+		{RoutingKey: "meter.reading.accepted", Payload: []byte(`{"n":1}`)},
+		{RoutingKey: "meter.reading.accepted", Payload: []byte(`{"n":2}`)},
+	}
+	if err := repo.InsertOutboxEventsTx(ctx, tx, queued); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	claimed, err := repo.ClaimOutboxEvents(ctx, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(claimed) != 2 {
+		t.Fatalf("Expected 2 claimed events, got %d", len(claimed))
+	}
+	again, err := repo.ClaimOutboxEvents(ctx, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(again) != 0 {
+		t.Errorf("Expected leased events hidden, got %d", len(again))
+	}
+
+	if err := repo.MarkOutboxEventsSent(ctx, []int64{claimed[0].ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := repo.MarkOutboxEventFailed(ctx, claimed[1].ID, "unroutable", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	retried, err := repo.ClaimOutboxEvents(ctx, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(retried) != 1 || retried[0].ID != claimed[1].ID {
+		t.Fatalf("Expected only the failed event due again, got %+v", retried)
+	}
+	if retried[0].Attempts != 1 || retried[0].LastError == nil || *retried[0].LastError != "unroutable" {
+		t.Errorf("Expected 1 recorded attempt with its error, got %d %v", retried[0].Attempts, retried[0].LastError)
+	}
+	if n := countRows(t, pool, "event_outbox", "sent_at IS NOT NULL"); n != 1 {
+		t.Errorf("Expected 1 sent event, got %d", n)
+	}
+}
+
+func TestDeleteFinishedOutboxEventsTx_KeepsPendingEvents(t *testing.T) {
+	pool := testDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	delivery := ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220", "current": "5"})
+	if err := processor.ProcessMessage(ctx, delivery); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	claimed, err := repo.ClaimOutboxEvents(ctx, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(claimed) != 2 {
+		t.Fatalf("Expected 2 claimed events, got %d", len(claimed))
+	}
+	if err := repo.MarkOutboxEventsSent(ctx, []int64{claimed[0].ID}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	deleted, err := repo.DeleteFinishedOutboxEventsTx(ctx, tx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if deleted != 1 {
+		t.Errorf("Expected the sent event purged, got %d", deleted)
+	}
+	if n := countRows(t, pool, "event_outbox", "id = $1", claimed[1].ID); n != 1 {
+		t.Errorf("Expected the pending event kept, got %d", n)
+	}
+}
+
+func TestParkOutboxEvent_StopsRetriesUntilPurged(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	ctx := context.Background()
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	queued := []db.OutboxEvent{{RoutingKey: "meter.unbound", Payload: []byte(`{}`)}}
+	if err := repo.InsertOutboxEventsTx(ctx, tx, queued); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	claimed, err := repo.ClaimOutboxEvents(ctx, 10, 0)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("Expected 1 claimed event, got %d (%v)", len(claimed), err)
+	}
+	if err := repo.ParkOutboxEvent(ctx, claimed[0].ID, "unroutable"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	again, err := repo.ClaimOutboxEvents(ctx, 10, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(again) != 0 {
+		t.Errorf("Expected the parked event not to be claimed, got %d", len(again))
+	}
+
+	tx, err = repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	deleted, err := repo.DeleteFinishedOutboxEventsTx(ctx, tx, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected the parked event purged, got %d deleted", deleted)
+	}
+}
@@ -0,0 +1,205 @@
+package anomaly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/septivank/energy-metering-worker/internal/service"
+	"go.uber.org/zap"
+)
+
+// partitionedDB returns a test database whose readings table is natively
+// partitioned, skipping the test on TimescaleDB
+func partitionedDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	pool := testDB(t)
+	var partitioned bool
+	err := pool.QueryRow(context.Background(), `SELECT relkind = 'p' FROM pg_class WHERE oid = 'meter_readings_raw'::regclass`).Scan(&partitioned)
+	if err != nil {
+		t.Fatalf("Failed to check partitioning: %v", err)
+	}
+	if !partitioned {
+		t.Skip("readings table not natively partitioned")
+	}
+	return pool
+}
+
+// partitionOf returns the partition holding the reading of metric at ts
+func partitionOf(t *testing.T, pool *pgxpool.Pool, metric string, ts time.Time) string {
+	t.Helper()
+
+	var part string
+	err := pool.QueryRow(context.Background(), `
+		SELECT tableoid::regclass::text FROM meter_readings_raw
+		WHERE metric_name = $1 AND reading_timestamp = $2
+	`, metric, ts).Scan(&part)
+	if err != nil {
+		t.Fatalf("Failed to find reading %s at %v: %v", metric, ts, err)
+	}
+	return part
+}
+
+// partitionExists reports whether the daily partition of day exists
+func partitionExists(t *testing.T, pool *pgxpool.Pool, day time.Time) bool {
+	t.Helper()
+
+	var exists bool
+	name := "meter_readings_raw_p" + day.UTC().Format("20060102")
+	if err := pool.QueryRow(context.Background(), `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+		t.Fatalf("Failed to look up %s: %v", name, err)
+	}
+	return exists
+}
+
+func TestProcessMessage_StoresBackdatedReading(t *testing.T) {
+	pool := partitionedDB(t)
+	processor, _ := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	// Six days late, within the default tolerance of a week
+	readingAt := time.Now().AddDate(0, 0, -6).Truncate(time.Second)
+	if err := processor.ProcessMessage(ctx, ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := "meter_readings_raw_p" + readingAt.UTC().Format("20060102")
+	if part := partitionOf(t, pool, "voltage", readingAt); part != want {
+		t.Errorf("Expected the reading in %s, got %s", want, part)
+	}
+	if n := countRows(t, pool, "meter_readings_raw", "validation_status = 'valid'"); n != 1 {
+		t.Errorf("Expected the late reading stored as valid, got %d", n)
+	}
+}
+
+func TestPartitionMaintainer_MovesReadingsOutOfDefaultPartition(t *testing.T) {
+	pool := partitionedDB(t)
+	cfg := testConfig()
+	cfg.Validation.TimestampToleranceMinutes = 30 * 24 * 60
+	cfg.Partition.PremakeDays = 1
+	processor, repo := newTestProcessor(t, pool, cfg)
+	maintainer := service.NewPartitionMaintainer(repo, cfg, zap.NewNop())
+	ctx := context.Background()
+
+	// Older than the partitions made by the migration, but within tolerance
+	readingAt := time.Now().AddDate(0, 0, -20).Truncate(time.Second)
+	if err := processor.ProcessMessage(ctx, ingestDelivery(t, "req-1", "meter-a", readingAt, map[string]string{"voltage": "220"})); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if part := partitionOf(t, pool, "voltage", readingAt); part != "meter_readings_raw_default" {
+		t.Fatalf("Expected the reading in the default partition, got %s", part)
+	}
+
+	if err := maintainer.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := "meter_readings_raw_p" + readingAt.UTC().Format("20060102")
+	if part := partitionOf(t, pool, "voltage", readingAt); part != want {
+		t.Errorf("Expected the reading moved to %s, got %s", want, part)
+	}
+	if n := countRows(t, pool, "meter_readings_raw_default", ""); n != 0 {
+		t.Errorf("Expected the default partition emptied, got %d readings", n)
+	}
+}
+
+func TestReadingPartitions_CreatesAndDropsDays(t *testing.T) {
+	pool := partitionedDB(t)
+	_, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	// Days well before the partitions made by the migration
+	from := time.Now().UTC().AddDate(0, 0, -40)
+	to := from.AddDate(0, 0, 2)
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	created, err := repo.CreateReadingPartitionsTx(ctx, tx, from, to)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if created != 3 {
+		t.Errorf("Expected 3 partitions created, got %d", created)
+	}
+	if again, err := repo.CreateReadingPartitionsTx(ctx, tx, from, to); err != nil || again != 0 {
+		t.Errorf("Expected existing partitions kept, got %d created (err %v)", again, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if !partitionExists(t, pool, day) {
+			t.Errorf("Expected a partition for %s", day.Format("2006-01-02"))
+		}
+	}
+
+	tx, err = repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	dropped, err := repo.DropReadingPartitionsTx(ctx, tx, to)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if dropped != 2 {
+		t.Errorf("Expected the 2 days before %s dropped, got %d", to.Format("2006-01-02"), dropped)
+	}
+	if partitionExists(t, pool, from) || !partitionExists(t, pool, to) {
+		t.Errorf("Expected only the days before %s dropped", to.Format("2006-01-02"))
+	}
+}
+
+func TestPartitionMaintainer_AppliesRetentionToHypertable(t *testing.T) {
+	pool := testDB(t)
+	_, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hypertable, err := repo.IsReadingsHypertableTx(ctx, tx)
+	tx.Rollback(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hypertable {
+		t.Skip("readings table not a hypertable")
+	}
+
+	policies := func(dropAfter string) int {
+		return countRows(t, pool, "timescaledb_information.jobs", `
+			proc_name = 'policy_retention' AND hypertable_schema = current_schema()
+			AND hypertable_name = 'meter_readings_raw' AND (config->>'drop_after')::interval = $1::interval
+		`, dropAfter)
+	}
+
+	for _, tt := range []struct {
+		days   int
+		policy string
+		want   int
+	}{
+		{30, "30 days", 1},
+		{30, "90 days", 0},
+		{0, "30 days", 0},
+	} {
+		cfg := testConfig()
+		cfg.Partition.RetentionDays = tt.days
+		maintainer := service.NewPartitionMaintainer(repo, cfg, zap.NewNop())
+		if err := maintainer.RunOnce(ctx); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if n := policies(tt.policy); n != tt.want {
+			t.Errorf("retention %d days: expected %d policies dropping after %s, got %d", tt.days, tt.want, tt.policy, n)
+		}
+	}
+}
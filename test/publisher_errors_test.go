@@ -0,0 +1,31 @@
+package anomaly_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/mq"
+)
+
+func TestUnroutableError_MatchesSentinel(t *testing.T) {
+	err := fmt.Errorf("relay failed: %w", &mq.UnroutableError{
+		Exchange:   "energy-metering.worker.events.exchange",
+		RoutingKey: "meter.reading.accepted",
+		ReplyCode:  312,
+		ReplyText:  "NO_ROUTE",
+	})
+
+	if !errors.Is(err, mq.ErrUnroutable) {
+		t.Error("Expected UnroutableError to match ErrUnroutable")
+	}
+
+	if errors.Is(err, mq.ErrPublishNacked) {
+		t.Error("Expected UnroutableError not to match ErrPublishNacked")
+	}
+
+	var unroutable *mq.UnroutableError
+	if !errors.As(err, &unroutable) || unroutable.ReplyCode != 312 {
+		t.Error("Expected to extract reply code from UnroutableError")
+	}
+}
@@ -0,0 +1,164 @@
+package anomaly_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+)
+
+func TestInsertMeterReadingsTx_ReportsInsertedReadings(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	ctx := context.Background()
+
+	client, err := repo.UpsertClient(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	readingAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	reading := func(metric string, value float64) *db.MeterReading {
+		return &db.MeterReading{
+			ClientID:         client.ID,
+			MetricName:       metric,
+			MetricValue:      value,
+			ReadingTimestamp: readingAt,
+			ReceivedAt:       time.Now(),
+			ValidationStatus: "valid",
+		}
+	}
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := repo.InsertMeterReadingsTx(ctx, tx, []*db.MeterReading{reading("voltage", 220)}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// One batch mixing new readings with one already stored
+	inserted, err := repo.InsertMeterReadingsTx(ctx, tx, []*db.MeterReading{
+		reading("current", 5),
+		reading("voltage", 221),
+		reading("power", 1100),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []bool{true, false, true}
+	if len(inserted) != len(want) {
+		t.Fatalf("Expected %d results, got %v", len(want), inserted)
+	}
+	for i := range want {
+		if inserted[i] != want[i] {
+			t.Errorf("reading %d: expected inserted=%v, got %v", i+1, want[i], inserted[i])
+		}
+	}
+	if n := countRows(t, pool, "meter_readings_raw", ""); n != 3 {
+		t.Errorf("Expected 3 readings, got %d", n)
+	}
+	if n := countRows(t, pool, "meter_readings_raw", "metric_name = 'voltage' AND metric_value = 220"); n != 1 {
+		t.Errorf("Expected the first voltage reading kept, got %d", n)
+	}
+}
+
+func TestGetRecentReadingsForMetrics_NewestFirstPerMetric(t *testing.T) {
+	pool := testDB(t)
+	repo := repository.NewRepository(pool)
+	ctx := context.Background()
+
+	client, err := repo.UpsertClient(ctx, "meter-a", "10.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	other, err := repo.UpsertClient(ctx, "meter-b", "10.0.0.2", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Five voltage readings, two current readings and an anomalous one,
+	// stored out of order
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var readings []*db.MeterReading
+	add := func(reading *db.MeterReading) {
+		reading.ReceivedAt = time.Now()
+		if reading.ValidationStatus == "" {
+			reading.ValidationStatus = "valid"
+		}
+		readings = append(readings, reading)
+	}
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		add(&db.MeterReading{ClientID: client.ID, MetricName: "voltage", MetricValue: float64(220 + i), ReadingTimestamp: base.Add(time.Duration(i) * time.Minute)})
+	}
+	for _, i := range []int{1, 0} {
+		add(&db.MeterReading{ClientID: client.ID, MetricName: "current", MetricValue: float64(5 + i), ReadingTimestamp: base.Add(time.Duration(i) * time.Minute)})
+	}
+	add(&db.MeterReading{ClientID: client.ID, MetricName: "current", MetricValue: 500, ReadingTimestamp: base.Add(5 * time.Minute), ValidationStatus: "anomaly"})
+	add(&db.MeterReading{ClientID: other.ID, MetricName: "voltage", MetricValue: 100, ReadingTimestamp: base.Add(10 * time.Minute)})
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := repo.InsertMeterReadingsTx(ctx, tx, readings); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  map[string][]float64
+	}{
+		{
+			name:  "window shorter than the history",
+			limit: 3,
+			want:  map[string][]float64{"voltage": {224, 223, 222}, "current": {6, 5}},
+		},
+		{
+			name:  "window longer than the history",
+			limit: 10,
+			want:  map[string][]float64{"voltage": {224, 223, 222, 221, 220}, "current": {6, 5}},
+		},
+		{
+			name:  "single reading",
+			limit: 1,
+			want:  map[string][]float64{"voltage": {224}, "current": {6}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repo.GetRecentReadingsForMetrics(ctx, client.ID, []string{"voltage", "current", "power"}, tt.limit)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(got["power"]) != 0 {
+				t.Errorf("Expected no power history, got %v", got["power"])
+			}
+			for metric, want := range tt.want {
+				values := got[metric]
+				if len(values) != len(want) {
+					t.Errorf("Expected %s history %v, got %v", metric, want, values)
+					continue
+				}
+				for i := range want {
+					if values[i].Value != want[i] || (i > 0 && !values[i].Timestamp.Before(values[i-1].Timestamp)) {
+						t.Errorf("Expected %s history %v (newest first), got %v", metric, want, values)
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package anomaly_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/septivank/energy-metering-worker/internal/mq"
+)
+
+func TestRetryQueueName(t *testing.T) {
+	tests := []struct {
+		delay    time.Duration
+		expected string
+	}{
+		{5 * time.Second, "ingest.retry.5s"},
+		{30 * time.Second, "ingest.retry.30s"},
+		{5 * time.Minute, "ingest.retry.5m"},
+		{2 * time.Hour, "ingest.retry.2h"},
+		{1500 * time.Millisecond, "ingest.retry.1500ms"},
+	}
+
+	for _, tt := range tests {
+		if got := mq.RetryQueueName("ingest", tt.delay); got != tt.expected {
+			t.Errorf("RetryQueueName(%v) = %s, expected %s", tt.delay, got, tt.expected)
+		}
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  amqp.Table
+		expected int
+	}{
+		{"missing header", amqp.Table{}, 0},
+		{"nil headers", nil, 0},
+		{"int32", amqp.Table{mq.RetryCountHeader: int32(2)}, 2},
+		{"int64", amqp.Table{mq.RetryCountHeader: int64(3)}, 3},
+		{"unexpected type", amqp.Table{mq.RetryCountHeader: "1"}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := mq.RetryCount(tt.headers); got != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestPermanentError(t *testing.T) {
+	cause := errors.New("unexpected end of JSON input")
+	err := fmt.Errorf("processing failed: %w", mq.Permanent(cause))
+
+	if !mq.IsPermanent(err) {
+		t.Error("Expected wrapped permanent error to be detected")
+	}
+
+	if !errors.Is(err, cause) {
+		t.Error("Expected permanent error to unwrap to its cause")
+	}
+
+	if mq.IsPermanent(errors.New("connection reset by peer")) {
+		t.Error("Expected plain error to be treated as transient")
+	}
+
+	if mq.Permanent(nil) != nil {
+		t.Error("Expected Permanent(nil) to return nil")
+	}
+}
@@ -0,0 +1,295 @@
+package anomaly_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/septivank/energy-metering-worker/internal/config"
+	"github.com/septivank/energy-metering-worker/internal/db"
+	"github.com/septivank/energy-metering-worker/internal/migrate"
+	"github.com/septivank/energy-metering-worker/internal/repository"
+	"github.com/septivank/energy-metering-worker/internal/service"
+	"go.uber.org/zap"
+)
+
+// rollupDB returns a test database whose rollups are tables refreshed by the
+// worker, skipping the test on TimescaleDB
+func rollupDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	pool := testDB(t)
+	var maintained bool
+	err := pool.QueryRow(context.Background(), `SELECT relkind = 'r' FROM pg_class WHERE oid = 'meter_readings_15m'::regclass`).Scan(&maintained)
+	if err != nil {
+		t.Fatalf("Failed to check rollup tables: %v", err)
+	}
+	if !maintained {
+		t.Skip("rollups are continuous aggregates")
+	}
+	return pool
+}
+
+// storeReadings processes one message per value of metric, the i-th at
+// offsets[i] past base
+func storeReadings(t *testing.T, processor *service.ProcessorService, metric string, base time.Time, offsets []time.Duration, values []float64) {
+	t.Helper()
+
+	for i, offset := range offsets {
+		requestID := fmt.Sprintf("%s-%d", metric, i)
+		delivery := ingestDelivery(t, requestID, "meter-a", base.Add(offset), map[string]string{metric: fmt.Sprint(values[i])})
+		if err := processor.ProcessMessage(context.Background(), delivery); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+// rollupsOf gets the rollups of all metrics of client over the day of base
+func rollupsOf(t *testing.T, repo *repository.Repository, rollup repository.Rollup, client uuid.UUID, base time.Time) []db.ReadingRollup {
+	t.Helper()
+
+	day := base.Truncate(24 * time.Hour)
+	rollups, err := repo.GetRollups(context.Background(), rollup, client, nil, day, day.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return rollups
+}
+
+// expectBuckets checks the bucket starts and sample counts of rollups
+func expectBuckets(t *testing.T, name string, rollups []db.ReadingRollup, starts []time.Time, counts []int64) {
+	t.Helper()
+
+	if len(rollups) != len(starts) {
+		t.Fatalf("Expected %d %s buckets, got %+v", len(starts), name, rollups)
+	}
+	for i, ru := range rollups {
+		if !ru.Bucket.Equal(starts[i]) || ru.SampleCount != counts[i] {
+			t.Errorf("Expected %s bucket %v with %d readings, got %v with %d", name, starts[i], counts[i], ru.Bucket, ru.SampleCount)
+		}
+	}
+}
+
+// yesterday returns 10:00 UTC of the previous day
+func yesterday() time.Time {
+	return time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1).Add(10 * time.Hour)
+}
+
+func TestRefreshReadingRollup_AlignsBuckets(t *testing.T) {
+	pool := rollupDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	base := yesterday()
+	storeReadings(t, processor, "voltage", base,
+		[]time.Duration{7 * time.Minute, 14*time.Minute + 59*time.Second, 15 * time.Minute, 119 * time.Minute},
+		[]float64{220, 224, 222, 221})
+	client := clientID(t, pool, "meter-a")
+
+	tx, err := repo.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	// A range starting and ending mid-bucket covers the whole buckets
+	for _, rollup := range repository.Rollups {
+		if _, err := repo.RefreshRollupTx(ctx, tx, rollup, base.Add(10*time.Minute), base.Add(time.Hour+50*time.Minute)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	quarters := rollupsOf(t, repo, repository.Rollup15Min, client, base)
+	expectBuckets(t, "15m", quarters,
+		[]time.Time{base, base.Add(15 * time.Minute), base.Add(105 * time.Minute)},
+		[]int64{2, 1, 1})
+	if len(quarters) > 0 {
+		if q := quarters[0]; q.Min != 220 || q.Max != 224 || q.Avg != 222 || q.Last != 224 {
+			t.Errorf("Expected min 220, max 224, avg 222 and last 224, got %+v", q)
+		}
+	}
+	expectBuckets(t, "1h", rollupsOf(t, repo, repository.RollupHourly, client, base),
+		[]time.Time{base, base.Add(time.Hour)},
+		[]int64{3, 1})
+	expectBuckets(t, "1d", rollupsOf(t, repo, repository.RollupDaily, client, base),
+		[]time.Time{base.Truncate(24 * time.Hour)},
+		[]int64{4})
+}
+
+func TestGetRollups_FiltersMetricsAndRange(t *testing.T) {
+	pool := rollupDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	base := yesterday()
+	offsets := []time.Duration{0, time.Hour, 2 * time.Hour}
+	storeReadings(t, processor, "voltage", base, offsets, []float64{220, 221, 222})
+	storeReadings(t, processor, "current", base, offsets, []float64{5, 6, 7})
+	client := clientID(t, pool, "meter-a")
+
+	refresher := service.NewRollupRefresher(repo, config.RollupConfig{Lookback: 7 * 24 * time.Hour, BatchSize: 100}, zap.NewNop())
+	if err := refresher.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	all, err := repo.GetReadingsHourly(ctx, client, nil, base, base.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("Expected 2 hourly buckets of 2 metrics, got %+v", all)
+	}
+	if all[0].MetricName != "current" || all[1].MetricName != "current" || !all[0].Bucket.Before(all[1].Bucket) {
+		t.Errorf("Expected rollups ordered by metric and bucket, got %+v", all)
+	}
+
+	voltage, err := repo.GetReadingsHourly(ctx, client, []string{"voltage"}, base, base.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(voltage) != 3 {
+		t.Fatalf("Expected 3 voltage buckets, got %+v", voltage)
+	}
+	for _, ru := range voltage {
+		if ru.MetricName != "voltage" || ru.ClientID != client {
+			t.Errorf("Expected voltage rollups of %s, got %+v", client, ru)
+		}
+	}
+
+	other, err := repo.GetReadingsHourly(ctx, uuid.New(), nil, base, base.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(other) != 0 {
+		t.Errorf("Expected no rollups of another client, got %+v", other)
+	}
+}
+
+func TestRollupRefresher_RefreshesChangedBuckets(t *testing.T) {
+	pool := rollupDB(t)
+	processor, repo := newTestProcessor(t, pool, testConfig())
+	// A batch smaller than the changes, drained within one pass
+	refresher := service.NewRollupRefresher(repo, config.RollupConfig{Lookback: 7 * 24 * time.Hour, BatchSize: 2}, zap.NewNop())
+	ctx := context.Background()
+
+	base := yesterday()
+	storeReadings(t, processor, "voltage", base,
+		[]time.Duration{0, 15 * time.Minute, 30 * time.Minute, 45 * time.Minute, 60 * time.Minute},
+		[]float64{220, 221, 222, 223, 224})
+	client := clientID(t, pool, "meter-a")
+
+	if err := refresher.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := len(rollupsOf(t, repo, repository.Rollup15Min, client, base)); n != 5 {
+		t.Errorf("Expected 5 15m buckets, got %d", n)
+	}
+	if n := countRows(t, pool, "reading_rollup_invalidations", ""); n != 0 {
+		t.Errorf("Expected the logged changes drained, got %d left", n)
+	}
+
+	// The readings of the last bucket disappear; only its buckets change
+	if _, err := pool.Exec(ctx, `UPDATE meter_readings_15m SET sample_count = 99 WHERE bucket = $1`, base); err != nil {
+		t.Fatalf("Failed to mark untouched bucket: %v", err)
+	}
+	if _, err := pool.Exec(ctx, `DELETE FROM meter_readings_raw WHERE reading_timestamp = $1`, base.Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to delete readings: %v", err)
+	}
+	if err := refresher.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	quarters := rollupsOf(t, repo, repository.Rollup15Min, client, base)
+	expectBuckets(t, "15m", quarters,
+		[]time.Time{base, base.Add(15 * time.Minute), base.Add(30 * time.Minute), base.Add(45 * time.Minute)},
+		[]int64{99, 1, 1, 1})
+	expectBuckets(t, "1h", rollupsOf(t, repo, repository.RollupHourly, client, base),
+		[]time.Time{base},
+		[]int64{4})
+}
+
+func TestRollupRefresher_RefreshesChangesPastLookback(t *testing.T) {
+	pool := rollupDB(t)
+	_, repo := newTestProcessor(t, pool, testConfig())
+	refresher := service.NewRollupRefresher(repo, config.RollupConfig{Lookback: 7 * 24 * time.Hour, BatchSize: 100}, zap.NewNop())
+	ctx := context.Background()
+
+	client := uuid.New()
+	old := time.Now().UTC().Truncate(time.Hour).AddDate(0, 0, -8)
+	_, err := pool.Exec(ctx, `
+		INSERT INTO meter_clients (id, client_fingerprint, ip_address, first_seen_at, last_seen_at)
+		VALUES ($1, 'meter-a', '10.0.0.1', now(), now())
+	`, client)
+	if err != nil {
+		t.Fatalf("Failed to insert client: %v", err)
+	}
+	_, err = pool.Exec(ctx, `
+		INSERT INTO meter_readings_raw (client_id, metric_name, metric_value, reading_timestamp, received_at, validation_status)
+		VALUES ($1, 'voltage', 220, $2, now(), 'valid')
+	`, client, old)
+	if err != nil {
+		t.Fatalf("Failed to insert reading: %v", err)
+	}
+
+	if err := refresher.RunOnce(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := len(rollupsOf(t, repo, repository.Rollup15Min, client, old)); n != 1 {
+		t.Errorf("Expected the change past the lookback refreshed, got %d rollups", n)
+	}
+	if n := countRows(t, pool, "reading_rollup_invalidations", ""); n != 0 {
+		t.Errorf("Expected the late change drained, got %d left", n)
+	}
+}
+
+func TestMigrate_BackfillsRollupsOfExistingReadings(t *testing.T) {
+	pool := testDB(t)
+	_, repo := newTestProcessor(t, pool, testConfig())
+	ctx := context.Background()
+
+	migrator, err := migrate.New(pool, migrate.VariantAuto, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Back to before the rollups existed
+	if _, err := migrator.Down(ctx, 3); err != nil {
+		t.Fatalf("Failed to revert the rollups: %v", err)
+	}
+
+	client := uuid.New()
+	base := yesterday()
+	_, err = pool.Exec(ctx, `
+		INSERT INTO meter_clients (id, client_fingerprint, ip_address, first_seen_at, last_seen_at)
+		VALUES ($1, 'meter-a', '10.0.0.1', now(), now())
+	`, client)
+	if err != nil {
+		t.Fatalf("Failed to insert client: %v", err)
+	}
+	_, err = pool.Exec(ctx, `
+		INSERT INTO meter_readings_raw (client_id, metric_name, metric_value, reading_timestamp, received_at, validation_status, raw_payload)
+		SELECT $1, 'voltage', 220 + n, $2::timestamptz + offsets.o, now(), 'valid', '{}'
+		FROM (VALUES (0, INTERVAL '0'), (1, INTERVAL '15 minutes'), (2, INTERVAL '1 hour')) AS offsets(n, o)
+	`, client, base)
+	if err != nil {
+		t.Fatalf("Failed to insert readings: %v", err)
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	expectBuckets(t, "15m", rollupsOf(t, repo, repository.Rollup15Min, client, base),
+		[]time.Time{base, base.Add(15 * time.Minute), base.Add(time.Hour)},
+		[]int64{1, 1, 1})
+	expectBuckets(t, "1h", rollupsOf(t, repo, repository.RollupHourly, client, base),
+		[]time.Time{base, base.Add(time.Hour)},
+		[]int64{2, 1})
+	expectBuckets(t, "1d", rollupsOf(t, repo, repository.RollupDaily, client, base),
+		[]time.Time{base.Truncate(24 * time.Hour)},
+		[]int64{3})
+}
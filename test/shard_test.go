@@ -0,0 +1,46 @@
+package anomaly_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/mq"
+	"github.com/septivank/energy-metering-worker/internal/service"
+)
+
+func TestShardIndex_StableAndInRange(t *testing.T) {
+	const shards = 4
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		idx := mq.ShardIndex(key, shards)
+
+		if idx < 0 || idx >= shards {
+			t.Fatalf("Shard index %d out of range for key %s", idx, key)
+		}
+
+		if again := mq.ShardIndex(key, shards); again != idx {
+			t.Fatalf("Expected stable shard for key %s, got %d and %d", key, idx, again)
+		}
+	}
+}
+
+func TestShardIndex_SingleShard(t *testing.T) {
+	if idx := mq.ShardIndex("any-client", 1); idx != 0 {
+		t.Errorf("Expected shard 0, got %d", idx)
+	}
+}
+
+func TestShardKey_ExtractsFingerprint(t *testing.T) {
+	body := []byte(`{"request_id":"r1","client_fingerprint":"abc123","payload":{"PM":[]}}`)
+
+	if key := service.ShardKey(body); key != "abc123" {
+		t.Errorf("Expected key 'abc123', got '%s'", key)
+	}
+}
+
+func TestShardKey_MalformedBody(t *testing.T) {
+	if key := service.ShardKey([]byte("not json")); key != "" {
+		t.Errorf("Expected empty key for malformed body, got '%s'", key)
+	}
+}
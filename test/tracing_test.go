@@ -0,0 +1,80 @@
+package anomaly_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTracer(t *testing.T) trace.Tracer {
+	t.Helper()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return sdktrace.NewTracerProvider().Tracer("test")
+}
+
+func TestTracing_AMQPHeadersRoundTrip(t *testing.T) {
+	tracer := newTestTracer(t)
+	ctx, span := tracer.Start(context.Background(), "publish")
+	defer span.End()
+
+	headers := tracing.InjectAMQP(ctx, nil)
+	if _, ok := headers["traceparent"].(string); !ok {
+		t.Fatalf("Expected traceparent header, got %v", headers)
+	}
+
+	extracted := trace.SpanContextFromContext(tracing.ExtractAMQP(context.Background(), headers))
+	if extracted.TraceID() != span.SpanContext().TraceID() {
+		t.Errorf("Expected trace ID %s, got %s", span.SpanContext().TraceID(), extracted.TraceID())
+	}
+	if !extracted.IsRemote() {
+		t.Error("Expected extracted span context to be remote")
+	}
+}
+
+func TestTracing_MapRoundTrip(t *testing.T) {
+	tracer := newTestTracer(t)
+	ctx, span := tracer.Start(context.Background(), "process")
+	defer span.End()
+
+	stored := tracing.InjectMap(ctx)
+	extracted := trace.SpanContextFromContext(tracing.ExtractMap(context.Background(), stored))
+	if extracted.TraceID() != span.SpanContext().TraceID() {
+		t.Errorf("Expected trace ID %s, got %s", span.SpanContext().TraceID(), extracted.TraceID())
+	}
+}
+
+func TestTracing_InjectMapWithoutSpan(t *testing.T) {
+	newTestTracer(t)
+	if stored := tracing.InjectMap(context.Background()); stored != nil {
+		t.Errorf("Expected no trace context, got %v", stored)
+	}
+}
+
+func TestTracing_StdoutExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter, err := tracing.NewExporter(context.Background(), tracing.ExporterStdout, &buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := provider.Tracer("test").Start(context.Background(), "consume energy-metering.ingest.queue")
+	span.End()
+	provider.Shutdown(context.Background())
+
+	if !bytes.Contains(buf.Bytes(), []byte("consume energy-metering.ingest.queue")) {
+		t.Errorf("Expected exported span, got %s", buf.String())
+	}
+}
+
+func TestTracing_UnknownExporter(t *testing.T) {
+	if _, err := tracing.NewExporter(context.Background(), "jaeger", nil); err == nil {
+		t.Error("Expected error for unknown exporter")
+	}
+}
@@ -0,0 +1,111 @@
+package anomaly_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/validator"
+)
+
+func TestConsistencyRule_Parse(t *testing.T) {
+	rule, err := validator.ParseConsistencyRule("active_power = voltage * current * power_factor ~ 5%")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"active_power", "voltage", "current", "power_factor"}
+	if strings.Join(rule.Metrics, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected metrics %v, got %v", expected, rule.Metrics)
+	}
+}
+
+func TestConsistencyRule_ParseErrors(t *testing.T) {
+	rules := []string{
+		"active_power voltage * current",
+		"a = b = c",
+		"active_power = voltage * (current",
+		"active_power = voltage * current ~ lots",
+		"active_power = log(voltage)",
+		"1 = 1",
+	}
+	for _, src := range rules {
+		if _, err := validator.ParseConsistencyRule(src); err == nil {
+			t.Errorf("Expected error for %q", src)
+		}
+	}
+}
+
+func TestConsistencyRule_Check(t *testing.T) {
+	rule, _ := validator.ParseConsistencyRule("active_power = voltage * current * power_factor / 1000 ~ 5%")
+
+	consistent := map[string]float64{"active_power": 2.2, "voltage": 230, "current": 10, "power_factor": 0.95}
+	if reason, ok := rule.Check(consistent); !ok {
+		t.Errorf("Expected consistent readings to pass, got: %s", reason)
+	}
+
+	inconsistent := map[string]float64{"active_power": 3.1, "voltage": 230, "current": 10, "power_factor": 0.95}
+	reason, ok := rule.Check(inconsistent)
+	if ok {
+		t.Fatal("Expected inconsistent readings to fail")
+	}
+	if !strings.HasPrefix(reason, "inconsistent metrics: active_power = 3.10 vs voltage * current * power_factor / 1000 = 2.19 (tolerance 5%)") {
+		t.Errorf("Unexpected reason: %s", reason)
+	}
+}
+
+func TestConsistencyRule_AbsoluteToleranceAndFunctions(t *testing.T) {
+	rule, err := validator.ParseConsistencyRule("apparent_power = sqrt(active_power * active_power + reactive_power * reactive_power) ~ 0.5")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, ok := rule.Check(map[string]float64{"apparent_power": 5.3, "active_power": 3, "reactive_power": 4}); !ok {
+		t.Error("Expected difference within absolute tolerance to pass")
+	}
+	if _, ok := rule.Check(map[string]float64{"apparent_power": 5.6, "active_power": 3, "reactive_power": 4}); ok {
+		t.Error("Expected difference beyond absolute tolerance to fail")
+	}
+}
+
+func TestConsistencyRule_SkipsIncompleteGroups(t *testing.T) {
+	rule, _ := validator.ParseConsistencyRule("power_factor = active_power / apparent_power")
+
+	if _, ok := rule.Check(map[string]float64{"power_factor": 0.9, "active_power": 100}); !ok {
+		t.Error("Expected rule to pass when a metric is missing")
+	}
+	if _, ok := rule.Check(map[string]float64{"power_factor": 0.9, "active_power": 100, "apparent_power": 0}); !ok {
+		t.Error("Expected rule to pass when it does not evaluate to a finite number")
+	}
+}
+
+func TestValidator_CheckConsistency(t *testing.T) {
+	v, err := validator.NewValidatorWithConfig(testTimestampToleranceMinutes, validator.Config{
+		ConsistencyRules: []string{
+			"active_power_l1 = voltage_l1 * current_l1 ~ 5%",
+			"active_power_l2 = voltage_l2 * current_l2 ~ 5%",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	violations := v.CheckConsistency(map[string]float64{
+		"active_power_l1": 2300, "voltage_l1": 230, "current_l1": 10,
+		"active_power_l2": 900, "voltage_l2": 230, "current_l2": 10,
+	})
+
+	if _, ok := violations["active_power_l1"]; ok {
+		t.Error("Expected phase 1 to be consistent")
+	}
+	for _, name := range []string{"active_power_l2", "voltage_l2", "current_l2"} {
+		if len(violations[name]) != 1 {
+			t.Errorf("Expected %s to be flagged once, got %v", name, violations[name])
+		}
+	}
+
+	if _, err := validator.NewValidatorWithConfig(testTimestampToleranceMinutes, validator.Config{
+		ConsistencyRules: []string{"active_power ="},
+	}); err == nil {
+		t.Error("Expected error for malformed rule")
+	}
+}
@@ -0,0 +1,132 @@
+package anomaly_test
+
+import (
+	"testing"
+
+	"github.com/septivank/energy-metering-worker/internal/validator"
+)
+
+func newCounterValidator(t *testing.T) *validator.Validator {
+	t.Helper()
+	v, err := validator.NewValidatorWithConfig(testTimestampToleranceMinutes, validator.Config{
+		Counters: validator.CounterConfig{
+			Metrics:     []string{"energy_*", "*_kwh"},
+			RolloverMax: 99999.99,
+			ResetMax:    1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return v
+}
+
+func expectDelta(t *testing.T, result validator.CounterResult, want float64) {
+	t.Helper()
+	if !result.IsValid {
+		t.Fatalf("Expected valid counter reading, got: %s", result.AnomalyReason)
+	}
+	if result.Delta == nil {
+		t.Fatal("Expected delta, got nil")
+	}
+	if diff := *result.Delta - want; diff > 1e-6 || diff < -1e-6 {
+		t.Errorf("Expected delta %.2f, got %.2f", want, *result.Delta)
+	}
+}
+
+func TestCounter_IsCounter(t *testing.T) {
+	v := newCounterValidator(t)
+
+	for _, name := range []string{"energy_import", "total_kwh"} {
+		if !v.IsCounter(name) {
+			t.Errorf("Expected %s to be a counter", name)
+		}
+	}
+	if v.IsCounter("voltage") {
+		t.Error("Expected voltage to be a gauge")
+	}
+	if validator.NewValidator(testTimestampToleranceMinutes).IsCounter("energy_import") {
+		t.Error("Expected no counters without configuration")
+	}
+}
+
+func TestCounter_ForwardDelta(t *testing.T) {
+	v := newCounterValidator(t)
+	previous := 1200.5
+
+	result := v.ValidateCounter(1203.75, &previous)
+	expectDelta(t, result, 3.25)
+	if result.Event != "" {
+		t.Errorf("Expected no counter event, got %q", result.Event)
+	}
+
+	expectDelta(t, v.ValidateCounter(1200.5, &previous), 0)
+}
+
+func TestCounter_FirstReading(t *testing.T) {
+	v := newCounterValidator(t)
+
+	result := v.ValidateCounter(1200.5, nil)
+	if !result.IsValid || result.Delta != nil {
+		t.Errorf("Expected valid reading without delta, got %+v", result)
+	}
+}
+
+func TestCounter_Rollover(t *testing.T) {
+	v := newCounterValidator(t)
+	previous := 99998.0
+
+	result := v.ValidateCounter(3.0, &previous)
+	expectDelta(t, result, 4.99)
+	if result.Event != validator.CounterRollover {
+		t.Errorf("Expected rollover, got %q", result.Event)
+	}
+}
+
+func TestCounter_Reset(t *testing.T) {
+	v := newCounterValidator(t)
+	previous := 5230.0
+
+	result := v.ValidateCounter(0.4, &previous)
+	expectDelta(t, result, 0.4)
+	if result.Event != validator.CounterReset {
+		t.Errorf("Expected reset, got %q", result.Event)
+	}
+}
+
+func TestCounter_Backwards(t *testing.T) {
+	v := newCounterValidator(t)
+	previous := 5230.0
+
+	result := v.ValidateCounter(5100.0, &previous)
+	if result.IsValid {
+		t.Fatal("Expected backwards counter to be invalid")
+	}
+	if result.AnomalyReason != "counter went backwards: value 5100.00 below previous 5230.00" {
+		t.Errorf("Unexpected reason: %s", result.AnomalyReason)
+	}
+	if result.Delta != nil {
+		t.Errorf("Expected no delta, got %v", *result.Delta)
+	}
+}
+
+func TestCounter_AboveRegisterMaximum(t *testing.T) {
+	v := newCounterValidator(t)
+
+	if result := v.ValidateCounter(100000.0, nil); result.IsValid {
+		t.Error("Expected value above the register maximum to be invalid")
+	}
+}
+
+func TestCounter_InvalidConfig(t *testing.T) {
+	configs := []validator.CounterConfig{
+		{Metrics: []string{"[energy"}},
+		{RolloverMax: -1},
+		{RolloverMax: 100, ResetMax: 100},
+	}
+	for _, cfg := range configs {
+		if _, err := validator.NewValidatorWithConfig(testTimestampToleranceMinutes, validator.Config{Counters: cfg}); err == nil {
+			t.Errorf("Expected error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package anomaly_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/septivank/energy-metering-worker/internal/validator"
+)
+
+const testRules = `
+rules:
+  - id: voltage-range
+    metrics: ["voltage", "voltage_l*"]
+    min: 180
+    max: 260
+    units: ["V"]
+    precision: 2
+  - id: export-power
+    metrics: ["export_power*"]
+    allow_negative: true
+  - id: energy-register
+    metrics: ["energy_*"]
+    max_rate_per_hour: 500
+`
+
+func newRulesValidator(t *testing.T) *validator.Validator {
+	t.Helper()
+	rules, err := validator.ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	v, err := validator.NewValidatorWithConfig(testTimestampToleranceMinutes, validator.Config{Rules: rules})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return v
+}
+
+func validateWithRules(v *validator.Validator, name, data, unit string) validator.ValidationResult {
+	_, _, result := v.ValidateMetricData(validator.MetricData{
+		Date: "29/12/2025 10:30:00",
+		Data: data,
+		Name: name,
+		Unit: unit,
+	}, time.Date(2025, 12, 29, 10, 32, 0, 0, time.UTC))
+	return result
+}
+
+func TestRules_Limits(t *testing.T) {
+	v := newRulesValidator(t)
+
+	tests := []struct {
+		name, data, unit string
+		reason           string
+	}{
+		{"voltage_l1", "230.5", "V", ""},
+		{"voltage_l1", "230.5", "", ""},
+		{"voltage_l1", "175.00", "V", "rule voltage-range: value 175.00 below minimum 180.00"},
+		{"voltage", "270", "V", "rule voltage-range: value 270.00 above maximum 260.00"},
+		{"voltage", "230", "kV", `rule voltage-range: unit "kV" not allowed (V)`},
+		{"voltage", "230.125", "V", "rule voltage-range: value 230.125 has 3 decimal places, at most 2 allowed"},
+		{"voltage", "-230", "V", "rule voltage-range: negative value detected"},
+		{"export_power", "-1250.5", "", ""},
+		{"current", "-3", "", "negative value detected"},
+	}
+
+	for _, tt := range tests {
+		result := validateWithRules(v, tt.name, tt.data, tt.unit)
+		if tt.reason == "" && !result.IsValid {
+			t.Errorf("%s=%s: expected valid, got %q", tt.name, tt.data, result.AnomalyReason)
+		}
+		if tt.reason != "" && result.AnomalyReason != tt.reason {
+			t.Errorf("%s=%s: expected %q, got %q", tt.name, tt.data, tt.reason, result.AnomalyReason)
+		}
+	}
+}
+
+func TestRules_FirstMatchApplies(t *testing.T) {
+	rules, err := validator.ParseRules([]byte(`{"rules": [
+		{"id": "l1", "metrics": ["voltage_l1"], "max": 300},
+		{"id": "all", "metrics": ["voltage*"], "max": 250}
+	]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing JSON rules: %v", err)
+	}
+	v, _ := validator.NewValidatorWithConfig(testTimestampToleranceMinutes, validator.Config{Rules: rules})
+
+	if rule := v.RuleFor("voltage_l1"); rule == nil || rule.ID != "l1" {
+		t.Errorf("Expected rule l1, got %+v", rule)
+	}
+	if rule := v.RuleFor("voltage_l2"); rule == nil || rule.ID != "all" {
+		t.Errorf("Expected rule all, got %+v", rule)
+	}
+	if v.RuleFor("current") != nil {
+		t.Error("Expected no rule for current")
+	}
+}
+
+func TestRules_Rate(t *testing.T) {
+	v := newRulesValidator(t)
+
+	if result := v.ValidateRate("energy_import", 100, 30*time.Minute); !result.IsValid {
+		t.Errorf("Expected 200/h to pass, got %q", result.AnomalyReason)
+	}
+
+	result := v.ValidateRate("energy_import", 400, 30*time.Minute)
+	if result.IsValid {
+		t.Fatal("Expected 800/h to be invalid")
+	}
+	if result.AnomalyReason != "rule energy-register: rate of change 800.00/h exceeds 500.00/h" {
+		t.Errorf("Unexpected reason: %s", result.AnomalyReason)
+	}
+
+	if result := v.ValidateRate("voltage", 1000, time.Minute); !result.IsValid {
+		t.Error("Expected metric without rate limit to pass")
+	}
+}
+
+func TestRules_AllowsNegative(t *testing.T) {
+	v := newRulesValidator(t)
+
+	if !v.AllowsNegative("export_power_l1") {
+		t.Error("Expected export power to allow negative values")
+	}
+	if v.AllowsNegative("voltage") || v.AllowsNegative("current") {
+		t.Error("Expected negative values to be rejected by default")
+	}
+}
+
+func TestRules_ParseErrors(t *testing.T) {
+	files := map[string]string{
+		"missing id":      `rules: [{metrics: ["voltage"]}]`,
+		"missing metrics": `rules: [{id: v}]`,
+		"bad pattern":     `rules: [{id: v, metrics: ["[voltage"]}]`,
+		"min above max":   `rules: [{id: v, metrics: ["voltage"], min: 10, max: 5}]`,
+		"duplicate id":    `rules: [{id: v, metrics: ["a"]}, {id: v, metrics: ["b"]}]`,
+		"bad rate":        `rules: [{id: v, metrics: ["a"], max_rate_per_hour: 0}]`,
+		"not yaml":        `rules: [`,
+	}
+	for name, data := range files {
+		if _, err := validator.ParseRules([]byte(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		} else if !strings.Contains(err.Error(), "validation rule") {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestRules_ExampleFile(t *testing.T) {
+	rules, err := validator.LoadRules("../validation-rules.example.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(rules) == 0 {
+		t.Error("Expected example rules")
+	}
+}